@@ -7,12 +7,24 @@ import (
 	"log"
 	"os"
 	"runtime/debug"
+	"strings"
 
 	editormod "github.com/amirali/virayeshgar/editor"
+	"github.com/amirali/virayeshgar/editor/term"
 )
 
 func main() {
 	debugFlag := flag.Bool("debug", false, "flag to enable debug logging")
+	flag.BoolVar(&editormod.Hidden, "hidden", editormod.Hidden, "keep unsaved changes in hidden buffers when switching buffers")
+	flag.BoolVar(&editormod.IgnoreCase, "ignorecase", editormod.IgnoreCase, "ignore case in search patterns")
+	flag.BoolVar(&editormod.SmartCase, "smartcase", editormod.SmartCase, "with -ignorecase, don't ignore case in patterns with upper case letters")
+	flag.BoolVar(&editormod.HlSearch, "hlsearch", editormod.HlSearch, "highlight every match of the last search pattern")
+	flag.StringVar(&editormod.UndoDir, "undodir", editormod.UndoDir, "directory to keep undo history in, empty to disable")
+	flag.Func("langmap", "keys of another keyboard layout to take for commands, one of "+strings.Join(editormod.LangmapNames(), ", ")+` or pairs like "ضq,صw"`, func(s string) error {
+		m, err := editormod.ParseLangmap(s)
+		editormod.Langmap = m
+		return err
+	})
 	flag.Parse()
 
 	var outfile io.Writer
@@ -32,20 +44,22 @@ func main() {
 
 	var editor editormod.Editor
 
-	if err := editor.Init(logger); err != nil {
+	if err := editor.Init(term.NewTTY(os.Stdin, os.Stdout), logger); err != nil {
 		editormod.Die(err)
 	}
 	defer editor.Close()
 
-	if len(flag.Args()) > 0 {
-		err := editor.OpenFile(flag.Arg(0))
+	for _, filename := range flag.Args() {
+		err := editor.OpenFile(filename)
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			editormod.Die(err)
 		}
 	}
-
-	if len(editor.Rows) == 0 {
-		editor.Rows = append(editor.Rows, &editormod.Row{})
+	if flag.NArg() > 1 {
+		// start on the first file.
+		if err := editor.SwitchBuffer(1); err != nil {
+			editormod.Die(err)
+		}
 	}
 
 	editor.SetStatusMessage("-- NORMAL --")
@@ -1,9 +0,0 @@
-package actions
-
-type Action int
-
-const (
-	Cut Action = iota
-	Paste
-	Edit
-)
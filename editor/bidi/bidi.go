@@ -0,0 +1,262 @@
+// Package bidi puts lines of bidirectional text in the order they are shown
+// in, following the Unicode Bidirectional Algorithm (UAX #9).
+//
+// Every line is a paragraph of its own, its direction taken from its first
+// strong character. Explicit embeddings, overrides and isolates are taken
+// for neutral characters, and brackets aren't paired (rule N0).
+package bidi
+
+import (
+	"golang.org/x/text/unicode/bidi"
+)
+
+// HasRTL reports whether text has right-to-left characters, or Arabic
+// digits. Text without any is shown in its logical order.
+func HasRTL(text string) bool {
+	for _, r := range text {
+		if r < 0x0590 {
+			continue
+		}
+		switch class(r) {
+		case bidi.R, bidi.AL, bidi.AN:
+			return true
+		}
+	}
+	return false
+}
+
+func class(r rune) bidi.Class {
+	props, _ := bidi.LookupRune(r)
+	switch c := props.Class(); c {
+	case bidi.LRO, bidi.RLO, bidi.LRE, bidi.RLE, bidi.PDF, bidi.LRI, bidi.RLI, bidi.FSI, bidi.PDI:
+		return bidi.ON
+	default:
+		return c
+	}
+}
+
+// Levels returns the embedding level of every character of the line,
+// odd levels going right to left.
+func Levels(text []rune) []uint8 {
+	n := len(text)
+	types := make([]bidi.Class, n)
+	for i, r := range text {
+		types[i] = class(r)
+	}
+	orig := append([]bidi.Class(nil), types...)
+
+	// P2, P3: the paragraph level.
+	var para uint8
+	for _, t := range types {
+		if t == bidi.L {
+			break
+		}
+		if t == bidi.R || t == bidi.AL {
+			para = 1
+			break
+		}
+	}
+	sos := bidi.L
+	if para == 1 {
+		sos = bidi.R
+	}
+
+	// W1: non-spacing marks take the type of the character before them.
+	prev := sos
+	for i, t := range types {
+		if t == bidi.NSM {
+			types[i] = prev
+		}
+		prev = types[i]
+	}
+	// W2, W3: European numbers after Arabic letters are Arabic numbers, and
+	// Arabic letters are right to left.
+	strong := sos
+	for i, t := range types {
+		switch t {
+		case bidi.L, bidi.R:
+			strong = t
+		case bidi.AL:
+			strong = t
+			types[i] = bidi.R
+		case bidi.EN:
+			if strong == bidi.AL {
+				types[i] = bidi.AN
+			}
+		}
+	}
+	// W4: a single separator between two numbers of the same type joins
+	// them.
+	for i := 1; i+1 < n; i++ {
+		before, after := types[i-1], types[i+1]
+		switch types[i] {
+		case bidi.ES:
+			if before == bidi.EN && after == bidi.EN {
+				types[i] = bidi.EN
+			}
+		case bidi.CS:
+			if before == after && (before == bidi.EN || before == bidi.AN) {
+				types[i] = before
+			}
+		}
+	}
+	// W5: terminators next to European numbers belong to them.
+	for i := 0; i < n; {
+		if types[i] != bidi.ET {
+			i++
+			continue
+		}
+		j := i
+		for j < n && types[j] == bidi.ET {
+			j++
+		}
+		if i > 0 && types[i-1] == bidi.EN || j < n && types[j] == bidi.EN {
+			for k := i; k < j; k++ {
+				types[k] = bidi.EN
+			}
+		}
+		i = j
+	}
+	// W6: the separators and terminators left are neutral.
+	for i, t := range types {
+		if t == bidi.ES || t == bidi.ET || t == bidi.CS {
+			types[i] = bidi.ON
+		}
+	}
+	// W7: European numbers in left to right text are left to right.
+	strong = sos
+	for i, t := range types {
+		switch t {
+		case bidi.L, bidi.R:
+			strong = t
+		case bidi.EN:
+			if strong == bidi.L {
+				types[i] = bidi.L
+			}
+		}
+	}
+	// N1, N2: neutrals between text of the same direction take it, the
+	// others take the direction of the paragraph.
+	direction := func(t bidi.Class) bidi.Class {
+		if t == bidi.EN || t == bidi.AN {
+			return bidi.R
+		}
+		return t
+	}
+	for i := 0; i < n; {
+		if !neutral(types[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < n && neutral(types[j]) {
+			j++
+		}
+		before, after := sos, sos
+		if i > 0 {
+			before = direction(types[i-1])
+		}
+		if j < n {
+			after = direction(types[j])
+		}
+		fill := sos
+		if before == after {
+			fill = before
+		}
+		for k := i; k < j; k++ {
+			types[k] = fill
+		}
+		i = j
+	}
+
+	// I1, I2: the resolved levels.
+	levels := make([]uint8, n)
+	for i, t := range types {
+		levels[i] = para
+		switch {
+		case para == 0 && t == bidi.R:
+			levels[i]++
+		case para == 0 && (t == bidi.AN || t == bidi.EN):
+			levels[i] += 2
+		case para == 1 && (t == bidi.L || t == bidi.AN || t == bidi.EN):
+			levels[i]++
+		}
+	}
+
+	// L1: separators and the white space before them, or at the end of the
+	// line, go back to the paragraph level.
+	trailing := true
+	for i := n - 1; i >= 0; i-- {
+		switch orig[i] {
+		case bidi.S, bidi.B:
+			levels[i] = para
+			trailing = true
+		case bidi.WS, bidi.BN:
+			if trailing {
+				levels[i] = para
+			}
+		default:
+			trailing = false
+		}
+	}
+	return levels
+}
+
+func neutral(t bidi.Class) bool {
+	switch t {
+	case bidi.B, bidi.S, bidi.WS, bidi.ON, bidi.BN:
+		return true
+	}
+	return false
+}
+
+// VisualOrder returns the indices of the characters with the given levels
+// in the order they are shown in, from left to right (rule L2).
+func VisualOrder(levels []uint8) []int {
+	order := make([]int, len(levels))
+	var highest, lowest uint8 = 0, 255
+	for i, l := range levels {
+		order[i] = i
+		highest, lowest = max(highest, l), min(lowest, l)
+	}
+	// reverse every run at each level or higher, from the highest level
+	// down to the lowest odd one.
+	for level := highest; level >= lowest|1; level-- {
+		for i := 0; i < len(order); {
+			if levels[order[i]] < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(order) && levels[order[j]] >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				order[a], order[b] = order[b], order[a]
+			}
+			i = j
+		}
+	}
+	return order
+}
+
+// mirrors pairs the characters that are shown mirrored in right to left
+// text (rule L4).
+var mirrors = map[rune]rune{
+	'(': ')', ')': '(',
+	'[': ']', ']': '[',
+	'{': '}', '}': '{',
+	'<': '>', '>': '<',
+	'«': '»', '»': '«',
+	'‹': '›', '›': '‹',
+}
+
+// Mirror returns how r looks at the given level.
+func Mirror(r rune, level uint8) rune {
+	if level%2 == 1 {
+		if m, ok := mirrors[r]; ok {
+			return m
+		}
+	}
+	return r
+}
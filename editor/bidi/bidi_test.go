@@ -0,0 +1,106 @@
+package bidi
+
+import (
+	"strings"
+	"testing"
+)
+
+// visual returns text as it is shown, from left to right.
+func visual(text string) string {
+	runes := []rune(text)
+	levels := Levels(runes)
+	var b strings.Builder
+	for _, i := range VisualOrder(levels) {
+		b.WriteRune(Mirror(runes[i], levels[i]))
+	}
+	return b.String()
+}
+
+func levelString(levels []uint8) string {
+	var b strings.Builder
+	for _, l := range levels {
+		b.WriteByte('0' + l)
+	}
+	return b.String()
+}
+
+func TestLevels(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		levels string
+		visual string
+	}{
+		{"left to right", "abc def", "0000000", "abc def"},
+		{"right to left", "سلام", "1111", "مالس"},
+		{"rtl inside ltr", "abc سلام def", "000011110000", "abc مالس def"},
+		{"ltr inside rtl", "سلام abc", "11111222", "abc مالس"},
+		{"arabic numbers inside rtl", "سلام 123 دنیا", "1111122211111", "ایند 123 مالس"},
+		{"european numbers inside hebrew", "שלום 123", "11111222", "123 םולש"},
+		{"persian digits", "سلام ۱۲", "1111122", "۱۲ مالس"},
+		{"number with a separator in rtl", "سلام 1.5", "11111222", "1.5 مالس"},
+		{"number with a separator in ltr", "a 1.5 b", "0000000", "a 1.5 b"},
+		{"terminator joins a european number", "שלום 50%", "11111222", "50% םולש"},
+		{"terminator stays off an arabic number", "سلام 50%", "11111221", "%50 مالس"},
+		{"neutral between ltr and rtl", "abc! سلام", "000001111", "abc! مالس"},
+		{"neutral between rtl and ltr", "سلام! abc", "111111222", "abc !مالس"},
+		{"neutral between rtl runs", "سلام - دنیا", "11111111111", "ایند - مالس"},
+		{"trailing white space", "abc سلام ", "000011110", "abc مالس "},
+		{"brackets are mirrored", "(سلام)", "111111", "(مالس)"},
+		{"mark takes its letter's level", "abc سَلام", "000011111", "abc مالَس"},
+		{"empty", "", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := levelString(Levels([]rune(test.text))); got != test.levels {
+				t.Errorf("levels of %q = %s, want %s", test.text, got, test.levels)
+			}
+			if got := visual(test.text); got != test.visual {
+				t.Errorf("%q is shown as %q, want %q", test.text, got, test.visual)
+			}
+		})
+	}
+}
+
+func TestVisualOrder(t *testing.T) {
+	tests := []struct {
+		levels []uint8
+		want   []int
+	}{
+		{[]uint8{0, 0, 0}, []int{0, 1, 2}},
+		{[]uint8{1, 1, 1}, []int{2, 1, 0}},
+		{[]uint8{0, 1, 1, 0}, []int{0, 2, 1, 3}},
+		{[]uint8{1, 2, 2, 1}, []int{3, 1, 2, 0}},
+		{[]uint8{0, 1, 2, 2, 1, 0}, []int{0, 4, 2, 3, 1, 5}},
+	}
+	for _, test := range tests {
+		got := VisualOrder(test.levels)
+		if len(got) != len(test.want) {
+			t.Errorf("VisualOrder(%v) = %v, want %v", test.levels, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("VisualOrder(%v) = %v, want %v", test.levels, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHasRTL(t *testing.T) {
+	for text, want := range map[string]bool{
+		"abc 123":    false,
+		"سلام":       true,
+		"abc שלום":   true,
+		"۱۲۳":        false,
+		"٣":          true,
+		"«quoted»":   false,
+		"\u202bx":    false,
+		"naïve café": false,
+	} {
+		if got := HasRTL(text); got != want {
+			t.Errorf("HasRTL(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
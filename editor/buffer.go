@@ -0,0 +1,310 @@
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/amirali/virayeshgar/editor/rope"
+	"github.com/amirali/virayeshgar/editor/syntax"
+)
+
+// Hidden lets the editor move away from a buffer with unsaved changes, which
+// keeps them around in the hidden buffer. Without it, leaving such a buffer
+// takes a ! after the command.
+var Hidden = true
+
+var ErrNoWriteSinceLastChange = errors.New("No write since last change (add ! to override)")
+
+// Buffer is the text of a file being edited, along with everything that
+// goes with it, like its undo history.
+type Buffer struct {
+	// number identifies the buffer in the buffer list.
+	number int
+
+	filename string
+
+	// Rows holds the lines of the file, the lines that weren't read yet
+	// in runs of one row each.
+	Rows rope.Rope[*Row]
+	// loader reads the file in the background.
+	loader *loader
+
+	dirty int
+	// changes counts the changes made to the buffer, written or not.
+	changes int
+
+	syntax *syntax.EditorSyntax
+
+	undoTree undoTree
+
+	lastVisual visualSelection
+	// marks holds the positions set with m, by their letter.
+	marks map[rune]position
+	// lowestMarked is the first row that may be marked for :global.
+	lowestMarked int
+
+	// lastView is where the cursor was when the buffer was last shown.
+	lastView view
+}
+
+// view is the position of the cursor and of the screen on a buffer.
+type view struct {
+	cx, cy               int
+	rowOffset, colOffset int
+}
+
+// newBuffer adds an empty buffer to the buffer list.
+func (e *Editor) newBuffer(filename string) *Buffer {
+	e.lastBufferNumber++
+	b := &Buffer{
+		number:   e.lastBufferNumber,
+		filename: filename,
+		undoTree: newUndoTree(),
+	}
+	b.Rows = b.Rows.Insert(0, &Row{})
+	e.buffers = append(e.buffers, b)
+	return b
+}
+
+// showBuffer makes b the current buffer.
+func (e *Editor) showBuffer(b *Buffer) {
+	if b == e.Buffer {
+		return
+	}
+	e.commitUndo()
+	e.Buffer.lastView = e.view
+	e.alternate = e.Buffer
+	e.Buffer = b
+	e.view = b.lastView
+	e.clampCursor()
+}
+
+// leaveBuffer reports whether the current buffer may be left for another
+// one.
+func (e *Editor) leaveBuffer(force bool) error {
+	if e.dirty > 0 && !Hidden && !force {
+		return ErrNoWriteSinceLastChange
+	}
+	return nil
+}
+
+// findBuffer returns the buffer editing filename, if any.
+func (e *Editor) findBuffer(filename string) *Buffer {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil
+	}
+	for _, b := range e.buffers {
+		if b.filename == "" {
+			continue
+		}
+		if babs, err := filepath.Abs(b.filename); err == nil && babs == abs {
+			return b
+		}
+	}
+	return nil
+}
+
+// bufferIndex returns where the current buffer is in the buffer list.
+func (e *Editor) bufferIndex() int {
+	return slices.Index(e.buffers, e.Buffer)
+}
+
+// SwitchBuffer makes the buffer with the given number the current one.
+func (e *Editor) SwitchBuffer(number int) error {
+	for _, b := range e.buffers {
+		if b.number == number {
+			e.showBuffer(b)
+			return nil
+		}
+	}
+	return fmt.Errorf("Buffer %d does not exist", number)
+}
+
+// EditFile opens filename in a buffer of its own and makes it the current
+// buffer. If the file is open already, it goes to its buffer instead.
+func (e *Editor) EditFile(filename string, force bool) error {
+	if b := e.findBuffer(filename); b != nil {
+		if b == e.Buffer {
+			return nil
+		}
+		if err := e.leaveBuffer(force); err != nil {
+			return err
+		}
+		e.showBuffer(b)
+		return nil
+	}
+	if err := e.leaveBuffer(force); err != nil {
+		return err
+	}
+	return e.OpenFile(filename)
+}
+
+// ReloadFile reads the file of the current buffer again, dropping the
+// changes made to it unless they are saved. Its undo history starts over
+// like that of a file just opened, read from the undo file if there is one
+// for the text read: the states in it were of the text before.
+func (e *Editor) ReloadFile(force bool) error {
+	if e.filename == "" {
+		return errors.New("No file name")
+	}
+	if e.dirty > 0 && !force {
+		return ErrNoWriteSinceLastChange
+	}
+	err := e.loadFile(e.filename)
+	e.clampCursor()
+	return err
+}
+
+// NextBuffer moves count buffers forward in the buffer list, or backward
+// when count is negative, going round at its ends.
+func (e *Editor) NextBuffer(count int, force bool) error {
+	if err := e.leaveBuffer(force); err != nil {
+		return err
+	}
+	n := len(e.buffers)
+	i := ((e.bufferIndex()+count)%n + n) % n
+	e.showBuffer(e.buffers[i])
+	return nil
+}
+
+// DeleteBuffer removes the buffer with the given number, or the current one
+// when number is zero, from the buffer list. Its unsaved changes are lost,
+// which takes force.
+func (e *Editor) DeleteBuffer(number int, force bool) error {
+	b := e.Buffer
+	if number != 0 {
+		i := slices.IndexFunc(e.buffers, func(b *Buffer) bool { return b.number == number })
+		if i < 0 {
+			return fmt.Errorf("Buffer %d does not exist", number)
+		}
+		b = e.buffers[i]
+	}
+	if b.dirty > 0 && !force {
+		return fmt.Errorf("No write since last change for buffer %d (add ! to override)", b.number)
+	}
+
+	if b == e.Buffer {
+		// show the alternate buffer, or else the next one, in its place.
+		next := e.alternate
+		if next == nil || next == b {
+			if len(e.buffers) > 1 {
+				next = e.buffers[(e.bufferIndex()+1)%len(e.buffers)]
+			} else {
+				next = e.newBuffer("")
+			}
+		}
+		e.showBuffer(next)
+	}
+	for _, w := range e.allWindows() {
+		if w.Buffer == b {
+			w.Buffer, w.view = e.Buffer, e.Buffer.lastView
+		}
+	}
+	if e.alternate == b {
+		e.alternate = nil
+	}
+	if b.loader != nil {
+		b.loader.close()
+	}
+	e.buffers = slices.DeleteFunc(e.buffers, func(x *Buffer) bool { return x == b })
+	return nil
+}
+
+// bufferList describes the buffers in the buffer list, like :ls.
+func (e *Editor) bufferList() string {
+	var list []string
+	for _, b := range e.buffers {
+		var flags string
+		switch b {
+		case e.Buffer:
+			flags = "%a"
+		case e.alternate:
+			flags = "#h"
+		default:
+			flags = " h"
+		}
+		if b.dirty > 0 {
+			flags += "+"
+		}
+		name := b.filename
+		if name == "" {
+			name = "[No Name]"
+		}
+		line := b.lastView.cy
+		if b == e.Buffer {
+			line = e.cy
+		}
+		list = append(list, fmt.Sprintf("%d %s %q line %d", b.number, flags, name, line+1))
+	}
+	return strings.Join(list, " | ")
+}
+
+// modifiedBuffer returns a buffer with unsaved changes, the current one if
+// it has any.
+func (e *Editor) modifiedBuffer() *Buffer {
+	if e.dirty > 0 {
+		return e.Buffer
+	}
+	for _, b := range e.buffers {
+		if b.dirty > 0 {
+			return b
+		}
+	}
+	return nil
+}
+
+// bufferCommand runs the buffer list commands. It reports false for other
+// commands.
+func (e *Editor) bufferCommand(name string, args []string) (bool, error) {
+	force := strings.HasSuffix(name, "!")
+	name = strings.TrimSuffix(name, "!")
+	arg := strings.Join(args, " ")
+
+	if name == "e" || name == "edit" {
+		if arg == "" {
+			return true, e.ReloadFile(force)
+		}
+		err := e.EditFile(arg, force)
+		if errors.Is(err, os.ErrNotExist) {
+			e.SetStatusMessage("%q [New]", arg)
+			return true, nil
+		}
+		return true, err
+	}
+
+	number := 0
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return true, fmt.Errorf("Invalid buffer number %q", arg)
+		}
+		number = n
+	}
+
+	switch name {
+	case "bn", "bnext":
+		return true, e.NextBuffer(max(number, 1), force)
+	case "bp", "bprevious", "bN", "bNext":
+		return true, e.NextBuffer(-max(number, 1), force)
+	case "b", "buffer":
+		if number == 0 {
+			return true, nil
+		}
+		if err := e.leaveBuffer(force); err != nil {
+			return true, err
+		}
+		return true, e.SwitchBuffer(number)
+	case "bd", "bdelete":
+		return true, e.DeleteBuffer(number, force)
+	case "ls", "buffers", "files":
+		e.SetStatusMessage("%s", e.bufferList())
+		return true, nil
+	}
+	return false, nil
+}
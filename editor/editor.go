@@ -1,27 +1,25 @@
 package editor
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"slices"
+	"regexp"
 	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
-	"golang.org/x/sys/unix"
 
-	actions "github.com/amirali/virayeshgar/editor/actions"
 	keys "github.com/amirali/virayeshgar/editor/keys"
 	modes "github.com/amirali/virayeshgar/editor/modes"
+	"github.com/amirali/virayeshgar/editor/rope"
 	"github.com/amirali/virayeshgar/editor/syntax"
+	"github.com/amirali/virayeshgar/editor/term"
 	"github.com/amirali/virayeshgar/tools"
 )
 
@@ -36,115 +34,133 @@ var (
 	ErrUnkownMotion   = errors.New("unknown motion")
 )
 
-var (
-	stdinfd  = int(os.Stdin.Fd())
-	stdoutfd = int(os.Stdout.Fd())
-)
-
 type Editor struct {
-	cx int
-	cy int
-	rx int
-
-	rowOffset int
-	colOffset int
-
-	screenRows int
-	screenCols int
-
-	Rows []*Row
-
-	dirty int
+	// termRows and termCols are the size of the terminal.
+	termRows int
+	termCols int
+
+	// Window is the current window, the one with the cursor, of the
+	// current tab page.
+	*Window
+	*TabPage
+	tabs []*TabPage
+
+	// buffers lists all buffers and alternate is the one shown before the
+	// current one.
+	buffers          []*Buffer
+	alternate        *Buffer
+	lastBufferNumber int
 
 	quitCounter int
 
-	filename string
-
 	statusmsg     string
 	statusmsgTime time.Time
 
-	syntax *syntax.EditorSyntax
-
-	origTermios *unix.Termios
+	// term is the terminal the editor reads keys from and draws on.
+	term term.Terminal
+	// screen is what the terminal shows, as last rendered, nil when it
+	// isn't known and has to be cleared before the next render.
+	screen *term.Screen
+	stats  RenderStats
 
 	mode           modes.Mode
 	command        string
 	motionRegister []keys.Key
-	yankRegister   string
-
-	// TODO: Implement this as an actual tree
-	undoPath []*UndoNode
+	yankRegister   register
+	// registers holds the named registers, selectedRegister is the one
+	// picked with " for the command being run.
+	registers        map[rune]register
+	selectedRegister rune
+	// hasCount is set when a count was typed for the command being run.
+	hasCount bool
+
+	// lastPattern is the last pattern searched for or substituted, and
+	// lastReplacement what it was last substituted with. searchBackward is
+	// set when the last search went backward, with ? or #.
+	lastPattern     string
+	lastReplacement string
+	searchBackward  bool
+	// noHighlight is set by :noh to stop highlighting the matches of the
+	// last pattern until the next search. incSearch is the pattern being
+	// typed and currentMatch the match the user is looking at, if any.
+	noHighlight  bool
+	incSearch    *regexp.Regexp
+	currentMatch *match
+	// highlightRe is the last pattern as compiled for the overlay, and
+	// searchMatches its matches as counted for the status bar.
+	highlightRe   *regexp.Regexp
+	searchMatches searchMatches
+	// inGlobal is set while :global runs its command.
+	inGlobal bool
+
+	// anchor is the end of the visual selection that stays put while the
+	// cursor moves.
+	anchor      position
+	blockInsert *blockInsert
+
+	// input decodes the keys read from the terminal.
+	input keys.Decoder
 
 	logger *log.Logger
 }
 
-type UndoNode struct {
-	undoType   actions.Action
-	beforeRows []*Row
-	afterRows  []*Row
-	// NOTE: considering one line changes for now
-	fromIdx int
-	toIdx   int
-}
-
-func enableRawMode() (*unix.Termios, error) {
-	t, err := unix.IoctlGetTermios(stdinfd, ioctlReadTermios)
-	if err != nil {
-		return nil, err
-	}
-	raw := *t
-	raw.Iflag &^= unix.BRKINT | unix.INPCK | unix.ISTRIP | unix.IXON
-	raw.Cflag |= unix.CS8
-	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
-	raw.Cc[unix.VMIN] = 0
-	raw.Cc[unix.VTIME] = 1
-	if err := unix.IoctlSetTermios(stdinfd, ioctlWriteTermios, &raw); err != nil {
-		return nil, err
-	}
-	return t, nil
-}
-
-func (e *Editor) Init(logger *log.Logger) error {
-	termios, err := enableRawMode()
-
+// Init sets the editor up to run in the terminal t.
+func (e *Editor) Init(t term.Terminal, logger *log.Logger) error {
+	e.term = t
 	e.logger = logger
 
-	if err != nil {
+	if err := t.MakeRaw(); err != nil {
 		return err
 	}
+	io.WriteString(t, "\x1b[?2004h") // turn bracketed paste on
 
-	e.origTermios = termios
 	e.mode = modes.NormalMode
-	e.undoPath = make([]*UndoNode, 0)
+	e.Window = newWindow(e.newBuffer(""))
+	e.TabPage = &TabPage{layout: e.Window.frame}
+	e.tabs = []*TabPage{e.TabPage}
+	defer e.layoutWindows()
 
-	ws, err := unix.IoctlGetWinsize(stdoutfd, unix.TIOCGWINSZ)
-	if err != nil || ws.Col == 0 {
-		if _, err = os.Stdout.Write([]byte("\x1b[999C\x1b[999B")); err != nil {
-			return err
-		}
-		if row, col, err := tools.GetCursorPosition(); err == nil {
-			e.screenRows = row
-			e.screenCols = col
-			return nil
-		}
-		return err
+	var err error
+	e.termRows, e.termCols, err = t.Size()
+	return err
+}
+
+// resize lays the windows out again for the new size of the terminal and
+// redraws the screen.
+func (e *Editor) resize() {
+	rows, cols, err := e.term.Size()
+	if err != nil || rows == 0 || cols == 0 {
+		return
 	}
-	e.screenRows = int(ws.Row) - 2
-	e.screenCols = int(ws.Col)
-	return nil
+	e.termRows, e.termCols = rows, cols
+	e.layoutWindows()
+	// windows that got taller show more of the text above, rather than
+	// rows past its end.
+	for _, w := range e.windows() {
+		w.rowOffset = min(w.rowOffset, max(w.Rows.Len()-w.screenRows, 0))
+	}
+	e.screen = nil
+	// Render scrolls every window to keep its cursor in sight.
+	e.Render()
 }
 
 func (e *Editor) Close() error {
-	if e.origTermios == nil {
-		return fmt.Errorf("raw mode is not enabled")
+	for _, b := range e.buffers {
+		if b.loader != nil {
+			b.loader.close()
+		}
 	}
-	// restore original termios.
-	return unix.IoctlSetTermios(stdinfd, ioctlWriteTermios, e.origTermios)
+	io.WriteString(e.term, "\x1b[?2004l") // turn bracketed paste off
+	return e.term.Restore()
 }
 
 type Row struct {
-	// Index within the file.
-	idx int
+	// src is the loader of the file the row was read from, as long as its
+	// text wasn't read yet. Such a row stands for a run of lines, line i
+	// starting at offset starts[i] of the file and ending with the
+	// newline before starts[i+1].
+	src    *loader
+	starts []int64
 	// Raw character data for the row as an array of runes.
 	chars []rune
 	// Actual chracters to draw on the screen.
@@ -153,6 +169,22 @@ type Row struct {
 	hl []uint8
 	// Indicates whether this row has unclosed multiline comment.
 	hasUnclosedComment bool
+	// order is the order the runes of render are shown in when the row has
+	// right-to-left text, nil otherwise. levels holds their bidi embedding
+	// levels.
+	order  []int
+	levels []uint8
+	// marked is set on the rows :global has yet to run its command on.
+	marked bool
+}
+
+// Weight returns the number of lines the row stands for, which is one once
+// it is loaded.
+func (row *Row) Weight() int {
+	if row.src == nil {
+		return 1
+	}
+	return len(row.starts) - 1
 }
 
 func Die(err error) {
@@ -162,41 +194,34 @@ func Die(err error) {
 	os.Exit(1)
 }
 
-// readKey reads a key press input from stdin.
-func readKey() (keys.Key, error) {
-	buf := make([]byte, 4)
+// readKey waits for a key press. Meanwhile it shows the rows the loader
+// finds in the file being opened, and redraws the screen when the terminal
+// is resized.
+func (e *Editor) readKey() (keys.Key, error) {
+	buf := make([]byte, 64)
 	for {
-		n, err := os.Stdin.Read(buf)
+		if k, ok := e.input.Next(); ok {
+			return k, nil
+		}
+		select {
+		case <-e.term.Resized():
+			e.resize()
+		default:
+		}
+		n, err := e.term.Read(buf)
 		if err != nil && err != io.EOF {
 			return 0, err
 		}
 		if n > 0 {
-			buf = bytes.TrimRightFunc(buf, func(r rune) bool { return r == 0 })
-			switch {
-			case bytes.Equal(buf, []byte("\x1b[A")):
-				return keys.KeyArrowUp, nil
-			case bytes.Equal(buf, []byte("\x1b[B")):
-				return keys.KeyArrowDown, nil
-			case bytes.Equal(buf, []byte("\x1b[C")):
-				return keys.KeyArrowRight, nil
-			case bytes.Equal(buf, []byte("\x1b[D")):
-				return keys.KeyArrowLeft, nil
-			case bytes.Equal(buf, []byte("\x1b[1~")), bytes.Equal(buf, []byte("\x1b[7~")),
-				bytes.Equal(buf, []byte("\x1b[H")), bytes.Equal(buf, []byte("\x1bOH")):
-				return keys.KeyHome, nil
-			case bytes.Equal(buf, []byte("\x1b[4~")), bytes.Equal(buf, []byte("\x1b[8~")),
-				bytes.Equal(buf, []byte("\x1b[F")), bytes.Equal(buf, []byte("\x1bOF")):
-				return keys.KeyEnd, nil
-			case bytes.Equal(buf, []byte("\x1b[3~")):
-				return keys.KeyDelete, nil
-			case bytes.Equal(buf, []byte("\x1b[5~")):
-				return keys.KeyPageUp, nil
-			case bytes.Equal(buf, []byte("\x1b[6~")):
-				return keys.KeyPageDown, nil
-
-			default:
-				return keys.Key(buf[0]), nil
-			}
+			e.input.Feed(buf[:n])
+			continue
+		}
+		// nothing came in for a while, an Esc on its own is the Esc key.
+		if k, ok := e.input.Flush(); ok {
+			return k, nil
+		}
+		if e.pollLoader(false) {
+			e.Render()
 		}
 	}
 }
@@ -208,23 +233,23 @@ func (e *Editor) MoveCursor(k keys.Key) {
 			e.cy--
 		}
 	case keys.NavKeyJ, keys.KeyArrowDown, keys.NavKeyRightCurly:
-		if e.cy < len(e.Rows) {
+		if e.cy < e.Rows.Len() {
 			e.cy++
 		}
 	case keys.NavKeyH, keys.KeyArrowLeft:
 		if e.cx != 0 {
-			e.cx--
+			e.cx = prevCluster(e.row(e.cy).chars, e.cx, 1)
 		} else if e.cy > 0 {
 			e.cy--
-			e.cx = len(e.Rows[e.cy].chars)
+			e.cx = len(e.row(e.cy).chars)
 		}
 	case keys.NavKeyL, keys.KeyArrowRight:
 		linelen := -1
-		if e.cy < len(e.Rows) {
-			linelen = len(e.Rows[e.cy].chars)
+		if e.cy < e.Rows.Len() {
+			linelen = len(e.row(e.cy).chars)
 		}
 		if linelen >= 0 && e.cx < linelen {
-			e.cx++
+			e.cx = clusterEnd(e.row(e.cy).chars, e.cx)
 		} else if linelen >= 0 && e.cx == linelen {
 			e.cy++
 			e.cx = 0
@@ -234,8 +259,8 @@ func (e *Editor) MoveCursor(k keys.Key) {
 	// If the cursor ends up past the end of the line it's on
 	// put the cursor at the end of the line.
 	var linelen int
-	if e.cy < len(e.Rows) {
-		linelen = len(e.Rows[e.cy].chars)
+	if e.cy < e.Rows.Len() {
+		linelen = len(e.row(e.cy).chars)
 	}
 	if e.cx > linelen {
 		e.cx = linelen
@@ -248,31 +273,8 @@ func (e *Editor) MoveCursorByRepeat(k keys.Key, repeat int) {
 	}
 }
 
-func (e *Editor) JumpParagraph(k keys.Key) {
-	row := e.cy
-	var targetSlice []*Row
-	if (row == 0 && k == keys.NavKeyLeftCurly) || (row == len(e.Rows) && k == keys.NavKeyRightCurly) {
-		return
-	}
-	e.logger.Println("     ", row)
-	switch k {
-	case keys.NavKeyLeftCurly:
-		targetSlice = slices.Clone(e.Rows[:row])
-		slices.Reverse(targetSlice)
-	case keys.NavKeyRightCurly:
-		targetSlice = e.Rows[row+1:]
-	}
-	for _, rowFinder := range targetSlice {
-		e.logger.Println(rowFinder.render, row)
-		e.MoveCursor(k)
-		if rowFinder.render == "" {
-			break
-		}
-	}
-}
-
 func (e *Editor) ProcessKeyInsertMode() error {
-	k, err := readKey()
+	k, err := e.readKey()
 	if err != nil {
 		return err
 	}
@@ -284,7 +286,7 @@ func (e *Editor) ProcessKeyInsertMode() error {
 		e.DeleteChar()
 
 	case keys.KeyDelete:
-		if e.cy == len(e.Rows)-1 && e.cx == len(e.Rows[e.cy].chars) {
+		if e.cy == e.Rows.Len()-1 && e.cx == len(e.row(e.cy).chars) {
 			// cursor is on the last row and one past the last character,
 			// no more character to delete to the right.
 			break
@@ -298,6 +300,9 @@ func (e *Editor) ProcessKeyInsertMode() error {
 	case keys.EscKey:
 		e.SetMode(modes.NormalMode)
 
+	case keys.KeyPaste:
+		e.InsertPasted(e.input.Pasted())
+
 	default:
 		e.InsertChar(rune(k))
 	}
@@ -307,149 +312,44 @@ func (e *Editor) ProcessKeyInsertMode() error {
 }
 
 func (e *Editor) SetMode(mode modes.Mode) {
+	prev := e.mode
 	e.mode = mode
 	e.SetStatusMessage(mode.StatusMessage)
 
 	switch mode {
-	case modes.InsertMode:
-		// FIXME: WTF?
-		newRow := *e.Rows[e.cy]
-		e.undoPath = append(e.undoPath, &UndoNode{undoType: actions.Edit, fromIdx: e.cy, toIdx: e.cy, beforeRows: []*Row{&newRow}})
 	case modes.NormalMode:
-		// node := e.undoPath[len(e.undoPath)-1]
-		// node.toIdx = e.cy
-	}
-}
-
-func (e *Editor) ExecuteMotion() error {
-	if len(e.motionRegister) > 3 {
-		e.motionRegister = []keys.Key{}
-		return ErrUnkownMotion
-	}
-	switch {
-	case keys.KeySequenceEqual(e.motionRegister, []keys.Key{keys.MotionKeyD, keys.MotionKeyD}):
-		e.CutRow()
-		e.motionRegister = []keys.Key{}
-	case keys.KeySequenceEqual(e.motionRegister, []keys.Key{keys.MotionKeySmallP}):
-		e.PasteRow(e.cy + 1)
-		e.motionRegister = []keys.Key{}
-	case keys.KeySequenceEqual(e.motionRegister, []keys.Key{keys.MotionKeyCapitalP}):
-		e.PasteRow(e.cy)
-		e.motionRegister = []keys.Key{}
-	case keys.KeySequenceEqual(e.motionRegister, []keys.Key{keys.MotionKeyY, keys.MotionKeyY}):
-		e.YankRow()
-
-		e.motionRegister = []keys.Key{}
-	}
-	return nil
-}
-
-// FIXME: o and O doesn't push anything to the undo stack
-func (e *Editor) Undo() {
-	undoLength := len(e.undoPath)
-	if undoLength == 0 {
-		e.SetStatusMessage("oldest version")
-		return
-	}
-
-	lastUndoNode := e.undoPath[undoLength-1]
-	e.undoPath = e.undoPath[:undoLength-1]
-
-	switch lastUndoNode.undoType {
-	case actions.Cut:
-		for i := 0; i < lastUndoNode.toIdx-lastUndoNode.fromIdx+1; i++ {
-			e.Rows = tools.InsertToSlice(e.Rows, lastUndoNode.beforeRows[i], lastUndoNode.fromIdx+i)
-		}
-	case actions.Paste:
-		for i := 0; i < lastUndoNode.toIdx-lastUndoNode.fromIdx+1; i++ {
-			e.Rows = tools.RemoveFromSlice(e.Rows, lastUndoNode.fromIdx+i)
-		}
-	case actions.Edit:
-		e.logger.Printf("before rows: %#v", lastUndoNode.beforeRows[0])
-		for i := 0; i < lastUndoNode.toIdx-lastUndoNode.fromIdx+1; i++ {
-			e.logger.Println(lastUndoNode.fromIdx+i, i)
-			e.Rows[lastUndoNode.fromIdx+i] = lastUndoNode.beforeRows[i]
+		if prev == modes.InsertMode && e.blockInsert != nil {
+			e.finishBlockInsert()
 		}
+	case modes.VisualMode, modes.VisualLineMode, modes.VisualBlockMode:
+		e.cy = e.clampY(e.cy)
+		e.anchor = position{x: e.cx, y: e.cy}
 	}
 }
 
 func (e *Editor) ProcessKeyNormalMode() error {
-	k, err := readKey()
+	k, err := e.readKey()
 	if err != nil {
 		return err
 	}
+	k = e.mapKey(k, false)
 	e.SetStatusMessage("-- NORMAL --")
 	e.logger.Printf("%#v\n", k)
 	switch k {
-
-	// case navKeyH, navKeyJ, navKeyK, navKeyL, keyArrowLeft, keyArrowDown, keyArrowUp, keyArrowRight:
-	case keys.NavKeyH, keys.NavKeyJ, keys.NavKeyK, keys.NavKeyL:
-		e.MoveCursor(k)
-
-	case keys.NavKeyLeftCurly, keys.NavKeyRightCurly:
-		e.JumpParagraph(k)
-
-	case keys.NavKeyGg:
-		e.cy = 0
-
-	case keys.NavKeyCapitalG:
-		e.cy = len(e.Rows) - 1
-
-	case keys.ModeKeyI:
-		e.SetMode(modes.InsertMode)
-	case keys.ModeKeyCol:
-		e.mode = modes.CommandMode
-		e.command = ""
-		e.SetStatusMessage(e.command)
-
-	case keys.ModeKeySmallA:
-		e.MoveCursor(keys.NavKeyL)
-		e.SetMode(modes.InsertMode)
-
-	case keys.ModeKeyCapitalA:
-		if e.cy < len(e.Rows) {
-			e.cx = len(e.Rows[e.cy].chars)
-		}
-		e.SetMode(modes.InsertMode)
-	case keys.ModeKeySmallO:
-		if e.cy < len(e.Rows) {
-			e.cx = len(e.Rows[e.cy].chars)
-		}
-		e.InsertNewline()
-		e.SetMode(modes.InsertMode)
-	case keys.ModeKeyCapitalO:
-		if e.cy < len(e.Rows) {
-			e.cx = 0
-		}
-		e.InsertNewline()
-		e.MoveCursor(keys.NavKeyK)
-		e.SetMode(modes.InsertMode)
-	case keys.ModeKeySearch:
-		err := e.Find()
-		if err != nil {
-			if err == ErrPromptCanceled {
-				e.SetStatusMessage("")
-			} else {
-				return err
-			}
-		}
-	case keys.ModeKeyU:
-		e.Undo()
-	case keys.ModeKeyX:
-		if e.cy == len(e.Rows)-1 && e.cx == len(e.Rows[e.cy].chars) {
-			// cursor is on the last row and one past the last character,
-			// no more character to delete to the right.
-			break
-		}
-		e.MoveCursor(keys.KeyArrowRight)
-		e.DeleteChar()
 	case keys.EscKey:
 		e.motionRegister = []keys.Key{}
+	case keys.KeyPaste:
+		e.motionRegister = []keys.Key{}
+		e.InsertPasted(e.input.Pasted())
+		// leave the cursor on the last character pasted.
+		e.cx = max(e.cx-1, 0)
 	default:
 		e.motionRegister = append(e.motionRegister, k)
 		err = e.ExecuteMotion()
-		if err != nil {
+		if errors.Is(err, ErrUnkownMotion) {
 			e.SetStatusMessage(err.Error())
+		} else if err != nil {
+			return err
 		}
 	}
 
@@ -459,7 +359,7 @@ func (e *Editor) ProcessKeyNormalMode() error {
 
 func (e *Editor) ProcessKeyCommandMode() error {
 	var err error
-	e.command, err = e.Prompt(":%s", nil)
+	e.command, err = e.prompt(":%s", e.command, nil)
 	if err != nil {
 		return err
 	}
@@ -472,30 +372,71 @@ func (e *Editor) ProcessKeyCommandMode() error {
 }
 
 func (e *Editor) ProcessKey() error {
+	var err error
 	switch e.mode {
 	case modes.NormalMode:
-		return e.ProcessKeyNormalMode()
+		err = e.ProcessKeyNormalMode()
 
 	case modes.InsertMode:
-		return e.ProcessKeyInsertMode()
+		err = e.ProcessKeyInsertMode()
 
 	case modes.CommandMode:
-		return e.ProcessKeyCommandMode()
+		err = e.ProcessKeyCommandMode()
+
+	case modes.VisualMode, modes.VisualLineMode, modes.VisualBlockMode:
+		err = e.ProcessKeyVisualMode()
 
 	default:
 		return ErrUnknownMode
 	}
+	// everything changed since entering insert mode undoes as one step.
+	if e.mode != modes.InsertMode {
+		e.commitUndo()
+	}
+	return err
 }
 
 func (e *Editor) ExecuteCommand() error {
-	var err error
+	e.SetMode(modes.NormalMode)
+	err := e.runCommand(e.command)
+	e.command = ""
+	return err
+}
 
-	commandParts := strings.Split(e.command, " ")
+// runCommand runs a command line, as typed after :.
+func (e *Editor) runCommand(line string) error {
+	var err error
 
-	e.SetMode(modes.NormalMode)
+	cmd, perr := e.parseExCommand(line)
+	if perr != nil {
+		e.SetStatusMessage("%s", perr)
+		return nil
+	}
+	// lines the command acts on, the cursor line unless a range is given.
+	lines := region{kind: linewise, start: position{y: cmd.from}, end: position{y: cmd.to}}
+	hasRange := cmd.addresses > 0
+	commandParts := append([]string{cmd.name}, cmd.args...)
 
 	switch commandParts[0] {
+	case "":
+		// a range on its own goes to its last line.
+		e.cy = cmd.to
+		e.cx = e.firstNonBlank(e.cy)
+
 	case "w":
+		if hasRange {
+			if len(commandParts) < 2 {
+				e.SetStatusMessage("Use a file name to write part of the buffer")
+				break
+			}
+			n, err := e.writeLines(commandParts[1], lines.start.y, lines.end.y)
+			if err != nil {
+				e.SetStatusMessage("Can't save! I/O error: %s", err.Error())
+			} else {
+				e.SetStatusMessage("%d bytes written to disk", n)
+			}
+			break
+		}
 		n, err := e.Save(commandParts[1:]...)
 		if err != nil {
 			if err == ErrPromptCanceled {
@@ -507,20 +448,13 @@ func (e *Editor) ExecuteCommand() error {
 			e.SetStatusMessage("%d bytes written to disk", n)
 		}
 
-	case "q":
-		if e.dirty > 0 {
-			e.SetStatusMessage("ERROR!!! File has unsaved changes")
-			e.command = ""
-			return nil
+	case "q", "q!":
+		if err := e.Quit(commandParts[0] == "q!"); err != nil {
+			if errors.Is(err, ErrQuitEditor) {
+				return err
+			}
+			e.SetStatusMessage("%s", err)
 		}
-		os.Stdout.WriteString("\x1b[2J") // clear the screen
-		os.Stdout.WriteString("\x1b[H")  // reposition the cursor
-		return ErrQuitEditor
-
-	case "q!":
-		os.Stdout.WriteString("\x1b[2J") // clear the screen
-		os.Stdout.WriteString("\x1b[H")  // reposition the cursor
-		return ErrQuitEditor
 
 	case "wq":
 		n, err := e.Save()
@@ -532,35 +466,155 @@ func (e *Editor) ExecuteCommand() error {
 			}
 		} else {
 			e.SetStatusMessage("%d bytes written to disk", n)
+			if err := e.Quit(false); !errors.Is(err, ErrQuitEditor) {
+				if err != nil {
+					e.SetStatusMessage("%s", err)
+				}
+				return nil
+			}
 		}
-		os.Stdout.WriteString("\x1b[2J") // clear the screen
-		os.Stdout.WriteString("\x1b[H")  // reposition the cursor
+		io.WriteString(e.term, "\x1b[2J") // clear the screen
+		io.WriteString(e.term, "\x1b[H")  // reposition the cursor
 		return ErrQuitEditor
 
+	case "d", "delete", "y", "yank":
+		// :d and :y take a register and a count.
+		args := cmd.args
+		if len(args) > 0 && !isDigit(args[0][0]) {
+			e.selectedRegister = []rune(args[0])[0]
+			defer func() { e.selectedRegister = 0 }()
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			if err := e.exCount(&cmd, args[0]); err != nil {
+				e.SetStatusMessage("%s", err)
+				break
+			}
+		}
+		lines.start.y, lines.end.y = cmd.from, cmd.to
+		if commandParts[0][0] == 'd' {
+			e.deleteRegion(lines)
+		} else {
+			e.yankRegion(lines)
+		}
+
+	case "m", "mo", "move", "t", "co", "copy":
+		target, n, err := e.parseAddress(cmd.arg, e.clampY(e.cy))
+		if err == nil && (n == 0 || n < len(cmd.arg)) {
+			err = ErrInvalidAddress
+		}
+		if err == nil && (target < -1 || target >= e.Rows.Len()) {
+			err = ErrInvalidRange
+		}
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+			break
+		}
+		if commandParts[0][0] == 'm' {
+			err = e.moveLines(cmd.from, cmd.to, target)
+		} else {
+			e.copyLines(cmd.from, cmd.to, target)
+		}
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+			break
+		}
+		e.cx = e.firstNonBlank(e.cy)
+
+	case "s", "substitute":
+		if err := e.Substitute(cmd); err != nil {
+			e.SetStatusMessage("%s", err)
+		}
+
+	case "g", "global", "g!", "global!", "v", "vglobal":
+		// :g! is :v, running the command on the lines that don't match.
+		invert := commandParts[0][0] == 'v' || strings.HasSuffix(commandParts[0], "!")
+		if err := e.Global(cmd, invert); err != nil {
+			if errors.Is(err, ErrQuitEditor) {
+				return err
+			}
+			e.SetStatusMessage("%s", err)
+		}
+
+	case "undolist":
+		e.SetStatusMessage("%s", e.undoList())
+
+	case "earlier", "later":
+		if err := e.UndoTime(strings.Join(commandParts[1:], ""), commandParts[0] == "later"); err != nil {
+			e.SetStatusMessage("%s", err)
+		}
+
 	case "syntax":
 		for _, syntax := range syntax.HLDB {
 			if syntax.Filetype == commandParts[1] {
 				e.syntax = syntax
-				for _, row := range e.Rows {
-					e.updateHighlight(row)
-				}
+				e.highlightLoaded()
 			}
 		}
 
+	case "noh", "nohlsearch":
+		e.noHighlight = true
+
+	case "set":
+		if err := setOptions(cmd.args); err != nil {
+			e.SetStatusMessage("%s", err)
+		}
+
+	case "langmap":
+		// with no argument the langmap is turned off.
+		m, err := ParseLangmap(strings.Join(commandParts[1:], " "))
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+			break
+		}
+		Langmap = m
+
 	default:
-		e.SetStatusMessage(ErrUnknownCommand.Error())
+		if name := commandParts[0]; strings.Trim(name, ">") == "" || strings.Trim(name, "<") == "" {
+			// :> and :< shift once for every > or <, and take a count.
+			if len(cmd.args) > 0 {
+				if err := e.exCount(&cmd, cmd.args[0]); err != nil {
+					e.SetStatusMessage("%s", err)
+					break
+				}
+			}
+			lines.start.y, lines.end.y = cmd.from, cmd.to
+			dir := 1
+			if name[0] == '<' {
+				dir = -1
+			}
+			for range name {
+				e.indentRegion(lines, dir)
+			}
+			break
+		}
+		ok, err := e.windowCommand(commandParts[0], commandParts[1:])
+		if !ok {
+			ok, err = e.tabCommand(commandParts[0], commandParts[1:])
+		}
+		if !ok {
+			ok, err = e.bufferCommand(commandParts[0], commandParts[1:])
+		}
+		if !ok {
+			err = ErrUnknownCommand
+		}
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+		}
 	}
 
-	e.command = ""
-
 	return err
 }
 
-func (e *Editor) drawRows(b *strings.Builder) {
+// drawRows draws the text of the window, showing the visual selection when
+// it is the current window.
+func (e *Editor) drawRows(b *strings.Builder, current bool) {
 	for y := 0; y < e.screenRows; y++ {
+		fmt.Fprintf(b, "\x1b[%d;%dH", e.top+y+1, e.left+1)
+		width := 0 // the columns drawn so far
 		filerow := y + e.rowOffset
-		if filerow >= len(e.Rows) {
-			if len(e.Rows) == 0 && y == e.screenRows/3 {
+		if filerow >= e.Rows.Len() {
+			if e.Rows.Len() == 0 && y == e.screenRows/3 {
 				welcomeMsg := fmt.Sprintf("Virayeshgar v%s", version)
 				if runewidth.StringWidth(welcomeMsg) > e.screenCols {
 					welcomeMsg = tools.Utf8Slice(welcomeMsg, 0, e.screenCols)
@@ -574,31 +628,40 @@ func (e *Editor) drawRows(b *strings.Builder) {
 					b.Write([]byte(" "))
 				}
 				b.WriteString(welcomeMsg)
+				width = (e.screenCols-runewidth.StringWidth(welcomeMsg))/2 + runewidth.StringWidth(welcomeMsg)
 			} else {
 				b.Write([]byte("~"))
+				width = 1
 			}
 		} else {
-			var (
-				line string
-				hl   []uint8
-			)
-			if runewidth.StringWidth(e.Rows[filerow].render) > e.colOffset {
-				line = tools.Utf8Slice(
-					e.Rows[filerow].render,
-					e.colOffset,
-					utf8.RuneCountInString(e.Rows[filerow].render))
-				hl = e.Rows[filerow].hl[e.colOffset:]
-			}
-			if runewidth.StringWidth(line) > e.screenCols {
-				line = runewidth.Truncate(line, e.screenCols, "")
-				hl = hl[:utf8.RuneCountInString(line)]
-			}
+			line, hl, cols := visibleText(e.row(filerow), e.colOffset, e.textCols())
 			currentColor := ""          // keep track of color to detect color change
 			b.WriteString("\x1b[0;90m") // use inverted colors
-			maxLength := len(fmt.Sprint(len(e.Rows)))
-			b.WriteString(fmt.Sprintf("%*d ", maxLength, e.Rows[filerow].idx+1))
+			maxLength := len(fmt.Sprint(e.Rows.Len()))
+			b.WriteString(fmt.Sprintf("%*d ", maxLength, filerow+1))
 			b.WriteString("\x1b[m") // reset all formatting
+			width = e.gutterWidth()
+			selFrom, selTo, hasSelection := e.visualSpan(filerow)
+			hasSelection = hasSelection && current
+			inverted := false // keep track of the visual selection highlight
+			spans := e.searchSpans(filerow)
 			for i, r := range []rune(line) {
+				col := cols[i]
+				h := hl[i]
+				// matches are drawn inverted, like the selection, but for
+				// the current one which gets a color of its own.
+				matched, currentMatch := spanAt(spans, col)
+				if currentMatch {
+					h = syntax.HlMatch
+				}
+				if selected := hasSelection && col >= selFrom && col < selTo || matched && !currentMatch; selected != inverted {
+					inverted = selected
+					if inverted {
+						b.WriteString("\x1b[7m")
+					} else {
+						b.WriteString("\x1b[27m")
+					}
+				}
 				if unicode.IsControl(r) {
 					// deal with non-printable characters (e.g. Ctrl-A)
 					sym := '?'
@@ -607,35 +670,66 @@ func (e *Editor) drawRows(b *strings.Builder) {
 					}
 					b.WriteString("\x1b[7m") // use inverted colors
 					b.WriteRune(sym)
+					width++
 					b.WriteString("\x1b[m") // reset all formatting
 					if currentColor != "" {
 						// restore the current color
 						b.WriteString(fmt.Sprintf("\x1b[%sm", currentColor))
 					}
-				} else if hl[i] == syntax.HlNormal {
+					if inverted {
+						// restore the selection highlight
+						b.WriteString("\x1b[7m")
+					}
+				} else if h == syntax.HlNormal {
 					if currentColor != "" {
 						currentColor = ""
-						b.WriteString("\x1b[39m")
+						b.WriteString("\x1b[22;39m")
 					}
 					b.WriteRune(r)
+					width += runewidth.RuneWidth(r)
 				} else {
-					color := syntax.SyntaxToColor(hl[i])
+					color := syntax.SyntaxToColor(h)
 					if color != currentColor {
 						currentColor = color
 						b.WriteString(fmt.Sprintf("\x1b[%sm", color))
+						if inverted {
+							// the color resets the selection highlight
+							b.WriteString("\x1b[7m")
+						}
 					}
 					b.WriteRune(r)
+					width += runewidth.RuneWidth(r)
 				}
 			}
-			b.WriteString("\x1b[39m") // reset to normal color
+			if inverted {
+				b.WriteString("\x1b[27m")
+			}
+			b.WriteString("\x1b[22;39m") // reset to normal color
 		}
+		e.clearLine(b, width)
+	}
+}
+
+// clearLine clears the rest of a line of the window, after the width
+// columns drawn on it.
+func (e *Editor) clearLine(b *strings.Builder, width int) {
+	if e.left+e.screenCols >= e.termCols {
 		b.Write([]byte("\x1b[K")) // clear the line
-		b.Write([]byte("\r\n"))
+		return
 	}
+	// leave the windows on the right alone.
+	b.WriteString(strings.Repeat(" ", max(e.screenCols-width, 0)))
 }
 
-func (e *Editor) drawStatusBar(b *strings.Builder) {
-	b.Write([]byte("\x1b[7m"))      // switch to inverted colors
+// drawStatusBar draws the status line of the window, dimmed unless it is the
+// current window.
+func (e *Editor) drawStatusBar(b *strings.Builder, current bool) {
+	fmt.Fprintf(b, "\x1b[%d;%dH", e.top+e.screenRows+1, e.left+1)
+	if current {
+		b.Write([]byte("\x1b[7m")) // switch to inverted colors
+	} else {
+		b.Write([]byte("\x1b[2;7m")) // switch to dim inverted colors
+	}
 	defer b.Write([]byte("\x1b[m")) // switch back to normal formatting
 	filename := e.filename
 	if utf8.RuneCountInString(filename) == 0 {
@@ -645,23 +739,34 @@ func (e *Editor) drawStatusBar(b *strings.Builder) {
 	if e.dirty > 0 {
 		dirtyStatus = "(modified)"
 	}
-	lmsg := fmt.Sprintf("%.20s - %d lines - %s", filename, len(e.Rows), dirtyStatus)
-	if runewidth.StringWidth(lmsg) > e.screenCols {
-		lmsg = runewidth.Truncate(lmsg, e.screenCols, "...")
-	}
-	b.WriteString(lmsg)
 	filetype := "no filetype"
 	if e.syntax != nil {
 		filetype = e.syntax.Filetype
 	}
-	row, col, _ := tools.GetCursorPosition()
 
 	motionString := ""
-	for _, motion := range e.motionRegister {
-		motionString += string(rune(motion))
+	if current {
+		for _, motion := range e.motionRegister {
+			motionString += string(rune(motion))
+		}
 	}
 
-	rmsg := fmt.Sprintf("%s %s | %d:%d", motionString, filetype, row, col)
+	searchCount := ""
+	if current {
+		searchCount = e.searchCount()
+	}
+	rmsg := fmt.Sprintf("%s %s | %d:%d %s", strings.TrimSpace(motionString+" "+searchCount), filetype, e.cy+1, e.cx+1, e.scrollPercent())
+	lmsg := fmt.Sprintf("%.20s - %d lines - %s", filename, e.Rows.Len(), dirtyStatus)
+	// the file name gives way to the position of the cursor, unless the
+	// window is too narrow for that.
+	width := e.screenCols - runewidth.StringWidth(rmsg)
+	if width < 10 {
+		width = e.screenCols
+	}
+	if runewidth.StringWidth(lmsg) > width {
+		lmsg = runewidth.Truncate(lmsg, width, "...")
+	}
+	b.WriteString(lmsg)
 	l := runewidth.StringWidth(lmsg)
 	for l < e.screenCols {
 		if e.screenCols-l == runewidth.StringWidth(rmsg) {
@@ -671,14 +776,31 @@ func (e *Editor) drawStatusBar(b *strings.Builder) {
 		b.Write([]byte(" "))
 		l++
 	}
-	b.Write([]byte("\r\n"))
+}
+
+// scrollPercent returns how far down the text the window is, the way Vim
+// shows it in the ruler: "All" when all of it is in sight, "Top" and "Bot"
+// at its ends and the percentage of the rows above the window otherwise.
+func (e *Editor) scrollPercent() string {
+	above := e.rowOffset
+	below := e.Rows.Len() - e.rowOffset - e.screenRows
+	switch {
+	case below <= 0 && above == 0:
+		return "All"
+	case below <= 0:
+		return "Bot"
+	case above == 0:
+		return "Top"
+	}
+	return fmt.Sprintf("%d%%", above*100/(above+below))
 }
 
 func (e *Editor) drawMessageBar(b *strings.Builder) {
+	fmt.Fprintf(b, "\x1b[%d;1H", e.termRows)
 	b.Write([]byte("\x1b[K"))
 	msg := e.statusmsg
-	if runewidth.StringWidth(msg) > e.screenCols {
-		msg = runewidth.Truncate(msg, e.screenCols, "...")
+	if runewidth.StringWidth(msg) > e.termCols {
+		msg = runewidth.Truncate(msg, e.termCols, "...")
 	}
 	// show the message if it's less than 5s old.
 	if time.Since(e.statusmsgTime) < 5*time.Second {
@@ -686,50 +808,58 @@ func (e *Editor) drawMessageBar(b *strings.Builder) {
 	}
 }
 
+// tabstop returns the width of a tab for the current syntax.
+func (e Editor) tabstop() int {
+	if e.syntax != nil && e.syntax.Tabstop != 0 {
+		return e.syntax.Tabstop
+	}
+	return tabstop
+}
+
 func (e Editor) rowCxToRx(row *Row, cx int) int {
 	rx := 0
 	idx := cx
 	if cx > len(row.chars) {
-		idx = len(row.chars) - 1
+		idx = len(row.chars)
 	}
-	for _, r := range row.chars[:idx] {
-		if r == '\t' {
-			if e.syntax.Tabstop != 0 {
-				rx += (e.syntax.Tabstop) - (rx % e.syntax.Tabstop)
-			} else {
-				rx += (tabstop) - (rx % tabstop)
-			}
+	for i := 0; i < idx; {
+		end := clusterEnd(row.chars, i)
+		if row.chars[i] == '\t' {
+			rx += e.tabstop() - (rx % e.tabstop())
 		} else {
-			rx += runewidth.RuneWidth(r)
+			rx += clusterWidth(row.chars, i, end)
 		}
+		i = end
 	}
 	return rx
 }
 
 func (e Editor) rowRxToCx(row *Row, rx int) int {
 	curRx := 0
-	for i, r := range row.chars {
-		if r == '\t' {
-			if e.syntax.Tabstop != 0 {
-				curRx += (e.syntax.Tabstop) - (curRx % e.syntax.Tabstop)
-			} else {
-				curRx += (tabstop) - (curRx % tabstop)
-			}
+	for i := 0; i < len(row.chars); {
+		end := clusterEnd(row.chars, i)
+		if row.chars[i] == '\t' {
+			curRx += e.tabstop() - (curRx % e.tabstop())
 		} else {
-			curRx += runewidth.RuneWidth(r)
+			curRx += clusterWidth(row.chars, i, end)
 		}
 
 		if curRx > rx {
 			return i
 		}
+		i = end
 	}
-	panic("unreachable")
+	return len(row.chars)
 }
 
 func (e *Editor) scroll() {
 	e.rx = 0
-	if e.cy < len(e.Rows) {
-		e.rx = e.rowCxToRx(e.Rows[e.cy], e.cx)
+	if e.cy < e.Rows.Len() {
+		if row := e.row(e.cy); row.order != nil {
+			e.rx = e.visualColumn(row, e.cx)
+		} else {
+			e.rx = e.rowCxToRx(row, e.cx)
+		}
 	}
 	// scroll up if the cursor is above the visible window.
 	if e.cy < e.rowOffset {
@@ -744,29 +874,114 @@ func (e *Editor) scroll() {
 		e.colOffset = e.rx
 	}
 	// scroll right if the cursor is right of the visible window.
-	if e.rx >= e.colOffset+e.screenCols {
-		e.colOffset = e.rx - e.screenCols + 1
+	if e.rx >= e.colOffset+e.textCols() {
+		e.colOffset = e.rx - e.textCols() + 1
 	}
 }
 
-// Render refreshes the screen.
-func (e *Editor) Render() {
-	e.scroll()
+// textCols returns how many columns the text of the rows can take, next to
+// the line numbers.
+func (e *Editor) textCols() int {
+	return e.screenCols - e.gutterWidth()
+}
 
-	var b strings.Builder
+// gutterWidth returns the width of the line numbers in front of the rows.
+func (e *Editor) gutterWidth() int {
+	return len(fmt.Sprint(e.Rows.Len())) + 1
+}
 
-	b.Write([]byte("\x1b[?25l")) // hide the cursor
-	b.Write([]byte("\x1b[H"))    // reposition the cursor at the top left.
+// visibleText returns the part of the rendered row that is shown when the
+// screen is scrolled right by from columns and fits width columns, its
+// highlight and the column of every rune shown. It only goes over that
+// part, rows can be megabytes long. Rows with right-to-left text are shown
+// reordered.
+func visibleText(row *Row, from, width int) (string, []uint8, []int) {
+	if row.order != nil {
+		return visibleBidiText(row, from, width)
+	}
+	s := row.render
+	i, col := 0, 0
+	for i < len(s) && col < from {
+		end := clusterEndString(s, i)
+		col += stringWidth(s[i:end])
+		i = end
+	}
+	start, w := i, 0
+	var cols []int
+	for i < len(s) {
+		end := clusterEndString(s, i)
+		cw := stringWidth(s[i:end])
+		if w+cw > width {
+			break
+		}
+		for range utf8.RuneCountInString(s[i:end]) {
+			cols = append(cols, col+w)
+		}
+		w += cw
+		i = end
+	}
+	if len(cols) == 0 {
+		return "", nil, nil
+	}
+	first := utf8.RuneCountInString(s[:start])
+	return s[start:i], row.hl[first : first+len(cols)], cols
+}
+
+// RenderStats counts what Render wrote to the terminal.
+type RenderStats struct {
+	// Frames is the number of times the screen was rendered, Bytes the
+	// bytes written for all of them and LastBytes for the last one.
+	Frames    int
+	Bytes     int
+	LastBytes int
+}
+
+// RenderStats returns the counts of what Render wrote so far.
+func (e *Editor) RenderStats() RenderStats {
+	return e.stats
+}
 
-	e.drawRows(&b)
-	e.drawStatusBar(&b)
+// Render refreshes the screen. It draws the whole screen off the terminal,
+// then writes only the cells that differ from what the terminal shows.
+func (e *Editor) Render() {
+	var b strings.Builder
+
+	e.drawTabLine(&b)
+
+	// draw every window as if it was the current one.
+	current := e.Window
+	for _, w := range e.windows() {
+		e.Window = w
+		e.scroll()
+		e.drawRows(&b, w == current)
+		e.drawStatusBar(&b, w == current)
+		if right := w.left + w.screenCols; right < e.termCols {
+			// the separator from the window on the right.
+			for y := w.top; y <= w.top+w.screenRows; y++ {
+				fmt.Fprintf(&b, "\x1b[%d;%dH|", y+1, right+1)
+			}
+		}
+	}
+	e.Window = current
 	e.drawMessageBar(&b)
 
 	// position the cursor
-	b.WriteString(fmt.Sprintf("\x1b[%d;%dH", (e.cy-e.rowOffset)+1, (e.rx-e.colOffset)+1+len(fmt.Sprint(len(e.Rows)))+1))
-	// show the cursor
-	b.Write([]byte("\x1b[?25h"))
-	os.Stdout.WriteString(b.String())
+	b.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.top+(e.cy-e.rowOffset)+1, e.left+(e.rx-e.colOffset)+1+e.gutterWidth()))
+
+	frame := term.NewScreen(e.termRows, e.termCols)
+	io.WriteString(frame, b.String())
+	out := ""
+	if e.screen == nil {
+		out = "\x1b[2J\x1b[H" // clear the screen
+		e.screen = term.NewScreen(e.termRows, e.termCols)
+	}
+	out += frame.Diff(e.screen)
+	e.screen = frame
+	io.WriteString(e.term, out)
+
+	e.stats.Frames++
+	e.stats.Bytes += len(out)
+	e.stats.LastBytes = len(out)
 }
 
 func (e *Editor) SetStatusMessage(format string, a ...interface{}) {
@@ -774,13 +989,39 @@ func (e *Editor) SetStatusMessage(format string, a ...interface{}) {
 	e.statusmsgTime = time.Now()
 }
 
-func (e *Editor) rowsToString() string {
-	var b strings.Builder
-	for _, row := range e.Rows {
-		b.WriteString(string(row.chars))
-		b.WriteRune('\n')
+// writeLines writes the rows from..to to the given file.
+func (e *Editor) writeLines(filename string, from, to int) (int, error) {
+	n, _, err := e.writeFile(filename, from, to)
+	return n, err
+}
+
+// boolOptions are the options :set turns on, and off with a "no" in front
+// of their names.
+var boolOptions = map[string]*bool{
+	"ignorecase": &IgnoreCase,
+	"ic":         &IgnoreCase,
+	"smartcase":  &SmartCase,
+	"scs":        &SmartCase,
+	"hidden":     &Hidden,
+	"hid":        &Hidden,
+	"hlsearch":   &HlSearch,
+	"hls":        &HlSearch,
+}
+
+// setOptions runs :set with the given arguments, like "ic" or "noscs".
+func setOptions(args []string) error {
+	for _, arg := range args {
+		name, value := arg, true
+		if _, ok := boolOptions[name]; !ok && strings.HasPrefix(name, "no") {
+			name, value = name[2:], false
+		}
+		option, ok := boolOptions[name]
+		if !ok {
+			return fmt.Errorf("Unknown option: %s", arg)
+		}
+		*option = value
 	}
-	return b.String()
+	return nil
 }
 
 var ErrPromptCanceled = fmt.Errorf("user canceled the input prompt")
@@ -793,12 +1034,18 @@ var ErrPromptCanceled = fmt.Errorf("user canceled the input prompt")
 // It takes an optional callback function, which takes the query string and
 // the last key pressed.
 func (e *Editor) Prompt(prompt string, cb func(query string, k keys.Key)) (string, error) {
+	return e.prompt(prompt, "", cb)
+}
+
+// prompt works like Prompt, starting with initial already typed in.
+func (e *Editor) prompt(prompt, initial string, cb func(query string, k keys.Key)) (string, error) {
 	var b strings.Builder
+	b.WriteString(initial)
 	for {
 		e.SetStatusMessage(prompt, b.String())
 		e.Render()
 
-		k, err := readKey()
+		k, err := e.readKey()
 		if err != nil {
 			return "", err
 		}
@@ -823,7 +1070,13 @@ func (e *Editor) Prompt(prompt string, cb func(query string, k keys.Key)) (strin
 				}
 				return b.String(), nil
 			}
-		} else if !unicode.IsControl(rune(k)) && !keys.IsArrowKey(k) && unicode.IsPrint(rune(k)) {
+		} else if k == keys.KeyPaste {
+			for _, r := range e.input.Pasted() {
+				if isPromptRune(r) {
+					b.WriteRune(r)
+				}
+			}
+		} else if !unicode.IsControl(rune(k)) && !keys.IsArrowKey(k) && isPromptRune(rune(k)) {
 			b.WriteRune(rune(k))
 		}
 
@@ -833,6 +1086,12 @@ func (e *Editor) Prompt(prompt string, cb func(query string, k keys.Key)) (strin
 	}
 }
 
+// isPromptRune reports whether r can be typed at the prompt: the printable
+// runes and the joiners that are part of the characters around them.
+func isPromptRune(r rune) bool {
+	return unicode.IsPrint(r) || r == '\u200c' || r == '\u200d'
+}
+
 func (e *Editor) Save(opts ...string) (int, error) {
 	if len(opts) > 0 {
 		e.filename = opts[0]
@@ -846,138 +1105,156 @@ func (e *Editor) Save(opts ...string) (int, error) {
 		e.selectSyntaxHighlight()
 	}
 
-	f, err := os.OpenFile(e.filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	n, err := f.WriteString(e.rowsToString())
+	n, sum, err := e.writeFile(e.filename, 0, -1)
 	if err != nil {
 		return 0, err
 	}
 	e.dirty = 0
+	e.markSaved()
+	if err := e.writeUndoFile(sum); err != nil {
+		e.logger.Printf("writing undo history of %s: %v", e.filename, err)
+	}
 	return n, nil
 }
 
-// OpenFile opens a file with the given filename.
-// If a file does not exist, it returns os.ErrNotExist.
+// OpenFile opens a file with the given filename in a buffer of its own and
+// makes it the current buffer. The empty buffer the editor starts with is
+// used for the first file.
+// If a file does not exist, it returns os.ErrNotExist and leaves an empty
+// buffer for it.
 func (e *Editor) OpenFile(filename string) error {
+	b := e.Buffer
+	if b.filename != "" || b.dirty > 0 || b.Rows.Len() > 1 || len(b.undoTree.nodes) > 1 {
+		b = e.newBuffer(filename)
+		e.showBuffer(b)
+	}
 	e.filename = filename
+	return e.loadFile(filename)
+}
+
+// loadFile reads a file into the current buffer.
+//
+// Only the first screen of the file is read before loadFile returns, the
+// rest of its lines are indexed in the background and read as they are
+// needed.
+func (e *Editor) loadFile(filename string) error {
 	e.selectSyntaxHighlight()
 	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		line := s.Bytes()
-		// strip off newline or cariage return
-		bytes.TrimRightFunc(line, func(r rune) bool { return r == '\n' || r == '\r' })
-		e.InsertRow(len(e.Rows), string(line))
+	if e.loader != nil {
+		e.loader.close()
 	}
-	if err := s.Err(); err != nil {
-		return err
+	e.Rows = rope.Rope[*Row]{}
+	e.undoTree = newUndoTree()
+	e.loader = newLoader(f)
+	e.pollLoader(true)
+	if e.Rows.Len() == 0 {
+		e.Rows = e.Rows.Insert(0, &Row{})
 	}
 	e.dirty = 0
 	return nil
 }
 
 func (e *Editor) InsertRow(at int, chars string) {
-	if at < 0 || at > len(e.Rows) {
+	if at < 0 || at > e.Rows.Len() {
 		return
 	}
-	row := &Row{chars: []rune(chars)}
-	row.idx = at
-	if at > 0 {
-		row.hasUnclosedComment = e.Rows[at-1].hasUnclosedComment
+	if at < e.Rows.Len() {
+		// rows go in before a loaded row, not inside a run of unloaded
+		// ones.
+		e.row(at)
 	}
-	e.updateRow(row)
-
-	e.Rows = append(e.Rows, &Row{}) // grow the buffer
-	copy(e.Rows[at+1:], e.Rows[at:])
-	for i := at + 1; i < len(e.Rows); i++ {
-		e.Rows[i].idx++
-	}
-	e.Rows[at] = row
-}
-
-func (e *Editor) CutRow() {
-	e.dirty++
-
-	row := e.Rows[e.cy]
-	e.yankRegister = row.render
-
-	e.undoPath = append(e.undoPath, &UndoNode{undoType: actions.Cut, fromIdx: e.cy, toIdx: e.cy, beforeRows: []*Row{row}, afterRows: []*Row{{}}})
-
-	copy(e.Rows[e.cy:], e.Rows[e.cy+1:])
-	e.Rows = e.Rows[:len(e.Rows)-1]
-	for i := e.cy; i < len(e.Rows); i++ {
-		e.Rows[i].idx--
-	}
-}
-
-// FIXME: when cursor is at the end of the line, the yanking doesn't work
-func (e *Editor) YankRow() {
-	e.dirty++
-	row := e.Rows[e.cy]
-	e.yankRegister = row.render
+	e.change(at, at-1, func() {
+		row := &Row{chars: []rune(chars)}
+		if at > 0 {
+			row.hasUnclosedComment = e.Rows.At(at - 1).hasUnclosedComment
+		}
+		e.Rows = e.Rows.Insert(at, row)
+		e.updateRow(at)
+	})
+	e.adjustMarks(at, 1)
 }
 
 func (e *Editor) PasteRow(at int) {
-	e.dirty++
-	e.undoPath = append(e.undoPath, &UndoNode{undoType: actions.Paste, fromIdx: at, toIdx: at, afterRows: []*Row{e.Rows[at]}, beforeRows: []*Row{{}}})
-
-	e.InsertRow(at, e.yankRegister)
-	e.yankRegister = ""
+	lines := e.getRegister().lines
+	if len(lines) == 0 || at < 0 || at > e.Rows.Len() {
+		return
+	}
+	e.change(at, at-1, func() {
+		for i, line := range lines {
+			e.InsertRow(at+i, line)
+		}
+	})
 }
 
 func (e *Editor) InsertNewline() {
-	e.dirty++
-
-	if e.cx == 0 {
-		e.InsertRow(e.cy, "")
-	} else {
-		row := e.Rows[e.cy]
-		e.InsertRow(e.cy+1, string(row.chars[e.cx:]))
-		// reassignment needed since the call to InsertRow
-		// invalidates the pointer.
-		row = e.Rows[e.cy]
-		row.chars = row.chars[:e.cx]
-		e.updateRow(row)
-	}
+	e.change(e.cy, min(e.cy, e.Rows.Len()-1), func() {
+		if e.cx == 0 {
+			e.InsertRow(e.cy, "")
+		} else {
+			row := e.row(e.cy)
+			e.InsertRow(e.cy+1, string(row.chars[e.cx:]))
+			row.chars = row.chars[:e.cx]
+			e.updateRow(e.cy)
+		}
+	})
 	e.cy++
 	e.cx = 0
 }
 
-func (e *Editor) updateRow(row *Row) {
+// InsertPasted inserts text pasted in bracketed paste mode at the cursor,
+// as it is: none of it is taken for keys. It is a single change to undo.
+func (e *Editor) InsertPasted(text string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	if text == "" {
+		return
+	}
+	if e.cy == e.Rows.Len() {
+		e.InsertRow(e.Rows.Len(), "")
+	}
+	at := position{x: min(e.cx, len(e.row(e.cy).chars)), y: e.cy}
+	e.change(at.y, at.y, func() {
+		end := e.insertText(at, strings.Split(text, "\n"))
+		e.cx, e.cy = end.x, end.y
+	})
+}
+
+// updateRow renders the row at index at and highlights it.
+func (e *Editor) updateRow(at int) {
+	row := e.row(at)
 	var b strings.Builder
 	col := 0
-	for _, r := range row.chars {
-		if r == '\t' {
+	for i := 0; i < len(row.chars); {
+		end := clusterEnd(row.chars, i)
+		if row.chars[i] == '\t' {
 			// each tab must advance the cursor forward at least one column
 			b.WriteRune(' ')
 			col++
 			// append spaces until we get to a tab stop
-			var currentTabstop int
-			if e.syntax.Tabstop != 0 {
-				currentTabstop = e.syntax.Tabstop
-			} else {
-				currentTabstop = tabstop
-			}
-			for col%currentTabstop != 0 {
+			for col%e.tabstop() != 0 {
 				b.WriteRune(' ')
 				col++
 			}
 		} else {
-			b.WriteRune(r)
+			for _, r := range row.chars[i:end] {
+				b.WriteRune(r)
+			}
+			col += clusterWidth(row.chars, i, end)
 		}
+		i = end
 	}
 	row.render = b.String()
-	e.updateHighlight(row)
+	updateBidi(row)
+	e.updateHighlight(at)
 }
 
-func (e *Editor) updateHighlight(row *Row) {
+// updateHighlight highlights the row at index at, and the rows after it for
+// as long as a multiline comment opened or closed on it changes them.
+func (e *Editor) updateHighlight(at int) {
+	row := e.row(at)
 	row.hl = make([]uint8, utf8.RuneCountInString(row.render))
 	for i := range row.hl {
 		row.hl[i] = syntax.HlNormal
@@ -994,7 +1271,7 @@ func (e *Editor) updateHighlight(row *Row) {
 	var strQuote rune
 
 	// indicates whether we are inside a multi-line comment.
-	inComment := row.idx > 0 && e.Rows[row.idx-1].hasUnclosedComment
+	inComment := at > 0 && e.Rows.At(at-1).hasUnclosedComment
 
 	idx := 0
 	runes := []rune(row.render)
@@ -1008,7 +1285,7 @@ func (e *Editor) updateHighlight(row *Row) {
 		if e.syntax.Mcs != "" && e.syntax.Mce != "" && strQuote == 0 {
 			if inComment {
 				row.hl[idx] = syntax.HlMlComment
-				if strings.HasPrefix(string(runes[idx:]), e.syntax.Mce) {
+				if hasPrefix(runes[idx:], e.syntax.Mce) {
 					for j := 0; j < len(e.syntax.Mce); j++ {
 						row.hl[idx] = syntax.HlMlComment
 						idx++
@@ -1020,7 +1297,7 @@ func (e *Editor) updateHighlight(row *Row) {
 					idx++
 					continue
 				}
-			} else if strings.HasPrefix(string(runes[idx:]), e.syntax.Mcs) {
+			} else if hasPrefix(runes[idx:], e.syntax.Mcs) {
 				for j := 0; j < len(e.syntax.Mcs); j++ {
 					row.hl[idx] = syntax.HlMlComment
 					idx++
@@ -1031,7 +1308,7 @@ func (e *Editor) updateHighlight(row *Row) {
 		}
 
 		if e.syntax.Scs != "" && strQuote == 0 && !inComment {
-			if strings.HasPrefix(string(runes[idx:]), e.syntax.Scs) {
+			if hasPrefix(runes[idx:], e.syntax.Scs) {
 				for idx < len(runes) {
 					row.hl[idx] = syntax.HlComment
 					idx++
@@ -1110,11 +1387,35 @@ func (e *Editor) updateHighlight(row *Row) {
 
 	changed := row.hasUnclosedComment != inComment
 	row.hasUnclosedComment = inComment
-	if changed && row.idx+1 < len(e.Rows) {
-		e.updateHighlight(e.Rows[row.idx+1])
+	if changed && at+1 < e.Rows.Len() && e.Rows.At(at+1).src == nil {
+		e.updateHighlight(at + 1)
 	}
 }
 
+// hasPrefix reports whether runes begins with prefix, without copying runes
+// to a string, which is slow on long rows.
+func hasPrefix(runes []rune, prefix string) bool {
+	i := 0
+	for _, r := range prefix {
+		if i >= len(runes) || runes[i] != r {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// highlightLoaded highlights every row that is loaded, the others get
+// highlighted once they are.
+func (e *Editor) highlightLoaded() {
+	e.Rows.Walk(0, func(y int, row *Row) bool {
+		if row.src == nil {
+			e.updateHighlight(y)
+		}
+		return true
+	})
+}
+
 func (e *Editor) selectSyntaxHighlight() {
 	e.syntax = nil
 	if len(e.filename) == 0 {
@@ -1129,9 +1430,7 @@ func (e *Editor) selectSyntaxHighlight() {
 			if (isExt && pattern == ext) ||
 				(!isExt && strings.Index(e.filename, pattern) != -1) {
 				e.syntax = syntax
-				for _, row := range e.Rows {
-					e.updateHighlight(row)
-				}
+				e.highlightLoaded()
 				return
 			}
 		}
@@ -1159,128 +1458,54 @@ func (row *Row) deleteChar(at int) {
 }
 
 func (e *Editor) InsertChar(c rune) {
-	if e.cy == len(e.Rows) {
-		e.InsertRow(len(e.Rows), "")
-	}
-	row := e.Rows[e.cy]
-	row.insertChar(e.cx, c)
-	e.updateRow(row)
+	if e.cy == e.Rows.Len() {
+		e.InsertRow(e.Rows.Len(), "")
+	}
+	e.change(e.cy, e.cy, func() {
+		row := e.row(e.cy)
+		row.insertChar(e.cx, c)
+		e.updateRow(e.cy)
+	})
 	e.cx++
-	e.dirty++
 }
 
 func (e *Editor) DeleteChar() {
-	if e.cy == len(e.Rows) {
+	if e.cy == e.Rows.Len() {
 		return
 	}
 	if e.cx == 0 && e.cy == 0 {
 		return
 	}
-	row := e.Rows[e.cy]
+	row := e.row(e.cy)
 	if e.cx > 0 {
-		row.deleteChar(e.cx - 1)
-		e.updateRow(row)
-		e.cx--
-		e.dirty++
+		// the whole character before the cursor, marks and all.
+		start := clusterStart(row.chars, e.cx-1)
+		e.change(e.cy, e.cy, func() {
+			for at := e.cx - 1; at >= start; at-- {
+				row.deleteChar(at)
+			}
+			e.updateRow(e.cy)
+		})
+		e.cx = start
 	} else {
-		prevRow := e.Rows[e.cy-1]
-		e.cx = len(prevRow.chars)
-		prevRow.appendChars(row.chars)
-		e.updateRow(prevRow)
-		e.DeleteRow(e.cy)
+		prevRow := e.row(e.cy - 1)
+		e.change(e.cy-1, e.cy, func() {
+			e.cx = len(prevRow.chars)
+			prevRow.appendChars(row.chars)
+			e.updateRow(e.cy - 1)
+			e.DeleteRow(e.cy)
+		})
 		e.cy--
 	}
 }
 
 func (e *Editor) DeleteRow(at int) {
-	if at < 0 || at >= len(e.Rows) {
+	if at < 0 || at >= e.Rows.Len() {
 		return
 	}
-	e.Rows = append(e.Rows[:at], e.Rows[at+1:]...)
-	for i := at; i < len(e.Rows); i++ {
-		e.Rows[i].idx--
-	}
-	e.dirty++
-}
-
-// FIXME: Sometimes the patterm match will match the line above the rowOffset
-// FIXME: Crashes sometimes in big files
-func (e *Editor) Find() error {
-	savedCx := e.cx
-	savedCy := e.cy
-	savedColOffset := e.colOffset
-	savedRowOffset := e.rowOffset
-
-	lastMatchRowIndex := -1 // remember the last match row
-	searchDirection := 1    // 1 = forward, -1 = backward
-
-	savedHlRowIndex := -1
-	savedHl := []uint8(nil)
-
-	onKeyPress := func(query string, k keys.Key) {
-		if len(savedHl) > 0 {
-			copy(e.Rows[savedHlRowIndex].hl, savedHl)
-			savedHl = []uint8(nil)
-		}
-		switch k {
-		case keys.KeyEnter, keys.Key('\x1b'):
-			lastMatchRowIndex = -1
-			searchDirection = 1
-			return
-		case keys.KeyArrowRight, keys.KeyArrowDown:
-			searchDirection = 1
-		case keys.KeyArrowLeft, keys.KeyArrowUp:
-			searchDirection = -1
-		default:
-			// unless an arrow key was pressed, we'll reset.
-			lastMatchRowIndex = -1
-			searchDirection = 1
-		}
-
-		if lastMatchRowIndex == -1 {
-			searchDirection = 1
-		}
-
-		current := lastMatchRowIndex
-
-		// search for query and set e.cy, e.cx, e.rowOffset values.
-		for i := 0; i < len(e.Rows); i++ {
-			current += searchDirection
-			switch current {
-			case -1:
-				current = len(e.Rows) - 1
-			case len(e.Rows):
-				current = 0
-			}
-
-			row := e.Rows[current]
-			rx := strings.Index(row.render, query)
-			if rx != -1 {
-				lastMatchRowIndex = current
-				e.cy = current
-				e.cx = e.rowRxToCx(row, rx)
-				// set rowOffset to bottom so that the next scroll() will scroll
-				// upwards and the matching line will be at the top of the screen
-				e.rowOffset = len(e.Rows)
-				// highlight the matched string
-				savedHlRowIndex = current
-				savedHl = make([]uint8, len(row.hl))
-				copy(savedHl, row.hl)
-				for i := 0; i < utf8.RuneCountInString(query); i++ {
-					row.hl[rx+i] = syntax.HlMatch
-				}
-				break
-			}
-		}
-	}
-
-	_, err := e.Prompt("Search: %s (ESC = cancel | Enter = confirm | Arrows = prev/next)", onKeyPress)
-	// restore cursor position when the user cancels search
-	if err == ErrPromptCanceled {
-		e.cx = savedCx
-		e.cy = savedCy
-		e.colOffset = savedColOffset
-		e.rowOffset = savedRowOffset
-	}
-	return err
+	e.row(at)
+	e.change(at, at, func() {
+		e.Rows = e.Rows.Delete(at, at+1)
+	})
+	e.adjustMarks(at, -1)
 }
@@ -0,0 +1,860 @@
+package editor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amirali/virayeshgar/editor/rope"
+	"github.com/amirali/virayeshgar/editor/term"
+)
+
+// newTestEditor starts an editor on a fake terminal of the given size,
+// editing a file with the given name and text in a directory of its own.
+func newTestEditor(t *testing.T, rows, cols int, filename, text string) (*Editor, *term.Fake) {
+	t.Helper()
+	UndoDir = ""
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.WriteFile(filename, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := term.NewFake(rows, cols)
+	e := &Editor{}
+	if err := e.Init(f, log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if err := e.OpenFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	e.SetStatusMessage("-- NORMAL --")
+	e.Render()
+	return e, f
+}
+
+// errIdle stops typeKeys once the editor waits for more keys.
+var errIdle = errors.New("waiting for keys")
+
+// typeKeys types keys and runs the editor until it waits for more.
+func typeKeys(t *testing.T, e *Editor, f *term.Fake, keys string) {
+	t.Helper()
+	if err := runKeys(e, f, keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runKeys types keys and runs the editor until it waits for more or a key
+// gives an error, which it returns.
+func runKeys(e *Editor, f *term.Fake, keys string) error {
+	f.Type(keys)
+	f.Idle = func() { panic(errIdle) }
+	defer func() {
+		f.Idle = nil
+		if r := recover(); r != nil && r != errIdle {
+			panic(r)
+		}
+	}()
+	for {
+		if err := e.ProcessKey(); err != nil {
+			return err
+		}
+		e.Render()
+	}
+}
+
+func TestDeleteAndPutLine(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\n")
+	typeKeys(t, e, f, "ddp")
+	for i, want := range []string{"1 two", "2 one", "3 three"} {
+		if got := f.Line(i); got != want {
+			t.Errorf("line %d = %q, want %q", i+1, got, want)
+		}
+	}
+	if row, col := f.Cursor(); row != 1 || col != 2 {
+		t.Errorf("cursor at %d,%d, want 1,2", row, col)
+	}
+}
+
+func TestInsertText(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "world\n")
+	typeKeys(t, e, f, "ihello \x1b")
+	if got, want := f.Line(0), "1 hello world"; got != want {
+		t.Errorf("line 1 = %q, want %q", got, want)
+	}
+}
+
+func TestResize(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\nfour\nfive\nsix\n")
+	typeKeys(t, e, f, "G")
+	f.Resize(10, 40)
+	typeKeys(t, e, f, "k")
+	for row, want := range map[int]string{0: "1 one", 5: "6 six", 6: "~"} {
+		if got := f.Line(row); got != want {
+			t.Errorf("row %d = %q, want %q", row, got, want)
+		}
+	}
+	if row, col := f.Cursor(); row != 4 || col != 2 {
+		t.Errorf("cursor at %d,%d, want 4,2", row, col)
+	}
+	if e.screenRows != 8 || e.screenCols != 40 {
+		t.Errorf("window is %dx%d, want 8x40", e.screenRows, e.screenCols)
+	}
+}
+
+func TestRenderOnlyChanges(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\n")
+	full := e.RenderStats().LastBytes
+	e.Render()
+	if got := e.RenderStats().LastBytes; got != 0 {
+		t.Errorf("rendering an unchanged screen wrote %d bytes, want 0", got)
+	}
+	typeKeys(t, e, f, "x")
+	if got := e.RenderStats().LastBytes; got == 0 || got > full/2 {
+		t.Errorf("deleting a character wrote %d bytes, want a few of the %d of the whole screen", got, full)
+	}
+	if got, want := f.Line(0), "1 ne"; got != want {
+		t.Errorf("line 1 = %q, want %q", got, want)
+	}
+}
+
+func TestBracketedPaste(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\n")
+	// the Esc and the d in the paste are text, not keys.
+	typeKeys(t, e, f, "li\x1b[200~X\x1bdd\rY\x1b[201~Z\x1b")
+	for i, want := range []string{"oX\x1bdd", "YZne", "two"} {
+		if got := string(e.row(i).chars); got != want {
+			t.Errorf("line %d = %q, want %q", i+1, got, want)
+		}
+	}
+	typeKeys(t, e, f, "u")
+	if got := e.Rows.Len(); got != 2 {
+		t.Errorf("%d lines after undo, want 2", got)
+	}
+	if got, want := f.Line(0), "1 one"; got != want {
+		t.Errorf("line 1 after undo = %q, want %q", got, want)
+	}
+}
+
+func TestQuitWindow(t *testing.T) {
+	t.Cleanup(func() { Hidden = true })
+	for _, test := range []struct {
+		keys    string
+		quits   bool
+		windows int
+	}{
+		{"\x17q", true, 1},
+		{"\x17s\x17q", false, 1},
+		{"\x17s\x17q\x17q", true, 1},
+		{"x\x17q", false, 1},
+		{"x:w\r\x17q", true, 1},
+		{":q\r", true, 1},
+		{"x:q!\r", true, 1},
+		// the changes are still shown in the window left.
+		{":set nohidden\rx\x17s\x17q", false, 1},
+		{":set nohidden\r\x17s:e other.txt\rihi\x1b\x17q", false, 2},
+		{":set nohidden\r\x17s:e other.txt\rihi\x1b:q\r", false, 2},
+		{":set nohidden\r\x17s:e other.txt\rihi\x1b:q!\r", false, 1},
+		{"\x17c", false, 1},
+		{"\x17s\x17c", false, 1},
+		{":set nohidden\r\x17s:e other.txt\rihi\x1b\x17c", false, 2},
+	} {
+		Hidden = true
+		e, f := newTestEditor(t, 12, 30, "test.txt", "one\n")
+		err := runKeys(e, f, test.keys)
+		if quits := errors.Is(err, ErrQuitEditor); quits != test.quits || err != nil && !quits {
+			t.Errorf("%q returned %v, want quitting %v", test.keys, err, test.quits)
+		}
+		if n := len(e.windows()); !test.quits && n != test.windows {
+			t.Errorf("%q left %d windows, want %d", test.keys, n, test.windows)
+		}
+	}
+}
+
+func TestSearchCase(t *testing.T) {
+	t.Cleanup(func() { IgnoreCase, SmartCase = false, false })
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\nWORD\nword\n")
+	for _, test := range []struct {
+		keys string
+		want int
+	}{
+		{"gg/word\r", 2},
+		{":set ic\rgg/word\r", 1},
+		{":set scs\rgg/word\r", 1},
+		{"gg/Word\r", 0},
+		{"gg/\\Aword\r", 1},
+		{":set noic\rgg/\\Aword\r", 2},
+	} {
+		typeKeys(t, e, f, test.keys)
+		if e.cy != test.want {
+			t.Errorf("%q went to line %d, want %d", test.keys, e.cy+1, test.want+1)
+		}
+	}
+}
+
+func TestHlSearchLeavesSyntax(t *testing.T) {
+	t.Cleanup(func() { HlSearch = true })
+	e, f := newTestEditor(t, 6, 30, "test.go", "// one two\nx := 2\n")
+	want := slices.Clone(e.row(0).hl)
+	typeKeys(t, e, f, "/two\r")
+	if got := e.row(0).hl; !slices.Equal(got, want) {
+		t.Errorf("highlight after search = %v, want %v", got, want)
+	}
+	if got := f.Cell(0, 9).Style; got != "7;90" {
+		t.Errorf("match style = %q, want %q", got, "7;90")
+	}
+	typeKeys(t, e, f, ":set nohls\r")
+	if got := f.Cell(0, 9).Style; got != "90" {
+		t.Errorf("match style with nohlsearch = %q, want %q", got, "90")
+	}
+}
+
+func TestGraphemes(t *testing.T) {
+	const (
+		accent = "cafe\u0301s"    // e and a combining acute accent
+		emoji  = "a👩\u200d💻b"     // woman and laptop joined by ZWJ
+		zwnj   = "ab می\u200cروم" // ی kept apart from ر by ZWNJ
+		del    = "\x1b[3~"
+	)
+	tests := []struct {
+		text, keys string
+		want       string
+		x          int
+		// col is the screen column of the cursor.
+		col int
+	}{
+		{accent, "3l", accent, 3, 5},
+		{accent, "4l", accent, 5, 6},
+		{accent, "$h", accent, 3, 5},
+		{accent, "3lx", "cafs", 3, 5},
+		{accent, "$i\x7f\x1b", "cafs", 3, 5},
+		{accent, "3li" + del + "\x1b", "cafs", 3, 5},
+		{accent, "3lvd", "cafs", 3, 5},
+		{accent + "\n" + accent, "3l\x16jd", "cafs\ncafs", 3, 5},
+		{accent, "/s\r", accent, 5, 6},
+		{emoji, "l", emoji, 1, 3},
+		{emoji, "2l", emoji, 4, 5},
+		{emoji, "$h", emoji, 1, 3},
+		{emoji, "lx", "ab", 1, 3},
+		{emoji, "$i\x7f\x1b", "ab", 1, 3},
+		{emoji, "li" + del + "\x1b", "ab", 1, 3},
+		{emoji, "/b\r", emoji, 4, 5},
+		// the line is left to right, with the Persian word shown reversed
+		// after "ab ".
+		{zwnj, "3l", zwnj, 8, 5},
+		{zwnj, "5l", zwnj, 6, 7},
+		{zwnj, "6l", zwnj, 4, 8},
+		{zwnj, "7l", zwnj, 3, 9},
+		{zwnj, "7lh", zwnj, 4, 8},
+		{zwnj, "6lx", "ab مروم", 4, 7},
+		{zwnj, "6ldl", "ab مروم", 4, 7},
+		{zwnj, "5li\x7f\x1b", "ab مروم", 4, 7},
+		{zwnj, "6li" + del + "\x1b", "ab مروم", 4, 7},
+		{zwnj, "/ی\u200cر\r", zwnj, 4, 8},
+	}
+	for _, test := range tests {
+		e, f := newTestEditor(t, 6, 30, "test.txt", test.text+"\n")
+		typeKeys(t, e, f, test.keys)
+		if got := strings.Join(bufferLines(e), "\n"); got != test.want {
+			t.Errorf("%q on %q left %q, want %q", test.keys, test.text, got, test.want)
+		}
+		if e.cx != test.x {
+			t.Errorf("%q on %q went to character %d, want %d", test.keys, test.text, e.cx, test.x)
+		}
+		if _, col := f.Cursor(); col != test.col {
+			t.Errorf("%q on %q put the cursor in column %d, want %d", test.keys, test.text, col, test.col)
+		}
+	}
+}
+
+func TestGraphemeColumns(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "cafe\u0301s a👩\u200d💻b\n")
+	row := e.row(0)
+	for _, test := range []struct{ cx, rx int }{
+		{3, 3}, {5, 4}, {6, 5}, {7, 6}, {8, 7}, {11, 9},
+	} {
+		if got := e.rowCxToRx(row, test.cx); got != test.rx {
+			t.Errorf("rowCxToRx(%d) = %d, want %d", test.cx, got, test.rx)
+		}
+		if got := e.rowRxToCx(row, test.rx); got != test.cx {
+			t.Errorf("rowRxToCx(%d) = %d, want %d", test.rx, got, test.cx)
+		}
+	}
+	// the columns inside a cluster belong to it.
+	if got := e.rowRxToCx(row, 8); got != 8 {
+		t.Errorf("rowRxToCx(8) = %d, want 8", got)
+	}
+
+	// the matches are highlighted over the columns they are shown in.
+	for _, test := range []struct {
+		pattern  string
+		from, to int
+	}{
+		{"e\u0301", 3, 4},
+		{"s", 4, 5},
+		{"👩\u200d💻", 7, 9},
+		{"b", 9, 10},
+	} {
+		typeKeys(t, e, f, "gg0/"+test.pattern+"\r")
+		spans := e.searchSpans(0)
+		if len(spans) == 0 || spans[0].from != test.from || spans[0].to != test.to {
+			t.Errorf("/%s highlights %v, want columns %d to %d", test.pattern, spans, test.from, test.to)
+		}
+	}
+}
+
+// bigText returns a file of n numbered lines, several loader chunks long.
+func bigText(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	return b.String()
+}
+
+// openLoading starts an editor on a file of n lines, of which only the
+// first chunk is indexed, as if the loader were still at work on the rest.
+func openLoading(t *testing.T, n int) (*Editor, *term.Fake, string) {
+	t.Helper()
+	text := bigText(n)
+	e, f := newTestEditor(t, 6, 30, "big.txt", text)
+	file, err := os.Open("big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.loader.close()
+	e.loader = newLoader(file)
+	e.Rows = rope.Rope[*Row]{}.Insert(0, <-e.loader.batches)
+	if e.Rows.Len() >= n {
+		t.Fatalf("%d lines in the first chunk, want fewer than %d", e.Rows.Len(), n)
+	}
+	return e, f, text
+}
+
+func TestSaveWhileLoading(t *testing.T) {
+	for _, test := range []struct {
+		keys string
+		want func(text string) string
+	}{
+		{"dd:w\r", func(text string) string { return strings.TrimPrefix(text, "line 1\n") }},
+		{"j:w\r", func(text string) string { return text }},
+	} {
+		e, f, text := openLoading(t, 300000)
+		typeKeys(t, e, f, test.keys)
+		got, err := os.ReadFile("big.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := test.want(text); string(got) != want {
+			t.Errorf("%q saved %d bytes, want %d", test.keys, len(got), len(want))
+		}
+	}
+}
+
+func TestLastLineWhileLoading(t *testing.T) {
+	const n = 300000
+	for _, test := range []struct {
+		keys string
+		want int
+	}{
+		{"G", n},
+		{":$\r", n},
+		{":999999\r", n},
+		{"?line\r", n},
+		{"/line 299999\r", n - 1},
+	} {
+		e, f, _ := openLoading(t, n)
+		typeKeys(t, e, f, test.keys)
+		if e.cy != test.want-1 {
+			t.Errorf("%q went to line %d, want %d", test.keys, e.cy+1, test.want)
+		}
+	}
+	e, f, _ := openLoading(t, n)
+	typeKeys(t, e, f, ":%d\r")
+	if got := e.Rows.Len(); got != 1 {
+		t.Errorf(":%%d left %d lines, want 1", got)
+	}
+}
+
+func TestSaveKeepsLinks(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\n")
+	if err := os.Link("test.txt", "hard.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("test.txt", "soft.txt"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeKeys(t, e, f, "dd:w\r")
+	after, err := os.Stat("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("saving replaced the file")
+	}
+	if data, _ := os.ReadFile("hard.txt"); string(data) != "two\n" {
+		t.Errorf("hard link holds %q after saving, want %q", data, "two\n")
+	}
+	// writing through the symbolic link writes the file it points to.
+	if _, _, err := e.writeFile("soft.txt", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat("soft.txt"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("soft.txt isn't a symbolic link anymore")
+	}
+	if data, _ := os.ReadFile("test.txt"); string(data) != "two\n" {
+		t.Errorf("test.txt holds %q after writing soft.txt, want %q", data, "two\n")
+	}
+}
+
+func TestSaveWhileLoadingThroughLink(t *testing.T) {
+	e, f, text := openLoading(t, 300000)
+	// big.txt becomes a link to the file the editor is reading.
+	if err := os.Rename("big.txt", "real.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real.txt", "big.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod("real.txt", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	typeKeys(t, e, f, "dd:w\r")
+	if fi, err := os.Lstat("big.txt"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("big.txt isn't a symbolic link anymore")
+	}
+	fi, err := os.Stat("real.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("real.txt has mode %v after saving, want %v", fi.Mode().Perm(), os.FileMode(0o600))
+	}
+	data, err := os.ReadFile("real.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.TrimPrefix(text, "line 1\n"); string(data) != want {
+		t.Errorf("real.txt has %d bytes after saving, want %d", len(data), len(want))
+	}
+}
+
+func TestLoadRowsOnDemand(t *testing.T) {
+	const n = 300000
+	e, _, text := openLoading(t, n)
+	if err := e.waitLoading(); err != nil {
+		t.Fatal(err)
+	}
+	count := func() (loaded, runs int) {
+		e.Rows.Walk(0, func(_ int, row *Row) bool {
+			if row.src == nil {
+				loaded++
+			} else {
+				runs++
+			}
+			return true
+		})
+		return loaded, runs
+	}
+	if e.Rows.Len() != n {
+		t.Errorf("%d lines, want %d", e.Rows.Len(), n)
+	}
+	// nothing was read yet, every chunk is a single run.
+	chunks := (len(text) + loaderChunk - 1) / loaderChunk
+	if loaded, runs := count(); loaded != 0 || runs != chunks {
+		t.Errorf("%d rows loaded and %d runs, want none and %d", loaded, runs, chunks)
+	}
+	for _, y := range []int{150000, 149999, n - 1} {
+		if got, want := string(e.row(y).chars), fmt.Sprintf("line %d", y+1); got != want {
+			t.Errorf("line %d = %q, want %q", y+1, got, want)
+		}
+	}
+	if loaded, _ := count(); loaded > 3*loadBlock {
+		t.Errorf("%d rows loaded after reading 3 lines, want %d at most", loaded, 3*loadBlock)
+	}
+}
+
+func TestCarriageReturns(t *testing.T) {
+	e, _ := newTestEditor(t, 6, 30, "test.txt", "one\r\ntwo\r\n\r\nlast\r")
+	if got, want := bufferLines(e), []string{"one", "two", "", "last"}; !slices.Equal(got, want) {
+		t.Errorf("buffer = %q, want %q", got, want)
+	}
+}
+
+func TestLoaderCloseTwice(t *testing.T) {
+	e, _, _ := openLoading(t, 200000)
+	e.loader.close()
+	e.loader.close()
+}
+
+func TestMarkKeptByUndo(t *testing.T) {
+	for _, keys := range []string{
+		"jlmaxu",
+		"jlma:s/w/W/\ru",
+		"jlmaixyz\x1bu",
+		"jlmaddu",
+		"jlmaddu\x12u",
+		"jlmaGddu",
+	} {
+		e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\n")
+		typeKeys(t, e, f, keys)
+		p, err := e.mark('a')
+		if err != nil {
+			t.Errorf("%q: %v", keys, err)
+			continue
+		}
+		if want := (position{x: 1, y: 1}); p != want {
+			t.Errorf("%q left mark a at %d:%d, want %d:%d", keys, p.y+1, p.x+1, want.y+1, want.x+1)
+		}
+	}
+}
+
+func TestMarkMovedWithLines(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\nfour\n")
+	typeKeys(t, e, f, "jlma:1,3m$\r")
+	p, err := e.mark('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (position{x: 1, y: 2}); p != want {
+		t.Errorf("mark a at %d:%d after :m, want %d:%d", p.y+1, p.x+1, want.y+1, want.x+1)
+	}
+	typeKeys(t, e, f, "u")
+	if p, _ := e.mark('a'); p != (position{x: 1, y: 1}) {
+		t.Errorf("mark a at %d:%d after undoing :m, want 2:2", p.y+1, p.x+1)
+	}
+}
+
+func TestMoveLinesKeepsGlobalMarks(t *testing.T) {
+	e, _ := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\nfour\n")
+	e.row(1).marked = true
+	e.lowestMarked = 2
+	if err := e.moveLines(1, 1, -1); err != nil {
+		t.Fatal(err)
+	}
+	if !e.row(0).marked || e.row(2).marked {
+		t.Errorf("marked rows after :m0 = %v %v %v, want only the first one", e.row(0).marked, e.row(1).marked, e.row(2).marked)
+	}
+	if e.lowestMarked != 0 {
+		t.Errorf("lowest marked row = %d, want 0", e.lowestMarked)
+	}
+}
+
+func TestParseLangmap(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[rune]rune
+		err  bool
+	}{
+		{"", map[rune]rune{}, false},
+		{"ضq,صw", map[rune]rune{'ض': 'q', 'ص': 'w'}, false},
+		{"ضqصw", map[rune]rune{'ض': 'q', 'ص': 'w'}, false},
+		{"ضصث;qwe", map[rune]rune{'ض': 'q', 'ص': 'w', 'ث': 'e'}, false},
+		{"ضq,,صw,", map[rune]rune{'ض': 'q', 'ص': 'w'}, false},
+		{`و\,`, map[rune]rune{'و': ','}, false},
+		{`ک\;,گ'`, map[rune]rune{'ک': ';', 'گ': '\''}, false},
+		{`وک;\,\;`, map[rune]rune{'و': ',', 'ک': ';'}, false},
+		{`ذ\\`, map[rune]rune{'ذ': '\\'}, false},
+		{"hebrew,ץq", nil, false},
+		{"ضqص", nil, true},
+		{"ضص;q", nil, true},
+		{"ض;q;w", nil, true},
+		{`ض\`, nil, true},
+		{"klingon", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseLangmap(test.spec)
+		switch {
+		case test.err:
+			if err == nil {
+				t.Errorf("ParseLangmap(%q) = %q, want an error", test.spec, got)
+			}
+		case err != nil:
+			t.Errorf("ParseLangmap(%q): %v", test.spec, err)
+		case test.want != nil && !maps.Equal(got, test.want):
+			t.Errorf("ParseLangmap(%q) = %q, want %q", test.spec, got, test.want)
+		}
+	}
+
+	// a mapping after a layout overrides it.
+	m, err := ParseLangmap("hebrew,ץq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m['ץ'] != 'q' || m['ק'] != 'e' {
+		t.Errorf("hebrew,ץq maps ץ to %q and ק to %q, want 'q' and 'e'", m['ץ'], m['ק'])
+	}
+
+	// the built-in layouts map as many keys as they are typed from.
+	for _, name := range LangmapNames() {
+		if table := langmaps[name]; len([]rune(table[0])) != len([]rune(table[1])) {
+			t.Errorf("layout %s maps %d keys to %d", name, len([]rune(table[0])), len([]rune(table[1])))
+		}
+		if m, err := ParseLangmap(name); err != nil || len(m) == 0 {
+			t.Errorf("ParseLangmap(%q) = %d keys, %v", name, len(m), err)
+		}
+	}
+}
+
+func TestLangmapKeys(t *testing.T) {
+	m, err := ParseLangmap("russian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Langmap = m
+	t.Cleanup(func() { Langmap = nil })
+
+	const text = "one да two\nthree\nfour\n"
+	tests := []struct {
+		keys string
+		want string
+		y, x int
+	}{
+		// normal mode: ww, ll, jj, dd, 2x.
+		{"цц", text, 0, 7},
+		{"дд", text, 0, 2},
+		{"оо", text, 2, 0},
+		{"вв", "three\nfour", 0, 0},
+		{"2ч", "e да two\nthree\nfour", 0, 0},
+		// f searches for the character typed, d isn't translated.
+		{"ад", text, 0, 4},
+		{"fд", text, 0, 4},
+		// operator pending: dw, dl, df then a literal д, dj.
+		{"вц", "да two\nthree\nfour", 0, 0},
+		{"вд", "ne да two\nthree\nfour", 0, 0},
+		{"вад", "а two\nthree\nfour", 0, 0},
+		{"во", "four", 0, 0},
+		// visual mode: vld, vfдd, Vjd.
+		{"мдв", "e да two\nthree\nfour", 0, 0},
+		{"мадв", "а two\nthree\nfour", 0, 0},
+		{"Мов", "four", 0, 0},
+		// marks: ma then `a and 'a, the name translated or typed as is.
+		{"цьфjj0ёф", text, 0, 4},
+		{"цьфjjэф", text, 0, 0},
+		{"цьajj0ёф", text, 0, 4},
+		{"цьфjj0`a", text, 0, 4},
+		{"ьфцвёф", "да two\nthree\nfour", 0, 0},
+		{"ьфjjвэф", "", 0, 0},
+	}
+	for _, test := range tests {
+		e, f := newTestEditor(t, 6, 30, "test.txt", text)
+		typeKeys(t, e, f, test.keys)
+		want := strings.TrimSuffix(test.want, "\n")
+		if got := strings.Join(bufferLines(e), "\n"); got != want {
+			t.Errorf("%q left %q, want %q", test.keys, got, want)
+		}
+		if e.cy != test.y || e.cx != test.x {
+			t.Errorf("%q went to %d:%d, want %d:%d", test.keys, e.cy+1, e.cx+1, test.y+1, test.x+1)
+		}
+	}
+}
+
+// bufferLines returns the lines of the current buffer.
+func bufferLines(e *Editor) []string {
+	var lines []string
+	for y := 0; y < e.Rows.Len(); y++ {
+		lines = append(lines, string(e.row(y).chars))
+	}
+	return lines
+}
+
+// reopen closes e and opens its file in another editor, the way a later
+// session would, with the file read through.
+func reopen(t *testing.T, e *Editor) (*Editor, *term.Fake) {
+	t.Helper()
+	filename := e.filename
+	e.Close()
+	f := term.NewFake(6, 30)
+	e = &Editor{}
+	if err := e.Init(f, log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if err := e.OpenFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.waitLoading(); err != nil {
+		t.Fatal(err)
+	}
+	e.Render()
+	return e, f
+}
+
+// withUndoDir turns persistent undo on for a test, in a directory of its
+// own.
+func withUndoDir(t *testing.T) {
+	UndoDir = t.TempDir()
+	t.Cleanup(func() { UndoDir = "" })
+}
+
+func TestUndoFile(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\nthree\n")
+	withUndoDir(t)
+	typeKeys(t, e, f, "dd:w\rx:w\r")
+	e, f = reopen(t, e)
+	for _, step := range []struct {
+		keys string
+		want []string
+	}{
+		{"", []string{"wo", "three"}},
+		{"u", []string{"two", "three"}},
+		{"u", []string{"one", "two", "three"}},
+		{"u", []string{"one", "two", "three"}},
+		{"\x12\x12", []string{"wo", "three"}},
+	} {
+		typeKeys(t, e, f, step.keys)
+		if got := bufferLines(e); !slices.Equal(got, step.want) {
+			t.Errorf("after %q the buffer is %q, want %q", step.keys, got, step.want)
+		}
+	}
+}
+
+func TestUndoFileOfChangedFile(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\n")
+	withUndoDir(t)
+	typeKeys(t, e, f, "dd:w\r")
+	// another program writes the file.
+	if err := os.WriteFile("test.txt", []byte("changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, f = reopen(t, e)
+	if n := len(e.undoTree.nodes); n != 1 {
+		t.Errorf("history of the changed file has %d states, want 1", n)
+	}
+	typeKeys(t, e, f, "u")
+	if got := bufferLines(e); !slices.Equal(got, []string{"changed"}) {
+		t.Errorf("after u the buffer is %q, want [\"changed\"]", got)
+	}
+}
+
+func TestUndoFilePath(t *testing.T) {
+	t.Cleanup(func() { UndoDir = "" })
+	UndoDir = ""
+	if _, err := undoFilePath("/a/b.txt"); err == nil {
+		t.Errorf("undoFilePath with no undo directory didn't fail")
+	}
+	UndoDir = "/undo"
+	if got, _ := undoFilePath("/home/me/notes.txt"); got != "/undo/%home%me%notes.txt" {
+		t.Errorf("undoFilePath(/home/me/notes.txt) = %q, want %q", got, "/undo/%home%me%notes.txt")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/undo/" + strings.ReplaceAll(wd, "/", "%") + "%notes.txt"
+	if got, _ := undoFilePath("notes.txt"); got != want {
+		t.Errorf("undoFilePath(notes.txt) = %q, want %q", got, want)
+	}
+}
+
+func TestCorruptUndoFile(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "one\ntwo\n")
+	withUndoDir(t)
+	sum := sha256.Sum256([]byte("one\ntwo\n"))
+	path, err := undoFilePath("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bad bytes.Buffer
+	gob.NewEncoder(&bad).Encode(undoFile{Hash: sum, Cur: 1, Nodes: []undoFileNode{{Parent: -1}, {Parent: 1}}})
+	for name, data := range map[string][]byte{
+		"garbage":         []byte("not a gob"),
+		"cut short":       bad.Bytes()[:bad.Len()/2],
+		"bad parent":      bad.Bytes(),
+		"no nodes at all": {},
+	} {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.readUndoFile(sum); err == nil {
+			t.Errorf("reading a %s undo file didn't fail", name)
+		}
+	}
+	// the file opens all the same, with no history.
+	e, f = reopen(t, e)
+	typeKeys(t, e, f, "u")
+	if got := bufferLines(e); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("after u the buffer is %q, want [\"one\" \"two\"]", got)
+	}
+}
+
+func TestUndoTime(t *testing.T) {
+	e, f := newTestEditor(t, 6, 30, "test.txt", "abcdef\n")
+	// states 0 to 5, state n having deleted n characters.
+	typeKeys(t, e, f, "xxxxx")
+	tree := &e.undoTree
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for seq, d := range []time.Duration{0, 10 * time.Second, 5 * time.Minute, 2 * time.Hour, 24 * time.Hour, 48 * time.Hour} {
+		tree.nodes[seq].time = base.Add(d)
+	}
+	// the file was written in states 2 and 4.
+	tree.nodes[2].save, tree.nodes[4].save, tree.saves = 1, 2, 2
+
+	tests := []struct {
+		from int
+		cmd  string
+		want int
+	}{
+		{5, "earlier 1d", 4},
+		{5, "earlier 10s", 4},
+		{4, "earlier 1h", 3},
+		{3, "earlier 2h", 0},
+		{3, "earlier 119m", 1},
+		{2, "earlier 4m", 1},
+		{2, "earlier 5m", 0},
+		{0, "later 10s", 1},
+		{0, "later 9s", 0},
+		{1, "later 1d", 4},
+		{0, "later 3d", 5},
+		{5, "earlier 2", 3},
+		{0, "later", 1},
+		// with changes since the last write, the first f goes back to it.
+		{5, "earlier 1f", 4},
+		{5, "earlier 2f", 2},
+		{5, "earlier 3f", 0},
+		{3, "earlier 1f", 2},
+		{4, "earlier 1f", 2},
+		{2, "earlier 1f", 0},
+		{0, "later 1f", 2},
+		{3, "later 1f", 4},
+		{2, "later 1f", 4},
+		{4, "later 1f", 5},
+	}
+	for _, test := range tests {
+		e.undoGoto(tree.nodes[test.from])
+		typeKeys(t, e, f, ":"+test.cmd+"\r")
+		if got := tree.cur.seq; got != test.want {
+			t.Errorf(":%s from state %d went to state %d, want %d", test.cmd, test.from, got, test.want)
+		}
+		if got, want := string(e.row(0).chars), "abcdef"[test.want:]; got != want {
+			t.Errorf(":%s from state %d left %q, want %q", test.cmd, test.from, got, want)
+		}
+	}
+
+	if err := e.UndoTime("1y", false); err == nil {
+		t.Errorf("UndoTime(1y) didn't fail")
+	}
+	if err := e.UndoTime("-1m", false); err == nil {
+		t.Errorf("UndoTime(-1m) didn't fail")
+	}
+}
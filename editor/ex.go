@@ -0,0 +1,340 @@
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrInvalidRange   = errors.New("Invalid range")
+	ErrInvalidAddress = errors.New("Invalid address")
+	ErrNoPattern      = errors.New("No previous regular expression")
+)
+
+// exCommand is a parsed command line: [range]name[!] [args].
+type exCommand struct {
+	// from and to are the lines of the range, counted from zero. They are
+	// the cursor line when no address is given.
+	from, to int
+	// addresses is the number of addresses given, up to two.
+	addresses int
+	// name is the name of the command along with its !, like "w" or "q!".
+	// It is empty for a range on its own.
+	name string
+	args []string
+	// arg is the text after the name, as typed.
+	arg string
+}
+
+// parseExCommand parses a command line typed after :. A range of lines
+// goes before the name of the command. It is made of addresses, one or two
+// separated by , or ;, or % for the whole buffer. An address is one of
+//
+//	N          the line N
+//	.          the cursor line
+//	$          the last line
+//	'x         the line of the mark x
+//	/pattern/  the next line matching pattern
+//	?pattern?  the previous line matching pattern
+//
+// followed by any number of +N and -N offsets. An address that is only
+// offsets counts from the cursor line. With ; rather than , the second
+// address counts from the first one.
+func (e *Editor) parseExCommand(s string) (exCommand, error) {
+	cur := e.clampY(e.cy)
+	cmd := exCommand{from: cur, to: cur}
+	i := skipBlanks(s, 0)
+	if i < len(s) && s[i] == '%' {
+		e.waitLoading()
+		cmd.from, cmd.to, cmd.addresses = 0, e.Rows.Len()-1, 2
+		i++
+	} else {
+		var lines []int
+		for {
+			line, n, err := e.parseAddress(s[i:], cur)
+			if err != nil {
+				return cmd, err
+			}
+			i = skipBlanks(s, i+n)
+			separator := i < len(s) && (s[i] == ',' || s[i] == ';')
+			if n == 0 && (separator || len(lines) > 0) {
+				// a missing address next to a , is the cursor line.
+				line = cur
+			} else if n == 0 {
+				break
+			}
+			lines = append(lines, line)
+			if !separator {
+				break
+			}
+			if s[i] == ';' {
+				cur = line
+			}
+			i = skipBlanks(s, i+1)
+		}
+		if len(lines) > 0 {
+			cmd.from, cmd.to = lines[max(len(lines)-2, 0)], lines[len(lines)-1]
+			cmd.addresses = min(len(lines), 2)
+		}
+	}
+	if cmd.from > cmd.to {
+		cmd.from, cmd.to = cmd.to, cmd.from
+	}
+
+	i = skipBlanks(s, i)
+	start := i
+	switch {
+	case i == len(s):
+	case isLetter(s[i]):
+		for i < len(s) && isLetter(s[i]) {
+			i++
+		}
+	default:
+		// commands like > and <, repeated for more.
+		for i < len(s) && s[i] == s[start] {
+			i++
+		}
+	}
+	if i < len(s) && s[i] == '!' {
+		i++
+	}
+	cmd.name = s[start:i]
+	cmd.arg = strings.TrimSpace(s[i:])
+	cmd.args = strings.Fields(cmd.arg)
+
+	if cmd.to >= e.Rows.Len() {
+		// the line may be in the part of the file still being read.
+		e.waitLoading()
+	}
+	if cmd.name == "" {
+		// going to a line past the end goes to the last one.
+		cmd.to = min(cmd.to, e.Rows.Len()-1)
+		cmd.from = min(cmd.from, cmd.to)
+	}
+	if cmd.from == -1 {
+		// line 0 is taken for the first line.
+		cmd.from, cmd.to = 0, max(cmd.to, 0)
+	}
+	if cmd.from < 0 || cmd.to >= e.Rows.Len() {
+		return cmd, ErrInvalidRange
+	}
+	return cmd, nil
+}
+
+// parseAddress parses the address s starts with, counting relative lines
+// from the line cur. It returns the line, counted from zero, and the length
+// of the address, which is zero when s doesn't start with one. The line
+// before the first one is -1.
+func (e *Editor) parseAddress(s string, cur int) (line, n int, err error) {
+	line = cur
+	i := 0
+	switch {
+	case i == len(s):
+		return 0, 0, nil
+	case s[i] == '.':
+		i++
+	case s[i] == '$':
+		e.waitLoading()
+		line = e.Rows.Len() - 1
+		i++
+	case isDigit(s[i]):
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		number, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, 0, ErrInvalidRange
+		}
+		line = number - 1
+	case s[i] == '\'':
+		if i+1 == len(s) {
+			return 0, 0, ErrInvalidAddress
+		}
+		r := rune(s[i+1])
+		if !unicode.IsLower(r) && r != '<' && r != '>' {
+			return 0, 0, ErrInvalidAddress
+		}
+		p, err := e.mark(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		line = p.y
+		i += 2
+	case s[i] == '/' || s[i] == '?':
+		delim := s[i]
+		end := strings.IndexByte(s[i+1:], delim)
+		pattern := s[i+1:]
+		if end >= 0 {
+			pattern = s[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			i = len(s)
+		}
+		dir := 1
+		if delim == '?' {
+			dir = -1
+		}
+		if line, err = e.searchLine(pattern, cur, dir); err != nil {
+			return 0, 0, err
+		}
+	case s[i] == '+' || s[i] == '-':
+		// offsets from the cursor line.
+	default:
+		return 0, 0, nil
+	}
+
+	for i < len(s) && (s[i] == '+' || s[i] == '-') {
+		sign := 1
+		if s[i] == '-' {
+			sign = -1
+		}
+		i++
+		j := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		offset := 1
+		if j < i {
+			if offset, err = strconv.Atoi(s[j:i]); err != nil {
+				return 0, 0, ErrInvalidRange
+			}
+		}
+		line += sign * offset
+	}
+	return line, i, nil
+}
+
+// searchLine returns the first line after the line from, or before it
+// when dir is -1, that matches pattern, going round at the ends of the
+// buffer.
+func (e *Editor) searchLine(pattern string, from, dir int) (int, error) {
+	re, err := e.compilePattern(pattern, e.ignoreCase(pattern))
+	if err != nil {
+		return 0, err
+	}
+	// going round at the end takes the whole file.
+	e.waitLoading()
+	n := e.Rows.Len()
+	for i := 1; i <= n; i++ {
+		y := ((from+dir*i)%n + n) % n
+		if re.MatchString(string(e.row(y).chars)) {
+			return y, nil
+		}
+	}
+	return 0, fmt.Errorf("Pattern not found: %s", pattern)
+}
+
+// compilePattern compiles a regular expression typed by the user, which
+// becomes the last pattern. An empty one stands for the last pattern.
+func (e *Editor) compilePattern(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = e.lastPattern
+	}
+	if pattern == "" {
+		return nil, ErrNoPattern
+	}
+	expr := pattern
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	e.lastPattern = pattern
+	e.noHighlight = false
+	return re, nil
+}
+
+// exCount reads the count a command like :d or :> takes after its name:
+// the range becomes that many lines starting at its last line.
+func (e *Editor) exCount(cmd *exCommand, arg string) error {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return fmt.Errorf("Trailing characters: %s", arg)
+	}
+	if n <= 0 {
+		return errors.New("Positive count required")
+	}
+	cmd.from = cmd.to
+	cmd.to = min(cmd.to+n-1, e.Rows.Len()-1)
+	return nil
+}
+
+// moveLines moves the lines from..to below the line at, -1 being above the
+// first line, as a single change.
+func (e *Editor) moveLines(from, to, at int) error {
+	if at >= from && at < to {
+		return errors.New("Cannot move a range of lines into itself")
+	}
+	if at == to || at == from-1 {
+		// the lines are there already.
+		e.cy = to
+		return nil
+	}
+	lines := e.rowStrings(from, to)
+	n := to - from + 1
+	// the marks and the :global marks of the lines go with them.
+	marked := make([]bool, n)
+	for i := range marked {
+		marked[i] = e.row(from + i).marked
+	}
+	marks := make(map[rune]position)
+	for name, p := range e.marks {
+		if p.y >= from && p.y <= to {
+			marks[name] = position{x: p.x, y: p.y - from}
+		}
+	}
+	lo, hi := min(from, at+1), max(to, at)
+	e.change(lo, hi, func() {
+		for y := to; y >= from; y-- {
+			e.DeleteRow(y)
+		}
+		if at > to {
+			at -= n
+		}
+		for i, line := range lines {
+			e.InsertRow(at+1+i, line)
+			e.row(at + 1 + i).marked = marked[i]
+			if marked[i] && at+1+i < e.lowestMarked {
+				e.lowestMarked = at + 1 + i
+			}
+		}
+	})
+	for name, p := range marks {
+		e.marks[name] = position{x: p.x, y: at + 1 + p.y}
+	}
+	e.cy = at + n
+	return nil
+}
+
+// copyLines copies the lines from..to below the line at, -1 being above the
+// first line.
+func (e *Editor) copyLines(from, to, at int) {
+	lines := e.rowStrings(from, to)
+	e.change(at+1, at, func() {
+		for i, line := range lines {
+			e.InsertRow(at+1+i, line)
+		}
+	})
+	e.cy = at + len(lines)
+}
+
+func skipBlanks(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
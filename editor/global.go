@@ -0,0 +1,76 @@
+package editor
+
+import (
+	"errors"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Global runs :[range]g/pattern/command, or :v/pattern/command with invert
+// set. It marks the lines of the range, the whole buffer when none is given,
+// that match pattern, or don't with invert, then runs the command on each
+// marked line in turn with the cursor on it. The marks stay on their lines
+// while the command adds or deletes lines, and a marked line that gets
+// deleted is skipped. The whole of it is a single change to undo.
+func (e *Editor) Global(cmd exCommand, invert bool) error {
+	if e.inGlobal {
+		return errors.New("Cannot do :global recursive")
+	}
+	if cmd.addresses == 0 {
+		e.waitLoading()
+		cmd.from, cmd.to = 0, e.Rows.Len()-1
+	}
+	if cmd.arg == "" {
+		return errors.New("Regular expression missing from :global")
+	}
+	delim, size := utf8.DecodeRuneInString(cmd.arg)
+	if unicode.IsLetter(delim) || unicode.IsDigit(delim) || unicode.IsSpace(delim) || delim == '\\' || delim == '"' || delim == '|' {
+		return errors.New("Regular expressions can't be delimited by letters")
+	}
+	fields, command := splitDelimited(cmd.arg[size:], delim, 1)
+	re, err := e.compilePattern(fields[0], e.ignoreCase(fields[0]))
+	if err != nil {
+		return err
+	}
+
+	e.lowestMarked = -1
+	for y := cmd.from; y <= cmd.to; y++ {
+		row := e.row(y)
+		if row.marked = re.MatchString(string(row.chars)) != invert; row.marked && e.lowestMarked < 0 {
+			e.lowestMarked = y
+		}
+	}
+	if e.lowestMarked < 0 {
+		if invert {
+			return errors.New("Pattern found in every line: " + fields[0])
+		}
+		return errors.New("Pattern not found: " + fields[0])
+	}
+
+	e.inGlobal = true
+	defer func() { e.inGlobal = false }()
+	for y := e.lowestMarked; y < e.Rows.Len(); y++ {
+		row := e.row(y)
+		if !row.marked {
+			continue
+		}
+		row.marked = false
+		// the rows before the next one to look at are done, the command may
+		// add or delete some of them.
+		e.lowestMarked = y + 1
+		e.cy, e.cx = y, 0
+		if err := e.runCommand(command); err != nil {
+			e.unmarkRows()
+			return err
+		}
+		y = e.lowestMarked - 1
+	}
+	return nil
+}
+
+// unmarkRows clears the marks :global leaves when it stops half way.
+func (e *Editor) unmarkRows() {
+	for y := max(e.lowestMarked, 0); y < e.Rows.Len(); y++ {
+		e.row(y).marked = false
+	}
+}
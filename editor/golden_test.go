@@ -0,0 +1,421 @@
+package editor
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amirali/virayeshgar/editor/syntax"
+	"github.com/amirali/virayeshgar/editor/term"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the screen tests")
+
+// A screenTest types keys into an editor on a fixture from testdata/fixtures
+// and compares the buffer, the cursor and the screen it ends up with to the
+// golden file testdata/golden/<name>.golden.
+type screenTest struct {
+	name    string
+	fixture string
+	keys    string
+	// others are more fixtures put next to the one opened, for the test to
+	// open.
+	others []string
+	// screenCursor adds where the cursor is on the screen.
+	screenCursor bool
+	// styles adds the colors and attributes of the screen to the golden
+	// file.
+	styles bool
+}
+
+// Keys that aren't printable, as the terminal sends them.
+const (
+	esc   = "\x1b"
+	enter = "\r"
+	ctrlR = "\x12"
+	ctrlV = "\x16"
+	ctrlW = "\x17"
+	up    = "\x1b[A"
+	down  = "\x1b[B"
+	right = "\x1b[C"
+	left  = "\x1b[D"
+	home  = "\x1b[H"
+	end   = "\x1b[F"
+	del   = "\x1b[3~"
+)
+
+var screenTests = []screenTest{
+	// motions
+	{name: "motion-h", fixture: "text.txt", keys: "5lh"},
+	{name: "motion-l", fixture: "text.txt", keys: "3l"},
+	{name: "motion-j", fixture: "text.txt", keys: "2j"},
+	{name: "motion-k", fixture: "text.txt", keys: "3jk"},
+	{name: "motion-arrows", fixture: "text.txt", keys: down + right + right + up + left},
+	{name: "motion-0", fixture: "text.txt", keys: "$0"},
+	{name: "motion-home-end", fixture: "text.txt", keys: end + "j" + home},
+	{name: "motion-caret", fixture: "text.txt", keys: "4j$^"},
+	{name: "motion-dollar", fixture: "text.txt", keys: "j$"},
+	{name: "motion-w", fixture: "text.txt", keys: "5j3w"},
+	{name: "motion-W", fixture: "text.txt", keys: "7jW"},
+	{name: "motion-b", fixture: "text.txt", keys: "$2b"},
+	{name: "motion-B", fixture: "text.txt", keys: "7j$B"},
+	{name: "motion-e", fixture: "text.txt", keys: "7j2e"},
+	{name: "motion-E", fixture: "text.txt", keys: "7jE"},
+	{name: "motion-paragraph-forward", fixture: "text.txt", keys: "}"},
+	{name: "motion-paragraph-backward", fixture: "text.txt", keys: "G{"},
+	{name: "motion-gg", fixture: "text.txt", keys: "Gllgg"},
+	{name: "motion-G", fixture: "text.txt", keys: "G"},
+	{name: "motion-count-G", fixture: "text.txt", keys: "4G"},
+	{name: "motion-H", fixture: "text.txt", keys: "GH"},
+	{name: "motion-M", fixture: "text.txt", keys: "M"},
+	{name: "motion-L", fixture: "text.txt", keys: "L"},
+	{name: "motion-f", fixture: "text.txt", keys: "2fo"},
+	{name: "motion-t", fixture: "text.txt", keys: "tq"},
+	{name: "motion-F", fixture: "text.txt", keys: "$Fo"},
+	{name: "motion-T", fixture: "text.txt", keys: "$2To"},
+
+	// operators
+	{name: "delete-word", fixture: "text.txt", keys: "dw"},
+	{name: "delete-line", fixture: "text.txt", keys: "dd"},
+	{name: "delete-lines-count", fixture: "text.txt", keys: "2dd"},
+	{name: "delete-to-find", fixture: "text.txt", keys: "dfx"},
+	{name: "delete-down", fixture: "text.txt", keys: "dj"},
+	{name: "yank-put", fixture: "text.txt", keys: "yyjp"},
+	{name: "yank-word-put-before", fixture: "text.txt", keys: "yw$P"},
+	{name: "change-word", fixture: "text.txt", keys: "cwA" + esc},
+	{name: "change-line", fixture: "text.txt", keys: "jccnew line" + esc},
+	{name: "indent", fixture: "text.txt", keys: ">>j>j"},
+	{name: "unindent", fixture: "text.txt", keys: "4j<<"},
+	{name: "toggle-case-operator", fixture: "text.txt", keys: "g~w"},
+	{name: "lower-case-line", fixture: "text.txt", keys: "guu"},
+	{name: "upper-case-word", fixture: "text.txt", keys: "wgUiw"},
+	{name: "count-operator", fixture: "text.txt", keys: "d3w"},
+	{name: "register", fixture: "text.txt", keys: "\"ayyj\"ap"},
+	{name: "register-append", fixture: "text.txt", keys: "\"ayyj\"Ayyj\"aP"},
+
+	// text objects
+	{name: "object-inner-word", fixture: "text.txt", keys: "wdiw"},
+	{name: "object-a-WORD", fixture: "text.txt", keys: "7jdaW"},
+	{name: "object-inner-paren", fixture: "text.txt", keys: "5jwdi("},
+	{name: "object-a-bracket", fixture: "text.txt", keys: "5jfida["},
+	{name: "object-inner-brace", fixture: "text.txt", keys: "5jfbci{x" + esc},
+	{name: "object-inner-angle", fixture: "text.txt", keys: "5jf<di<"},
+	{name: "object-inner-quote", fixture: "text.txt", keys: "5jfqci\"x" + esc},
+	{name: "object-a-single-quote", fixture: "text.txt", keys: "5jfsda'"},
+	{name: "object-paragraph", fixture: "text.txt", keys: "dap"},
+
+	// commands
+	{name: "insert", fixture: "text.txt", keys: "wiA " + esc},
+	{name: "insert-start", fixture: "text.txt", keys: "4j$I> " + esc},
+	{name: "append", fixture: "text.txt", keys: "a!" + esc},
+	{name: "append-end", fixture: "text.txt", keys: "A!!" + esc},
+	{name: "open-below", fixture: "text.txt", keys: "onew" + esc},
+	{name: "open-above", fixture: "text.txt", keys: "jOnew" + esc},
+	{name: "insert-newline-backspace", fixture: "text.txt", keys: "wi\rx\x7f" + esc},
+	{name: "insert-delete", fixture: "text.txt", keys: "i" + del + del + esc},
+	{name: "x", fixture: "text.txt", keys: "x"},
+	{name: "x-count", fixture: "text.txt", keys: "3x"},
+	{name: "X", fixture: "text.txt", keys: "$X"},
+	{name: "D", fixture: "text.txt", keys: "wD"},
+	{name: "C", fixture: "text.txt", keys: "wCend." + esc},
+	{name: "s", fixture: "text.txt", keys: "sA" + esc},
+	{name: "S", fixture: "text.txt", keys: "jSreplaced" + esc},
+	{name: "Y", fixture: "text.txt", keys: "YGp"},
+	{name: "put-count", fixture: "text.txt", keys: "yy2p"},
+	{name: "tilde", fixture: "text.txt", keys: "4~"},
+	{name: "undo", fixture: "text.txt", keys: "ddjdd" + "u"},
+	{name: "redo", fixture: "text.txt", keys: "ddjdd" + "uu" + ctrlR},
+	{name: "undo-insert", fixture: "text.txt", keys: "ione " + esc + "itwo " + esc + "u"},
+	{name: "undo-branches", fixture: "text.txt", keys: "xuXg-g-"},
+	{name: "redo-branches", fixture: "text.txt", keys: "xux" + "g-g-g+"},
+	{name: "visual", fixture: "text.txt", keys: "wvee"},
+	{name: "visual-delete", fixture: "text.txt", keys: "wvjd"},
+	{name: "visual-line", fixture: "text.txt", keys: "Vj"},
+	{name: "visual-line-yank-put", fixture: "text.txt", keys: "VjyGp"},
+	{name: "visual-block", fixture: "text.txt", keys: ctrlV + "jll"},
+	{name: "visual-block-delete", fixture: "text.txt", keys: ctrlV + "jlld"},
+	{name: "visual-object", fixture: "text.txt", keys: "5jfqvi\""},
+	{name: "command-line", fixture: "text.txt", keys: ":undo"},
+	{name: "ex-delete", fixture: "text.txt", keys: ":d" + enter},
+	{name: "ex-visual-range", fixture: "text.txt", keys: "Vj:>" + enter},
+	{name: "ex-goto-line", fixture: "text.txt", keys: ":5" + enter},
+	{name: "ex-goto-relative", fixture: "text.txt", keys: "j:+3" + enter},
+	{name: "ex-range-delete", fixture: "text.txt", keys: ":2,4d" + enter},
+	{name: "ex-range-yank", fixture: "text.txt", keys: "5G:.,$y" + enter + "ggP"},
+	{name: "ex-range-count", fixture: "text.txt", keys: ":2d 3" + enter},
+	{name: "ex-range-whole", fixture: "text.txt", keys: ":%>" + enter},
+	{name: "ex-range-marks", fixture: "text.txt", keys: "jmajjmbgg:'a,'bd" + enter},
+	{name: "ex-range-pattern", fixture: "text.txt", keys: ":/vexingly/;+1d" + enter},
+	{name: "ex-range-offsets", fixture: "text.txt", keys: "3G:-1,.+2>>" + enter},
+	{name: "ex-move", fixture: "text.txt", keys: ":1,2m$" + enter},
+	{name: "ex-move-up", fixture: "text.txt", keys: "G:m0" + enter},
+	{name: "ex-copy", fixture: "text.txt", keys: ":4t." + enter},
+	{name: "ex-invalid-range", fixture: "text.txt", keys: ":3,20d" + enter},
+	{name: "substitute", fixture: "text.txt", keys: ":s/o/0/" + enter},
+	{name: "substitute-global-range", fixture: "text.txt", keys: ":%s/o/0/g" + enter},
+	{name: "substitute-groups", fixture: "text.txt", keys: `:s/(\w+) (\w+)/\2 $1/` + enter},
+	{name: "substitute-named-group", fixture: "text.txt", keys: `:s/(?P<first>\w+)/[${first}]/` + enter},
+	{name: "substitute-case", fixture: "text.txt", keys: `:s/quick/\u&/` + enter + `:2s/\w+/\U&\E!/g` + enter},
+	{name: "substitute-ignore-case", fixture: "text.txt", keys: ":s/the/A/gi" + enter},
+	{name: "substitute-line-break", fixture: "text.txt", keys: `:s/ over /\r/` + enter},
+	{name: "substitute-count", fixture: "text.txt", keys: ":%s/o//gn" + enter},
+	{name: "substitute-repeat", fixture: "text.txt", keys: ":s/o/0/" + enter + "j:s" + enter},
+	{name: "substitute-undo", fixture: "text.txt", keys: ":%s/o/0/g" + enter + "u"},
+	{name: "substitute-not-found", fixture: "text.txt", keys: ":s/xyz/0/" + enter},
+	{name: "substitute-confirm", fixture: "text.txt", keys: ":1,2s/o/0/gc" + enter + "ynyl"},
+	{name: "substitute-confirm-prompt", fixture: "text.txt", keys: ":%s/o/0/gc" + enter + "y", styles: true},
+	{name: "global-delete", fixture: "text.txt", keys: ":g/o/d" + enter},
+	{name: "global-copy", fixture: "text.txt", keys: ":g/^\\t/t$" + enter},
+	{name: "global-move", fixture: "text.txt", keys: ":g/^/m0" + enter},
+	{name: "global-range", fixture: "text.txt", keys: ":3,$g/q/s/[aeiou]/_/g" + enter},
+	{name: "global-delete-next", fixture: "text.txt", keys: ":g/./+1d" + enter},
+	{name: "global-undo", fixture: "text.txt", keys: ":g/o/d" + enter + "u"},
+	{name: "vglobal", fixture: "text.txt", keys: ":v/o/d" + enter},
+	{name: "global-bang", fixture: "text.txt", keys: ":g!/^$/>" + enter},
+	{name: "global-mark", fixture: "text.txt", keys: "Gma:g/^$/d" + enter + ":'ad" + enter},
+	{name: "mark-jump", fixture: "text.txt", keys: "4Glmagg`a"},
+
+	// windows and tab pages
+	{name: "window-split", fixture: "text.txt", keys: ctrlW + "sj"},
+	{name: "window-vsplit", fixture: "text.txt", keys: ctrlW + "v" + ctrlW + "lG"},
+	{name: "window-cycle", fixture: "text.txt", keys: ctrlW + "s" + ctrlW + "w" + "dd"},
+	{name: "window-move", fixture: "text.txt", keys: ctrlW + "v" + ctrlW + "s" + ctrlW + "j" + "G" + ctrlW + "l" + ctrlW + "h" + ctrlW + "k"},
+	{name: "window-cycle-back", fixture: "text.txt", keys: ctrlW + "s" + ctrlW + "s" + ctrlW + "W" + "x"},
+	{name: "window-quit", fixture: "text.txt", keys: ctrlW + "sG" + ctrlW + "q"},
+	{name: "window-vresize", fixture: "text.txt", keys: ctrlW + "v3" + ctrlW + ">" + ctrlW + "<"},
+	{name: "window-widest", fixture: "text.txt", keys: ctrlW + "v" + ctrlW + "|"},
+	{name: "window-close", fixture: "text.txt", keys: ctrlW + "sG" + ctrlW + "c"},
+	{name: "window-only", fixture: "text.txt", keys: ctrlW + "s" + ctrlW + "v" + ctrlW + "o"},
+	{name: "window-resize", fixture: "text.txt", keys: ctrlW + "s2" + ctrlW + "-"},
+	{name: "window-equalize", fixture: "text.txt", keys: ctrlW + "s" + ctrlW + "_" + ctrlW + "="},
+	{name: "tab-next", fixture: "text.txt", keys: ":tabnew" + enter + "gt"},
+	{name: "tab-previous", fixture: "text.txt", keys: ":tabnew" + enter + ":tabnew" + enter + "gT"},
+	{name: "buffer-edit", fixture: "text.txt", others: []string{"hello.go"}, keys: ":e hello.go" + enter},
+	{name: "buffer-edit-new", fixture: "text.txt", keys: ":e new.txt" + enter + "ihi" + esc},
+	{name: "buffer-edit-open", fixture: "text.txt", others: []string{"hello.go"}, keys: "j:e hello.go" + enter + ":e text.txt" + enter},
+	{name: "buffer-next", fixture: "text.txt", others: []string{"hello.go", "hello.py"}, keys: ":e hello.go" + enter + ":e hello.py" + enter + ":bn" + enter},
+	{name: "buffer-previous", fixture: "text.txt", others: []string{"hello.go", "hello.py"}, keys: ":e hello.go" + enter + ":bp" + enter + ":bp" + enter},
+	{name: "buffer-number", fixture: "text.txt", others: []string{"hello.go", "hello.py"}, keys: ":e hello.go" + enter + ":e hello.py" + enter + ":b 2" + enter},
+	{name: "buffer-list", fixture: "text.txt", others: []string{"hello.go"}, keys: "x:e hello.go" + enter + ":ls" + enter},
+	{name: "buffer-delete", fixture: "text.txt", others: []string{"hello.go"}, keys: ":e hello.go" + enter + ":bd" + enter},
+	{name: "buffer-delete-number", fixture: "text.txt", others: []string{"hello.go"}, keys: ":e hello.go" + enter + ":bd 1" + enter + ":ls" + enter},
+	{name: "buffer-delete-modified", fixture: "text.txt", others: []string{"hello.go"}, keys: ":e hello.go" + enter + "x:bd" + enter},
+	{name: "buffer-delete-modified-force", fixture: "text.txt", others: []string{"hello.go"}, keys: ":e hello.go" + enter + "x:bd!" + enter + ":ls" + enter},
+	{name: "buffer-hidden-changes", fixture: "text.txt", others: []string{"hello.go"}, keys: "x:e hello.go" + enter + ":bp" + enter},
+	{name: "buffer-leave-modified", fixture: "text.txt", others: []string{"hello.go"}, keys: ":set nohidden" + enter + "x:e hello.go" + enter},
+	{name: "buffer-leave-modified-next", fixture: "text.txt", others: []string{"hello.go"}, keys: ":e hello.go" + enter + ":set nohidden" + enter + "x:bn" + enter},
+	{name: "buffer-leave-modified-force", fixture: "text.txt", others: []string{"hello.go"}, keys: ":set nohidden" + enter + "x:e! hello.go" + enter + ":b 1" + enter},
+	{name: "buffer-reload", fixture: "text.txt", keys: "x:e" + enter},
+	{name: "buffer-reload-force", fixture: "text.txt", keys: "x:e!" + enter},
+	// the changes are gone from the file read again, and so is their undo
+	// history.
+	{name: "buffer-reload-undo", fixture: "text.txt", keys: "xx:e!" + enter + "u"},
+	{name: "buffer-reload-saved-undo", fixture: "text.txt", keys: "x:w" + enter + ":e" + enter + "u"},
+
+	// right-to-left text, the cursor going across the screen with h and l
+	// but through the text with operators.
+	{name: "rtl-show", fixture: "mixed.txt", screenCursor: true},
+	{name: "rtl-l", fixture: "mixed.txt", keys: "l", screenCursor: true},
+	{name: "rtl-h", fixture: "mixed.txt", keys: "h", screenCursor: true},
+	{name: "rtl-h-count", fixture: "mixed.txt", keys: "6h", screenCursor: true},
+	{name: "rtl-h-into-ltr", fixture: "mixed.txt", keys: "4h", screenCursor: true},
+	{name: "rtl-end", fixture: "mixed.txt", keys: "$", screenCursor: true},
+	{name: "rtl-end-l", fixture: "mixed.txt", keys: "$l", screenCursor: true},
+	{name: "rtl-run-in-ltr", fixture: "mixed.txt", keys: "jw", screenCursor: true},
+	{name: "rtl-run-in-ltr-l", fixture: "mixed.txt", keys: "jwl", screenCursor: true},
+	{name: "rtl-run-in-ltr-h", fixture: "mixed.txt", keys: "jwh", screenCursor: true},
+	{name: "rtl-run-in-ltr-out", fixture: "mixed.txt", keys: "jw4l", screenCursor: true},
+	{name: "rtl-number", fixture: "mixed.txt", keys: "2jw", screenCursor: true},
+	{name: "rtl-number-l", fixture: "mixed.txt", keys: "2jwl", screenCursor: true},
+	{name: "rtl-number-h", fixture: "mixed.txt", keys: "2jwh", screenCursor: true},
+	{name: "rtl-x", fixture: "mixed.txt", keys: "jwlx", screenCursor: true},
+	{name: "rtl-delete-l", fixture: "mixed.txt", keys: "jwdl", screenCursor: true},
+	{name: "rtl-visual", fixture: "mixed.txt", keys: "jwvl", screenCursor: true, styles: true},
+
+	// Find
+	{name: "find-typing", fixture: "text.txt", keys: "/qu", styles: true},
+	{name: "find-enter", fixture: "text.txt", keys: "/quick" + enter},
+	{name: "find-next", fixture: "text.txt", keys: "/quick" + down + enter},
+	{name: "find-previous", fixture: "text.txt", keys: "/o" + down + down + up + enter},
+	{name: "find-cancel", fixture: "text.txt", keys: "j/zebra" + esc},
+	{name: "find-missing", fixture: "text.txt", keys: "/nowhere" + enter},
+	{name: "find-invalid", fixture: "text.txt", keys: "/(" + enter},
+	{name: "find-regexp", fixture: "text.txt", keys: "/j[a-z]+e" + enter},
+	{name: "find-tab", fixture: "text.txt", keys: "/black" + enter},
+	{name: "find-backward", fixture: "text.txt", keys: "G?quick" + enter},
+	{name: "search-next", fixture: "text.txt", keys: "/quick" + enter + "n"},
+	{name: "search-previous", fixture: "text.txt", keys: "/o" + enter + "nnN"},
+	{name: "search-count", fixture: "text.txt", keys: "/o" + enter + "3n"},
+	{name: "search-wrap", fixture: "text.txt", keys: "/quick" + enter + "nn"},
+	{name: "search-wrap-backward", fixture: "text.txt", keys: "?quick" + enter},
+	{name: "search-backward-next", fixture: "text.txt", keys: "G?o" + enter + "n"},
+	{name: "search-no-pattern", fixture: "text.txt", keys: "n"},
+	{name: "delete-to-search", fixture: "text.txt", keys: "/quick" + enter + "0dn"},
+	{name: "star", fixture: "text.txt", keys: "w*"},
+	{name: "star-next-word", fixture: "text.txt", keys: "4j$2F *"},
+	{name: "star-whole-word", fixture: "text.txt", keys: "jw*"},
+	{name: "hash", fixture: "text.txt", keys: "3jww#"},
+	{name: "star-no-word", fixture: "text.txt", keys: "2j*"},
+	{name: "hlsearch", fixture: "text.txt", keys: "/qu" + enter, styles: true},
+	{name: "hlsearch-off-match", fixture: "text.txt", keys: "/qu" + enter + "l", styles: true},
+	{name: "hlsearch-tab", fixture: "text.txt", keys: "/black|vow" + enter, styles: true},
+	{name: "hlsearch-selection", fixture: "text.txt", keys: "/o" + enter + "v$", styles: true},
+	{name: "nohlsearch", fixture: "text.txt", keys: "/qu" + enter + ":noh" + enter, styles: true},
+	{name: "nohlsearch-next", fixture: "text.txt", keys: "/qu" + enter + ":noh" + enter + "n", styles: true},
+
+	// Save
+	{name: "save", fixture: "text.txt", keys: "ddp:w" + enter},
+	{name: "save-as", fixture: "text.txt", keys: "dd:w copy.txt" + enter},
+	{name: "save-range", fixture: "text.txt", keys: "Vj:w part.txt" + enter},
+
+	// highlighting
+	{name: "highlight-go", fixture: "hello.go", styles: true},
+	{name: "highlight-lua", fixture: "hello.lua", styles: true},
+	{name: "highlight-python", fixture: "hello.py", styles: true},
+	{name: "highlight-visual", fixture: "hello.go", keys: "6jwve", styles: true},
+}
+
+func TestScreens(t *testing.T) {
+	for _, test := range screenTests {
+		t.Run(test.name, func(t *testing.T) {
+			runScreenTest(t, test)
+		})
+	}
+}
+
+// TestScreensCoverSyntaxes checks that there is a highlighting test for
+// every syntax.
+func TestScreensCoverSyntaxes(t *testing.T) {
+	for _, syntax := range syntax.HLDB {
+		found := false
+		for _, test := range screenTests {
+			if test.name == "highlight-"+syntax.Filetype {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no screen test highlights %s", syntax.Filetype)
+		}
+	}
+}
+
+func runScreenTest(t *testing.T, test screenTest) {
+	text, err := os.ReadFile(filepath.Join("testdata", "fixtures", test.fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join(wd, "testdata", "golden", test.name+".golden")
+
+	// the options :set changes are put back as they were.
+	options := map[*bool]bool{}
+	for _, opt := range boolOptions {
+		options[opt] = *opt
+	}
+	t.Cleanup(func() {
+		for opt, v := range options {
+			*opt = v
+		}
+	})
+
+	e, f := newTestEditor(t, 14, 50, test.fixture, string(text))
+	fixtures := map[string]string{test.fixture: string(text)}
+	for _, name := range test.others {
+		other, err := os.ReadFile(filepath.Join(wd, "testdata", "fixtures", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, other, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fixtures[name] = string(other)
+	}
+	typeKeys(t, e, f, test.keys)
+	got := screenReport(e, f, test, fixtures)
+
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from the golden file:\n--- got ---\n%s--- want ---\n%s", test.name, got, want)
+	}
+}
+
+// screenReport writes out the buffer, the cursor and the screen of the
+// editor, and the files written to, fixtures being left out unless they
+// were changed.
+func screenReport(e *Editor, f *term.Fake, test screenTest, fixtures map[string]string) string {
+	var b strings.Builder
+	b.WriteString("-- buffer --\n")
+	for y := 0; y < e.Rows.Len(); y++ {
+		b.WriteString(string(e.row(y).chars))
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "-- cursor --\n%d:%d\n", e.cy+1, e.cx+1)
+	if test.screenCursor {
+		row, col := f.Cursor()
+		fmt.Fprintf(&b, "-- screen cursor --\n%d:%d\n", row+1, col+1)
+	}
+	b.WriteString("-- screen --\n")
+	b.WriteString(f.String())
+	if test.styles {
+		b.WriteString("-- styles --\n")
+		b.WriteString(screenStyles(f))
+	}
+
+	// the files written, in the order their names sort in.
+	entries, _ := os.ReadDir(".")
+	for _, entry := range entries {
+		data, err := os.ReadFile(entry.Name())
+		if text, ok := fixtures[entry.Name()]; err != nil || ok && string(data) == text {
+			continue
+		}
+		fmt.Fprintf(&b, "-- file %s --\n%s", entry.Name(), data)
+	}
+	return b.String()
+}
+
+// screenStyles draws the styles of the screen, a letter standing for each
+// style but the default one, which is a dot. The letters are listed first.
+func screenStyles(f *term.Fake) string {
+	rows, cols, _ := f.Size()
+	letters := map[string]byte{}
+	var legend, lines strings.Builder
+	for y := 0; y < rows; y++ {
+		var line []byte
+		for x := 0; x < cols; x++ {
+			c := f.Cell(y, x)
+			if c.Text == "" {
+				// the right half of a wide character.
+				continue
+			}
+			if c.Style == "" {
+				line = append(line, '.')
+				continue
+			}
+			letter, ok := letters[c.Style]
+			if !ok {
+				letter = 'a' + byte(len(letters))
+				letters[c.Style] = letter
+				fmt.Fprintf(&legend, "%c: %s\n", letter, c.Style)
+			}
+			line = append(line, letter)
+		}
+		lines.WriteString(strings.TrimRight(string(line), "."))
+		lines.WriteString("\n")
+	}
+	return legend.String() + lines.String()
+}
@@ -0,0 +1,112 @@
+package editor
+
+import (
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/rivo/uniseg"
+)
+
+// The cursor moves over grapheme clusters, the characters as the user sees
+// them, which can be made of several runes: a letter and its combining
+// marks, emoji joined with ZWJ or Persian letters kept apart with ZWNJ.
+//
+// Two runes below U+0300 are always clusters of their own, which saves
+// segmenting most code.
+const clusterFree = 0x300
+
+// clusterEnd returns where the grapheme cluster starting at i ends.
+func clusterEnd(chars []rune, i int) int {
+	if i+1 >= len(chars) {
+		return len(chars)
+	}
+	if chars[i] < clusterFree && chars[i+1] < clusterFree {
+		return i + 1
+	}
+	// segment a part of the text after i, a bigger part when the cluster
+	// may go on past it.
+	for n := 32; ; n *= 2 {
+		end := min(i+n, len(chars))
+		g := uniseg.NewGraphemes(string(chars[i:end]))
+		g.Next()
+		if size := len(g.Runes()); i+size < end || end == len(chars) {
+			return i + size
+		}
+	}
+}
+
+// clusterStart returns where the grapheme cluster the rune at i is part of
+// starts.
+func clusterStart(chars []rune, i int) int {
+	if i >= len(chars) {
+		return len(chars)
+	}
+	// go back to a rune a cluster surely starts at and segment from there.
+	s := i
+	for s > 0 && !(chars[s] < clusterFree && chars[s-1] < clusterFree) {
+		s--
+	}
+	for {
+		end := clusterEnd(chars, s)
+		if end > i {
+			return s
+		}
+		s = end
+	}
+}
+
+// nextCluster returns where the cluster count clusters after the one at i
+// starts, stopping at the end of chars.
+func nextCluster(chars []rune, i, count int) int {
+	for ; count > 0 && i < len(chars); count-- {
+		i = clusterEnd(chars, i)
+	}
+	return min(i, len(chars))
+}
+
+// prevCluster returns where the cluster count clusters before the one at i
+// starts, stopping at the start of chars.
+func prevCluster(chars []rune, i, count int) int {
+	for ; count > 0 && i > 0; count-- {
+		i = clusterStart(chars, i-1)
+	}
+	return max(i, 0)
+}
+
+// clusterWidth returns the number of columns the cluster chars[start:end]
+// takes on the screen.
+func clusterWidth(chars []rune, start, end int) int {
+	if end-start == 1 {
+		return runewidth.RuneWidth(chars[start])
+	}
+	return runewidth.StringWidth(string(chars[start:end]))
+}
+
+// clusterEndString works like clusterEnd on the bytes of s, for the render
+// strings of rows too long to turn into runes.
+func clusterEndString(s string, i int) int {
+	r, size := utf8.DecodeRuneInString(s[i:])
+	if i+size >= len(s) {
+		return len(s)
+	}
+	if next, _ := utf8.DecodeRuneInString(s[i+size:]); r < clusterFree && next < clusterFree {
+		return i + size
+	}
+	for n := 128; ; n *= 2 {
+		end := min(i+n, len(s))
+		g := uniseg.NewGraphemes(s[i:end])
+		g.Next()
+		if _, to := g.Positions(); i+to < end || end == len(s) {
+			return i + to
+		}
+	}
+}
+
+// stringWidth returns the number of columns the cluster s takes on the
+// screen.
+func stringWidth(s string) int {
+	if r, size := utf8.DecodeRuneInString(s); size == len(s) {
+		return runewidth.RuneWidth(r)
+	}
+	return runewidth.StringWidth(s)
+}
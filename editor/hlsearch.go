@@ -0,0 +1,130 @@
+package editor
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// HlSearch highlights every match of the last search pattern on the screen.
+var HlSearch = true
+
+// maxSearchCount is as far as the matches are counted for the status bar.
+const maxSearchCount = 999
+
+// searchSpan is a match the hlsearch overlay draws on a row, from the
+// column from up to to. The current match is the one the cursor is taken
+// to while typing a search or asked about by :s///c.
+type searchSpan struct {
+	from, to int
+	current  bool
+}
+
+// searchMatches are the matches of a pattern in a buffer, as counted for
+// the status bar, along with what they were counted for.
+type searchMatches struct {
+	buffer     *Buffer
+	changes    int
+	rows       int
+	pattern    string
+	ignoreCase bool
+	// starts holds where the matches start, up to maxSearchCount of them.
+	starts []position
+}
+
+// highlightPattern returns the pattern the overlay highlights the matches
+// of: the one being typed, else the last one unless :noh turned it off. It
+// returns nil when there is nothing to highlight.
+func (e *Editor) highlightPattern() *regexp.Regexp {
+	if !HlSearch {
+		return nil
+	}
+	if e.incSearch != nil {
+		return e.incSearch
+	}
+	if e.noHighlight || e.lastPattern == "" {
+		return nil
+	}
+	ignoreCase := e.ignoreCase("")
+	if e.highlightRe == nil || e.highlightRe.String() != caseFlags(ignoreCase)+e.lastPattern {
+		re, err := regexp.Compile(caseFlags(ignoreCase) + e.lastPattern)
+		if err != nil {
+			return nil
+		}
+		e.highlightRe = re
+	}
+	return e.highlightRe
+}
+
+// searchSpans returns the matches the overlay draws on the row at y, in
+// the order they come in.
+func (e *Editor) searchSpans(y int) []searchSpan {
+	var spans []searchSpan
+	row := e.row(y)
+	if re := e.highlightPattern(); re != nil {
+		for _, m := range e.rowMatches(re, y) {
+			if m.end > m.x {
+				spans = append(spans, searchSpan{from: e.rowCxToRx(row, m.x), to: e.rowCxToRx(row, m.end)})
+			}
+		}
+	}
+	if m := e.currentMatch; m != nil && m.y == y {
+		spans = append(spans, searchSpan{from: e.rowCxToRx(row, m.x), to: e.rowCxToRx(row, m.end), current: true})
+	}
+	return spans
+}
+
+// spanAt returns whether the column col is in a match of spans, and whether
+// that is the current one.
+func spanAt(spans []searchSpan, col int) (matched, current bool) {
+	for _, s := range spans {
+		if col >= s.from && col < s.to {
+			matched = true
+			current = current || s.current
+		}
+	}
+	return matched, current
+}
+
+// searchCount returns the counter the status bar shows while the matches
+// are highlighted, like [3/17] when the cursor is on the third of 17
+// matches. It is empty when the cursor isn't at the start of a match.
+func (e *Editor) searchCount() string {
+	re := e.highlightPattern()
+	if re == nil || e.incSearch != nil || e.Rows.Len() == 0 {
+		return ""
+	}
+	onMatch := false
+	for _, m := range e.rowMatches(re, e.clampY(e.cy)) {
+		onMatch = onMatch || m.position == position{x: e.cx, y: e.cy}
+	}
+	if !onMatch {
+		return ""
+	}
+	c := &e.searchMatches
+	if c.buffer != e.Buffer || c.changes != e.changes || c.rows != e.Rows.Len() || c.pattern != e.lastPattern || c.ignoreCase != e.ignoreCase("") {
+		*c = searchMatches{buffer: e.Buffer, changes: e.changes, rows: e.Rows.Len(), pattern: e.lastPattern, ignoreCase: e.ignoreCase("")}
+		for y := 0; y < e.Rows.Len() && len(c.starts) <= maxSearchCount; y++ {
+			for _, m := range e.rowMatches(re, y) {
+				c.starts = append(c.starts, m.position)
+			}
+		}
+	}
+	n, _ := slices.BinarySearchFunc(c.starts, position{x: e.cx, y: e.cy}, func(p, cursor position) int {
+		switch {
+		case p.less(cursor):
+			return -1
+		case cursor.less(p):
+			return 1
+		}
+		return 0
+	})
+	switch {
+	case n >= len(c.starts):
+		// past the matches counted.
+		return fmt.Sprintf("[?/>%d]", maxSearchCount)
+	case len(c.starts) > maxSearchCount:
+		return fmt.Sprintf("[%d/>%d]", n+1, maxSearchCount)
+	}
+	return fmt.Sprintf("[%d/%d]", n+1, len(c.starts))
+}
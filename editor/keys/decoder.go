@@ -0,0 +1,150 @@
+package keys
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// escapeSequences maps the escape sequences terminals send for special keys,
+// without the leading Esc, to the keys.
+var escapeSequences = map[string]Key{
+	"[A":  KeyArrowUp,
+	"[B":  KeyArrowDown,
+	"[C":  KeyArrowRight,
+	"[D":  KeyArrowLeft,
+	"OA":  KeyArrowUp,
+	"OB":  KeyArrowDown,
+	"OC":  KeyArrowRight,
+	"OD":  KeyArrowLeft,
+	"[1~": KeyHome,
+	"[7~": KeyHome,
+	"[H":  KeyHome,
+	"OH":  KeyHome,
+	"[4~": KeyEnd,
+	"[8~": KeyEnd,
+	"[F":  KeyEnd,
+	"OF":  KeyEnd,
+	"[3~": KeyDelete,
+	"[5~": KeyPageUp,
+	"[6~": KeyPageDown,
+}
+
+// pasteStart and pasteEnd are the escape sequences terminals in bracketed
+// paste mode send around pasted text.
+var (
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
+
+// Decoder turns the bytes read from a terminal into keys. Reads can end in
+// the middle of a character or of an escape sequence, so the decoder keeps
+// what it can't decode yet until more bytes come in.
+type Decoder struct {
+	buf []byte
+	// pasted is the text of the last KeyPaste.
+	pasted string
+}
+
+// Feed adds bytes read from the terminal.
+func (d *Decoder) Feed(b []byte) {
+	d.buf = append(d.buf, b...)
+}
+
+// Pending reports whether there are bytes left that don't make a whole key
+// yet.
+func (d *Decoder) Pending() bool {
+	return len(d.buf) > 0
+}
+
+// Pasted returns the text pasted with the last KeyPaste.
+func (d *Decoder) Pasted() string {
+	return d.pasted
+}
+
+// Next returns the next key fed in, reporting false when the bytes left
+// aren't a whole key. Escape sequences the decoder doesn't know are
+// skipped. Text pasted in bracketed paste mode comes out whole as a
+// KeyPaste once its end is fed in, its text is left to Pasted.
+func (d *Decoder) Next() (Key, bool) {
+	for len(d.buf) > 0 {
+		if bytes.HasPrefix(d.buf, pasteStart) {
+			end := bytes.Index(d.buf[len(pasteStart):], pasteEnd)
+			if end < 0 {
+				return 0, false
+			}
+			text := d.buf[len(pasteStart) : len(pasteStart)+end]
+			d.pasted = string(text)
+			d.buf = d.buf[len(pasteStart)+end+len(pasteEnd):]
+			return KeyPaste, true
+		}
+
+		if d.buf[0] != byte(EscKey) {
+			if !utf8.FullRune(d.buf) {
+				return 0, false
+			}
+			// invalid bytes come out as utf8.RuneError, one at a time.
+			r, size := utf8.DecodeRune(d.buf)
+			d.buf = d.buf[size:]
+			return Key(r), true
+		}
+
+		n, complete := escapeSequenceLen(d.buf)
+		if !complete {
+			return 0, false
+		}
+		if n == 1 {
+			// Esc followed by a key that doesn't start a sequence.
+			d.buf = d.buf[1:]
+			return EscKey, true
+		}
+		seq := string(d.buf[1:n])
+		d.buf = d.buf[n:]
+		if k, ok := escapeSequences[seq]; ok {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// Flush is called once no bytes came in for a while. A lone Esc or the
+// start of an escape sequence that never got finished is taken for the Esc
+// key, the bytes after it are left to Next. A character that is cut short
+// stays pending, the rest of it may still be on its way, and so does a paste
+// that didn't end yet.
+func (d *Decoder) Flush() (Key, bool) {
+	if len(d.buf) == 0 || d.buf[0] != byte(EscKey) || bytes.HasPrefix(d.buf, pasteStart) {
+		return 0, false
+	}
+	d.buf = d.buf[1:]
+	return EscKey, true
+}
+
+// escapeSequenceLen returns the length of the escape sequence at the start
+// of b, which starts with Esc, reporting false when b ends before it does.
+// A length of one means the Esc doesn't start a sequence.
+func escapeSequenceLen(b []byte) (int, bool) {
+	if len(b) < 2 {
+		return 1, false
+	}
+	switch b[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes up to a final byte.
+		for i := 2; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1, true
+			}
+			if b[i] < 0x20 || b[i] > 0x3f {
+				// not a sequence after all.
+				return 1, true
+			}
+		}
+		return len(b), false
+	case 'O':
+		// SS3: a single final byte.
+		if len(b) < 3 {
+			return len(b), false
+		}
+		return 3, true
+	}
+	return 1, true
+}
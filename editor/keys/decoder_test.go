@@ -0,0 +1,113 @@
+package keys
+
+import (
+	"slices"
+	"testing"
+	"unicode/utf8"
+)
+
+// flush stands for a pause in the input, when Flush is called.
+const flush = "\x00flush"
+
+// decode feeds reads into a decoder one at a time and returns the keys it
+// gives after each one, and whether bytes are left pending at the end.
+func decode(d *Decoder, reads ...string) ([]Key, bool) {
+	var keys []Key
+	for _, read := range reads {
+		if read == flush {
+			if k, ok := d.Flush(); ok {
+				keys = append(keys, k)
+			}
+		} else {
+			d.Feed([]byte(read))
+		}
+		for {
+			k, ok := d.Next()
+			if !ok {
+				break
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys, d.Pending()
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		reads   []string
+		want    []Key
+		pending bool
+	}{
+		{"ascii", []string{"ab"}, []Key{'a', 'b'}, false},
+		{"utf-8", []string{"سلام"}, []Key{'س', 'ل', 'ا', 'م'}, false},
+		{"utf-8 split across reads", []string{"a\xd8", "\xb3b"}, []Key{'a', 'س', 'b'}, false},
+		{"4 byte rune split in three", []string{"\xf0\x9f", "\x98", "\x80"}, []Key{'😀'}, false},
+		{"cut short rune waits", []string{"\xd8"}, nil, true},
+		{"cut short rune outlives a flush", []string{"\xd8", flush, "\xb3"}, []Key{'س'}, false},
+		{"invalid byte", []string{"\xffa"}, []Key{utf8.RuneError, 'a'}, false},
+		{"arrow", []string{"\x1b[A"}, []Key{KeyArrowUp}, false},
+		{"ss3 arrow", []string{"\x1bOD"}, []Key{KeyArrowLeft}, false},
+		{"csi with parameter", []string{"\x1b[3~x"}, []Key{KeyDelete, 'x'}, false},
+		{"csi split across reads", []string{"\x1b", "[", "5", "~"}, []Key{KeyPageUp}, false},
+		{"unknown sequence is skipped", []string{"\x1b[99Zq"}, []Key{'q'}, false},
+		{"lone esc waits", []string{"\x1b"}, nil, true},
+		{"lone esc on flush", []string{"\x1b", flush}, []Key{EscKey}, false},
+		{"esc then a key", []string{"\x1bj"}, []Key{EscKey, 'j'}, false},
+		{"esc esc", []string{"\x1b\x1b", flush}, []Key{EscKey, EscKey}, false},
+		{"unfinished csi on flush", []string{"\x1b[", flush}, []Key{EscKey, '['}, false},
+		{"esc then a control key", []string{"\x1b[\r"}, []Key{EscKey, '[', '\r'}, false},
+		{"flush with nothing pending", []string{flush}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var d Decoder
+			got, pending := decode(&d, test.reads...)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("keys = %q, want %q", got, test.want)
+			}
+			if pending != test.pending {
+				t.Errorf("pending = %v, want %v", pending, test.pending)
+			}
+		})
+	}
+}
+
+func TestDecoderPaste(t *testing.T) {
+	tests := []struct {
+		name   string
+		reads  []string
+		want   []Key
+		pasted string
+	}{
+		{"whole", []string{"a\x1b[200~hi\x1b[201~b"}, []Key{'a', KeyPaste, 'b'}, "hi"},
+		{"keys in a paste are text", []string{"\x1b[200~\x1bdd\r\x1b[A\x1b[201~"}, []Key{KeyPaste}, "\x1bdd\r\x1b[A"},
+		{"spanning reads", []string{"\x1b[200~one ", "two", "\x1b[201~"}, []Key{KeyPaste}, "one two"},
+		{"start marker split", []string{"\x1b[2", "00~x\x1b[201~"}, []Key{KeyPaste}, "x"},
+		{"end marker split", []string{"\x1b[200~x\x1b[20", "1~y"}, []Key{KeyPaste, 'y'}, "x"},
+		{"rune split in a paste", []string{"\x1b[200~\xd8", "\xb3\x1b[201~"}, []Key{KeyPaste}, "س"},
+		{"flush in a paste", []string{"\x1b[200~slow", flush, " typist\x1b[201~"}, []Key{KeyPaste}, "slow typist"},
+		{"empty", []string{"\x1b[200~\x1b[201~"}, []Key{KeyPaste}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var d Decoder
+			got, pending := decode(&d, test.reads...)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("keys = %q, want %q", got, test.want)
+			}
+			if pending {
+				t.Errorf("bytes left pending")
+			}
+			if d.Pasted() != test.pasted {
+				t.Errorf("pasted = %q, want %q", d.Pasted(), test.pasted)
+			}
+		})
+	}
+
+	// the paste waits for its end.
+	var d Decoder
+	if got, pending := decode(&d, "\x1b[200~unfinished", flush); len(got) != 0 || !pending {
+		t.Errorf("unfinished paste gave %q, pending %v; want nothing, pending", got, pending)
+	}
+}
@@ -10,7 +10,6 @@ const (
 	NavKeyL          Key = 108
 	NavKeyLeftCurly  Key = 123
 	NavKeyRightCurly Key = 125
-	NavKeyGg         Key = 103
 	NavKeyCapitalG   Key = 71
 
 	EscKey Key = 27
@@ -23,7 +22,11 @@ const (
 	ModeKeyCol      Key = 58
 	ModeKeySearch   Key = 47
 	ModeKeyU        Key = 117
+	ModeKeyCtrlR    Key = 18
 	ModeKeyX        Key = 120
+	ModeKeySmallV   Key = 118
+	ModeKeyCapitalV Key = 86
+	ModeKeyCtrlV    Key = 22
 )
 
 // motion
@@ -39,7 +42,10 @@ const (
 	KeyEnter     Key = 10
 	KeyBackspace Key = 127
 
-	KeyArrowLeft Key = iota + 1000
+	// the keys that don't type a character are given code points of a
+	// private use plane, so that they don't clash with the characters
+	// typed.
+	KeyArrowLeft Key = iota + 0xf0000
 	KeyArrowRight
 	KeyArrowUp
 	KeyArrowDown
@@ -48,6 +54,8 @@ const (
 	KeyPageDown
 	KeyHome
 	KeyEnd
+	// KeyPaste stands for text pasted in bracketed paste mode.
+	KeyPaste
 )
 
 // ctrl returns a byte resulting from pressing the given ASCII character with the ctrl-key.
@@ -55,18 +63,6 @@ func Ctrl(char byte) byte {
 	return char & 0x1f
 }
 
-func KeySequenceEqual(a, b []Key) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i, v := range a {
-		if v != b[i] {
-			return false
-		}
-	}
-	return true
-}
-
 func IsArrowKey(k Key) bool {
 	return k == KeyArrowUp || k == KeyArrowRight ||
 		k == KeyArrowDown || k == KeyArrowLeft
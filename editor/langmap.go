@@ -0,0 +1,163 @@
+package editor
+
+import (
+	"fmt"
+	"sort"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+// Langmap translates the keys typed in another keyboard layout to the keys
+// of the US layout, so that commands work without switching layouts. It
+// applies to normal, visual and operator-pending mode, not to inserted
+// text, the command line or the character after f and t.
+var Langmap map[rune]rune
+
+// langmaps are the built-in tables, by layout, each a string of keys typed
+// in the layout and one of the keys they map to. Keys that type ASCII in the
+// layout are left out, they would clash with the same keys of the US
+// layout.
+var langmaps = map[string][2]string{
+	// ISIRI 9147, the Persian standard layout.
+	"persian": {
+		"ضصثقفغعهخحجچشسیبلاتنمکگظطزرذدپو" +
+			"\u0652\u064c\u064d\u064b\u064f\u0650\u064e\u0651ؤئيإأآة»«كٓژ\u0670\u200c\u0654ء؟" +
+			"۱۲۳۴۵۶۷۸۹۰٬٫﷼٪×،",
+		"qwertyuiop[]asdfghjkl;'zxcvbnm," +
+			"QWERTYUIASDFGHJKLZXCVBNM?" +
+			"1234567890@#$%^&",
+	},
+	// Arabic 101.
+	"arabic": {
+		"ضصثقفغعهخحجدشسيبلاتنمكطئءؤرىةوزظذ" +
+			"أإآ" +
+			"١٢٣٤٥٦٧٨٩٠",
+		"qwertyuiop[]asdfghjkl;'zxcvnm,./`" +
+			"HYN" +
+			"1234567890",
+	},
+	// ЙЦУКЕН.
+	"russian": {
+		"йцукенгшщзхъфывапролджэячсмитьбюё" +
+			"ЙЦУКЕНГШЩЗХЪФЫВАПРОЛДЖЭЯЧСМИТЬБЮЁ",
+		"qwertyuiop[]asdfghjkl;'zxcvbnm,.`" +
+			"QWERTYUIOP{}ASDFGHJKL:\"ZXCVBNM<>~",
+	},
+	// SI-1452.
+	"hebrew": {
+		"קראטוןםפשדגכעיחלךףזסבהנמצתץ",
+		"ertyuiopasdfghjkl;zxcvbnm,.",
+	},
+}
+
+// ParseLangmap reads a langmap: a comma separated list of built-in layouts,
+// like persian, and of mappings written the way Vim's 'langmap' option
+// takes them, "ABC;abc" or pairs like "AaBb". A backslash makes the comma,
+// semicolon or backslash after it stand for itself.
+func ParseLangmap(s string) (map[rune]rune, error) {
+	m := map[rune]rune{}
+	parts, err := splitLangmap(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		if len(part.sides) == 1 && len(part.sides[0]) == 0 {
+			continue
+		}
+		if table, ok := langmaps[part.text]; ok {
+			to := []rune(table[1])
+			for i, r := range []rune(table[0]) {
+				m[r] = to[i]
+			}
+			continue
+		}
+		switch {
+		case len(part.sides) > 2:
+			return nil, fmt.Errorf("Invalid langmap %q: more than one ;", part.text)
+		case len(part.sides) == 1:
+			pairs := part.sides[0]
+			if len(pairs)%2 != 0 {
+				return nil, fmt.Errorf("Invalid langmap %q: odd number of characters", part.text)
+			}
+			for i := 0; i < len(pairs); i += 2 {
+				m[pairs[i]] = pairs[i+1]
+			}
+		default:
+			from, to := part.sides[0], part.sides[1]
+			if len(from) != len(to) {
+				return nil, fmt.Errorf("Invalid langmap %q: %d characters map to %d", part.text, len(from), len(to))
+			}
+			for i, r := range from {
+				m[r] = to[i]
+			}
+		}
+	}
+	return m, nil
+}
+
+// langmapPart is a comma separated part of a langmap, as written and split
+// at its unescaped semicolons.
+type langmapPart struct {
+	text  string
+	sides [][]rune
+}
+
+// splitLangmap splits s at the commas that aren't escaped, and each part
+// at its semicolons, dropping the backslashes that escape them.
+func splitLangmap(s string) ([]langmapPart, error) {
+	var parts []langmapPart
+	part := langmapPart{sides: [][]rune{nil}}
+	start := 0
+	escaped := false
+	for i, r := range s {
+		side := &part.sides[len(part.sides)-1]
+		switch {
+		case escaped:
+			*side = append(*side, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			part.text = s[start:i]
+			parts = append(parts, part)
+			part = langmapPart{sides: [][]rune{nil}}
+			start = i + 1
+		case r == ';':
+			part.sides = append(part.sides, nil)
+		default:
+			*side = append(*side, r)
+		}
+	}
+	part.text = s[start:]
+	if escaped {
+		return nil, fmt.Errorf("Invalid langmap %q: trailing backslash", part.text)
+	}
+	return append(parts, part), nil
+}
+
+// LangmapNames returns the names of the built-in layouts.
+func LangmapNames() []string {
+	var names []string
+	for name := range langmaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mapKey translates k through the langmap, unless it is the argument of a
+// motion like f, which searches for the very character typed. Mark names
+// are translated, after ' and ` as after m.
+func (e *Editor) mapKey(k keys.Key, visual bool) keys.Key {
+	to, ok := Langmap[rune(k)]
+	if !ok {
+		return k
+	}
+	if len(e.motionRegister) > 0 {
+		cmd, err := parseCommand(e.motionRegister, visual)
+		if m := motions[cmd.motion]; err == errIncompleteCommand && cmd.motion != "" && m.takesArg && !m.markArg {
+			return k
+		}
+	}
+	return keys.Key(to)
+}
@@ -0,0 +1,382 @@
+package editor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+// loaderChunk is how much of the file the loader reads at once, every chunk
+// delivering one batch of rows.
+const loaderChunk = 1 << 20
+
+// loadBlock is how many lines are read at once out of a run of unloaded
+// lines, the lines next to the one needed being likely to be needed next.
+const loadBlock = 64
+
+// loader indexes the lines of a file in the background, so the file can be
+// shown before it is read through. The lines it finds are unloaded: every
+// chunk of the file becomes one row standing for all of its lines, which
+// only knows where they start. A line gets a row of its own once it is
+// read.
+type loader struct {
+	f *os.File
+	// batches delivers the unloaded rows of the chunks read so far. It is
+	// closed once the whole file is read, after sum and err are set.
+	batches chan *Row
+	stop    chan struct{}
+	// closeOnce makes close safe to call again.
+	closeOnce sync.Once
+	// done is set once batches is drained.
+	done bool
+	// sum is the sha256 sum of the file.
+	sum [sha256.Size]byte
+	err error
+}
+
+func newLoader(f *os.File) *loader {
+	l := &loader{
+		f:       f,
+		batches: make(chan *Row, 64),
+		stop:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *loader) run() {
+	defer close(l.batches)
+
+	h := sha256.New()
+	buf := make([]byte, loaderChunk)
+	var pos, start int64 // offsets of buf and of the line being indexed
+	for {
+		n, err := io.ReadFull(l.f, buf)
+		h.Write(buf[:n])
+
+		starts := []int64{start}
+		chunk := buf[:n]
+		for i := 0; ; {
+			j := bytes.IndexByte(chunk[i:], '\n')
+			if j < 0 {
+				break
+			}
+			start = pos + int64(i+j) + 1
+			starts = append(starts, start)
+			i += j + 1
+		}
+		pos += int64(n)
+
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if eof && pos > start {
+			// the last line has no newline.
+			starts = append(starts, pos+1)
+		}
+		if len(starts) > 1 && !l.send(&Row{src: l, starts: slices.Clip(starts)}) {
+			return
+		}
+		if eof {
+			break
+		}
+		if err != nil {
+			l.err = err
+			return
+		}
+	}
+	copy(l.sum[:], h.Sum(nil))
+}
+
+func (l *loader) send(batch *Row) bool {
+	select {
+	case l.batches <- batch:
+		return true
+	case <-l.stop:
+		return false
+	}
+}
+
+// close stops indexing and releases the file. Rows that weren't loaded yet
+// can't be read anymore. Only the first call does anything.
+func (l *loader) close() {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		for range l.batches {
+		}
+		l.f.Close()
+	})
+}
+
+// read returns the text of the lines from up to but not including to of an
+// unloaded row, without the carriage returns ending them.
+func (l *loader) read(row *Row, from, to int) ([][]byte, error) {
+	off := row.starts[from]
+	b := make([]byte, row.starts[to]-1-off)
+	_, err := l.f.ReadAt(b, off)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	lines := make([][]byte, to-from)
+	for i := range lines {
+		line := b[row.starts[from+i]-off : row.starts[from+i+1]-1-off]
+		lines[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+	return lines, err
+}
+
+// pollLoader appends the rows the loader found since the last call to the
+// buffer, waiting for them when wait is set. It reports whether any rows
+// were added.
+func (e *Editor) pollLoader(wait bool) bool {
+	l := e.loader
+	if l == nil || l.done {
+		return false
+	}
+	var batch *Row
+	added := false
+	for {
+		var ok bool
+		if wait {
+			batch, ok = <-l.batches
+		} else {
+			select {
+			case batch, ok = <-l.batches:
+			default:
+				return added
+			}
+		}
+		if !ok {
+			l.done = true
+			e.finishLoading()
+			return true
+		}
+		e.Rows = e.Rows.Insert(e.Rows.Len(), batch)
+		added = true
+		if wait && e.Rows.Len() >= e.screenRows {
+			// enough to show the first screen.
+			wait = false
+		}
+	}
+}
+
+// finishLoading is called once the whole file has been indexed.
+func (e *Editor) finishLoading() {
+	l := e.loader
+	if l.err != nil {
+		e.SetStatusMessage("Can't read %s: %s", e.filename, l.err)
+		return
+	}
+	// the undo history only fits the file as long as nothing was edited
+	// while it was loading.
+	if t := e.undoTree; t.cur == t.root && len(t.nodes) == 1 && t.pending == nil {
+		if err := e.readUndoFile(l.sum); err != nil && !errors.Is(err, os.ErrNotExist) {
+			e.logger.Printf("reading undo history of %s: %v", e.filename, err)
+		}
+	}
+}
+
+// waitLoading reads the rest of the file being loaded, if any.
+func (e *Editor) waitLoading() error {
+	if e.loader == nil {
+		return nil
+	}
+	for !e.loader.done {
+		e.pollLoader(true)
+	}
+	return e.loader.err
+}
+
+// row returns the row at index at, reading its text first if it isn't
+// loaded yet.
+func (e *Editor) row(at int) *Row {
+	row, start := e.Rows.Find(at)
+	if row.src != nil {
+		row = e.loadRow(at, row, start)
+	}
+	return row
+}
+
+// loadRow reads the block of lines around the line at index at out of the
+// unloaded row run, which starts at index start. The lines get rows of
+// their own, between what is left of run.
+func (e *Editor) loadRow(at int, run *Row, start int) *Row {
+	i := at - start
+	from := i - i%loadBlock
+	to := min(from+loadBlock, run.Weight())
+	lines, err := run.src.read(run, from, to)
+	if err != nil {
+		e.logger.Printf("reading lines %d to %d: %v", start+from+1, start+to, err)
+	}
+	rows := make([]*Row, 0, to-from+2)
+	if from > 0 {
+		rows = append(rows, &Row{src: run.src, starts: run.starts[:from+1]})
+	}
+	for _, text := range lines {
+		row := &Row{chars: make([]rune, 0, utf8.RuneCount(text))}
+		for len(text) > 0 {
+			r, size := utf8.DecodeRune(text)
+			row.chars = append(row.chars, r)
+			text = text[size:]
+		}
+		rows = append(rows, row)
+	}
+	if to < run.Weight() {
+		rows = append(rows, &Row{src: run.src, starts: run.starts[to:]})
+	}
+	e.Rows = e.Rows.Delete(start, start+run.Weight()).Insert(start, rows...)
+	for y := start + from; y < start+to; y++ {
+		// without the rows above loaded, there is no telling whether the
+		// row is inside a multiline comment.
+		if y > 0 {
+			if prev := e.Rows.At(y - 1); prev.src == nil {
+				e.Rows.At(y).hasUnclosedComment = prev.hasUnclosedComment
+			}
+		}
+		e.updateRow(y)
+	}
+	return e.Rows.At(at)
+}
+
+// writeRows writes the text of rows from..to to w, reading the rows that
+// aren't loaded straight from the file without loading them.
+func (e *Editor) writeRows(w io.Writer, from, to int) (int, error) {
+	bw := bufio.NewWriter(w)
+	n := 0
+	var err error
+	write := func(text []byte) {
+		bw.Write(text)
+		bw.WriteByte('\n')
+		n += len(text) + 1
+	}
+	e.Rows.Walk(from, func(y int, row *Row) bool {
+		if y > to {
+			return false
+		}
+		if row.src == nil {
+			write([]byte(string(row.chars)))
+			return y < to
+		}
+		for i := max(from-y, 0); i < row.Weight() && y+i <= to; i += loadBlock {
+			var lines [][]byte
+			if lines, err = row.src.read(row, i, min(i+loadBlock, row.Weight(), to-y+1)); err != nil {
+				return false
+			}
+			for _, text := range lines {
+				write(text)
+			}
+		}
+		return y+row.Weight() <= to
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// writeFile writes rows from..to to filename. A to below zero stands for
+// the last row, which is only known once the whole file is read. It returns
+// the number of bytes written and their sha256 sum.
+func (e *Editor) writeFile(filename string, from, to int) (int, [sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	if err := e.waitLoading(); err != nil {
+		return 0, sum, err
+	}
+	if to < 0 {
+		to = e.Rows.Len() - 1
+	}
+	h := sha256.New()
+	var n int
+	var err error
+	if e.readsFrom(filename) {
+		n, err = e.replaceFile(filename, from, to, h)
+	} else {
+		n, err = e.overwriteFile(filename, from, to, h)
+	}
+	if err != nil {
+		return n, sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return n, sum, nil
+}
+
+// readsFrom reports whether rows that aren't loaded yet are still to be read
+// from the file filename.
+func (e *Editor) readsFrom(filename string) bool {
+	if e.loader == nil {
+		return false
+	}
+	unloaded := false
+	e.Rows.Walk(0, func(_ int, row *Row) bool {
+		unloaded = row.src != nil
+		return !unloaded
+	})
+	if !unloaded {
+		return false
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	src, err := e.loader.f.Stat()
+	return err == nil && os.SameFile(fi, src)
+}
+
+// overwriteFile truncates filename and writes rows from..to to it, which
+// leaves the file itself, its links, owner and mode as they were.
+func (e *Editor) overwriteFile(filename string, from, to int, h io.Writer) (int, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := e.writeRows(io.MultiWriter(f, h), from, to)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// replaceFile writes rows from..to to a temporary file that is renamed over
+// filename, as the rows that aren't loaded yet are read from the file being
+// replaced. A symbolic link is followed to the file it points to, and the
+// new file gets the mode and, as far as it is allowed to, the owner of the
+// old one.
+func (e *Editor) replaceFile(filename string, from, to int, h io.Writer) (int, error) {
+	path, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := e.writeRows(io.MultiWriter(f, h), from, to)
+	if err == nil {
+		err = f.Chmod(fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && err == nil {
+		// only root can give a file away, keep at least the group then.
+		if f.Chown(int(st.Uid), int(st.Gid)) != nil {
+			f.Chown(-1, int(st.Gid))
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
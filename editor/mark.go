@@ -0,0 +1,89 @@
+package editor
+
+import (
+	"errors"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+var ErrMarkNotSet = errors.New("Mark not set")
+
+func init() {
+	for c := 'a'; c <= 'z'; c++ {
+		normalCommands["m"+string(c)] = func(e *Editor, _ int) error {
+			e.SetMark(c)
+			return nil
+		}
+	}
+	motions["'"] = motion{linewise: true, takesArg: true, markArg: true, jump: markJump(true)}
+	motions["`"] = motion{takesArg: true, markArg: true, jump: markJump(false)}
+}
+
+// SetMark puts the mark with the given letter on the cursor.
+func (e *Editor) SetMark(name rune) {
+	if e.marks == nil {
+		e.marks = make(map[rune]position)
+	}
+	e.marks[name] = position{x: e.cx, y: e.cy}
+}
+
+// mark returns the position of a mark: a letter set with m, or < and > for
+// the start and the end of the last visual selection. Marks are kept inside
+// the text, which may have shrunk since they were set.
+func (e *Editor) mark(name rune) (position, error) {
+	switch name {
+	case '<', '>':
+		if !e.lastVisual.mode.IsVisual() {
+			return position{}, ErrMarkNotSet
+		}
+		sel := e.lastVisual
+		start, end := sel.anchor, sel.cursor
+		if end.less(start) {
+			start, end = end, start
+		}
+		if name == '>' {
+			return e.clampPosition(end), nil
+		}
+		return e.clampPosition(start), nil
+	}
+	p, ok := e.marks[name]
+	if !ok {
+		return position{}, ErrMarkNotSet
+	}
+	return e.clampPosition(p), nil
+}
+
+// adjustMarks keeps the marks on their lines when a row is inserted at the
+// given index, delta being 1, or deleted from it, delta being -1. The marks
+// of a deleted row go with it.
+func (e *Editor) adjustMarks(at, delta int) {
+	for name, p := range e.marks {
+		switch {
+		case p.y == at && delta < 0:
+			delete(e.marks, name)
+		case p.y > at || p.y == at && delta > 0:
+			p.y += delta
+			e.marks[name] = p
+		}
+	}
+	if at < e.lowestMarked {
+		e.lowestMarked += delta
+	}
+}
+
+// markJump returns the jump of the ' motion, going to the first non-blank
+// character of the line of the mark, or the ` one with linewise unset, going
+// to the mark itself.
+func markJump(linewise bool) func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool) {
+	return func(e *Editor, p position, _ int, _ bool, arg keys.Key) (position, bool) {
+		m, err := e.mark(rune(arg))
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+			return p, false
+		}
+		if linewise {
+			m.x = e.firstNonBlank(m.y)
+		}
+		return m, true
+	}
+}
@@ -9,4 +9,13 @@ var (
 	NormalMode  Mode = Mode{Name: "normal", StatusMessage: "-- NORMAL --"}
 	InsertMode       = Mode{Name: "insert", StatusMessage: "-- INSERT --"}
 	CommandMode      = Mode{Name: "command"}
+
+	VisualMode      = Mode{Name: "visual", StatusMessage: "-- VISUAL --"}
+	VisualLineMode  = Mode{Name: "visual line", StatusMessage: "-- VISUAL LINE --"}
+	VisualBlockMode = Mode{Name: "visual block", StatusMessage: "-- VISUAL BLOCK --"}
 )
+
+// IsVisual reports whether m is one of the visual selection modes.
+func (m Mode) IsVisual() bool {
+	return m == VisualMode || m == VisualLineMode || m == VisualBlockMode
+}
@@ -1 +1,374 @@
 package editor
+
+import (
+	"unicode"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+// motion moves the cursor and tells operators how much text that movement
+// covers.
+type motion struct {
+	// linewise motions make operators act on whole lines.
+	linewise bool
+	// inclusive motions make operators include the character the motion
+	// lands on.
+	inclusive bool
+	// takesArg motions read one more key as their argument, like f and t.
+	takesArg bool
+	// markArg motions take the name of a mark as their argument, which
+	// goes through the langmap like the name after m.
+	markArg bool
+	// jump returns where the motion lands when started at p. count is at
+	// least one; hasCount tells whether the user typed it. It reports
+	// false when the motion can't move at all.
+	jump func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool)
+	// visual, if set, moves the cursor in place of jump when there is no
+	// operator. It goes across the screen rather than through the text,
+	// which differs in right-to-left text.
+	visual func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool)
+}
+
+var motions = map[string]motion{
+	"h":                              {jump: jumpLeft, visual: visualJump(-1)},
+	string(rune(keys.KeyArrowLeft)):  {jump: jumpLeft, visual: visualJump(-1)},
+	"l":                              {jump: jumpRight, visual: visualJump(1)},
+	string(rune(keys.KeyArrowRight)): {jump: jumpRight, visual: visualJump(1)},
+	"j":                              {linewise: true, jump: jumpDown},
+	string(rune(keys.KeyArrowDown)):  {linewise: true, jump: jumpDown},
+	"k":                              {linewise: true, jump: jumpUp},
+	string(rune(keys.KeyArrowUp)):    {linewise: true, jump: jumpUp},
+	"0":                              {jump: jumpLineStart},
+	string(rune(keys.KeyHome)):       {jump: jumpLineStart},
+	"^":                              {jump: jumpFirstNonBlank},
+	"$":                              {inclusive: true, jump: jumpLineEnd},
+	string(rune(keys.KeyEnd)):        {inclusive: true, jump: jumpLineEnd},
+	"w":                              {jump: wordJump((*Editor).wordForward, false)},
+	"W":                              {jump: wordJump((*Editor).wordForward, true)},
+	"b":                              {jump: wordJump((*Editor).wordBackward, false)},
+	"B":                              {jump: wordJump((*Editor).wordBackward, true)},
+	"e":                              {inclusive: true, jump: wordJump((*Editor).wordEnd, false)},
+	"E":                              {inclusive: true, jump: wordJump((*Editor).wordEnd, true)},
+	"{":                              {jump: jumpParagraphBackward},
+	"}":                              {jump: jumpParagraphForward},
+	"gg":                             {linewise: true, jump: jumpFirstLine},
+	"G":                              {linewise: true, jump: jumpLastLine},
+	"H":                              {linewise: true, jump: jumpScreenTop},
+	"M":                              {linewise: true, jump: jumpScreenMiddle},
+	"L":                              {linewise: true, jump: jumpScreenBottom},
+	"f":                              {inclusive: true, takesArg: true, jump: findJump(1, 0)},
+	"t":                              {inclusive: true, takesArg: true, jump: findJump(1, -1)},
+	"F":                              {takesArg: true, jump: findJump(-1, 0)},
+	"T":                              {takesArg: true, jump: findJump(-1, 1)},
+}
+
+func jumpLeft(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	if p.x == 0 {
+		return p, false
+	}
+	p.x = prevCluster(e.row(p.y).chars, p.x, count)
+	return p, true
+}
+
+func jumpRight(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	chars := e.row(p.y).chars
+	if p.x >= len(chars) {
+		return p, false
+	}
+	p.x = nextCluster(chars, p.x, count)
+	return p, true
+}
+
+func jumpDown(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	if p.y+1 >= e.Rows.Len() {
+		return p, false
+	}
+	p.y = min(p.y+count, e.Rows.Len()-1)
+	return p, true
+}
+
+func jumpUp(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	if p.y == 0 {
+		return p, false
+	}
+	p.y = max(p.y-count, 0)
+	return p, true
+}
+
+func jumpLineStart(e *Editor, p position, _ int, _ bool, _ keys.Key) (position, bool) {
+	p.x = 0
+	return p, true
+}
+
+func jumpFirstNonBlank(e *Editor, p position, _ int, _ bool, _ keys.Key) (position, bool) {
+	p.x = e.firstNonBlank(p.y)
+	return p, true
+}
+
+func jumpLineEnd(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	p.y = min(p.y+count-1, e.Rows.Len()-1)
+	p.x = max(len(e.row(p.y).chars)-1, 0)
+	return p, true
+}
+
+func jumpFirstLine(e *Editor, p position, count int, hasCount bool, _ keys.Key) (position, bool) {
+	p.y = 0
+	if hasCount {
+		p.y = min(count-1, e.Rows.Len()-1)
+	}
+	p.x = e.firstNonBlank(p.y)
+	return p, true
+}
+
+func jumpLastLine(e *Editor, p position, count int, hasCount bool, _ keys.Key) (position, bool) {
+	e.waitLoading()
+	p.y = e.Rows.Len() - 1
+	if hasCount {
+		p.y = min(count-1, e.Rows.Len()-1)
+	}
+	p.x = e.firstNonBlank(p.y)
+	return p, true
+}
+
+func jumpScreenTop(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	p.y = e.clampY(e.rowOffset + count - 1)
+	p.x = e.firstNonBlank(p.y)
+	return p, true
+}
+
+func jumpScreenMiddle(e *Editor, p position, _ int, _ bool, _ keys.Key) (position, bool) {
+	last := min(e.rowOffset+e.screenRows, e.Rows.Len()) - 1
+	p.y = e.clampY((e.rowOffset + last) / 2)
+	p.x = e.firstNonBlank(p.y)
+	return p, true
+}
+
+func jumpScreenBottom(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	last := min(e.rowOffset+e.screenRows, e.Rows.Len()) - 1
+	p.y = e.clampY(max(last-count+1, e.rowOffset))
+	p.x = e.firstNonBlank(p.y)
+	return p, true
+}
+
+func jumpParagraphForward(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	last := e.Rows.Len() - 1
+	if p.y == last && p.x >= len(e.row(last).chars)-1 {
+		return p, false
+	}
+	y := p.y
+	for ; count > 0; count-- {
+		for y < last && e.isBlankRow(y) {
+			y++
+		}
+		for y < last && !e.isBlankRow(y) {
+			y++
+		}
+	}
+	if e.isBlankRow(y) {
+		return position{x: 0, y: y}, true
+	}
+	// no blank line left, stop at the end of the last line.
+	return position{x: len(e.row(y).chars), y: y}, true
+}
+
+func jumpParagraphBackward(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+	if p.y == 0 && p.x == 0 {
+		return p, false
+	}
+	y := p.y
+	for ; count > 0; count-- {
+		for y > 0 && e.isBlankRow(y) {
+			y--
+		}
+		for y > 0 && !e.isBlankRow(y) {
+			y--
+		}
+	}
+	return position{x: 0, y: y}, true
+}
+
+// findJump returns the jump function of the f, t, F and T motions, which
+// look for their argument on the current line in the given direction and
+// then step back by offset.
+func findJump(dir, offset int) func(*Editor, position, int, bool, keys.Key) (position, bool) {
+	return func(e *Editor, p position, count int, _ bool, arg keys.Key) (position, bool) {
+		chars := e.row(p.y).chars
+		x := p.x
+		for count > 0 {
+			x += dir
+			if x < 0 || x >= len(chars) {
+				return p, false
+			}
+			if chars[x] == rune(arg) {
+				count--
+			}
+		}
+		p.x = x + offset
+		return p, true
+	}
+}
+
+func wordJump(word func(*Editor, position, bool) position, big bool) func(*Editor, position, int, bool, keys.Key) (position, bool) {
+	return func(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+		start := p
+		for ; count > 0; count-- {
+			p = word(e, p, big)
+		}
+		return p, p != start
+	}
+}
+
+// charClass splits characters into blanks (0), punctuation (1) and word
+// characters (2). With big set, punctuation counts as word characters.
+func charClass(r rune, big bool) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case big || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (e *Editor) isBlankRow(y int) bool {
+	return len(e.row(y).chars) == 0
+}
+
+// firstNonBlank returns the index of the first character in row y that is
+// not white space.
+func (e *Editor) firstNonBlank(y int) int {
+	chars := e.row(y).chars
+	for x, r := range chars {
+		if !unicode.IsSpace(r) {
+			return x
+		}
+	}
+	return max(len(chars)-1, 0)
+}
+
+// nextPos returns the position of the character after p, moving on to the
+// next line at the end of a line.
+func (e *Editor) nextPos(p position) (position, bool) {
+	if x := clusterEnd(e.row(p.y).chars, p.x); x < len(e.row(p.y).chars) {
+		return position{x: x, y: p.y}, true
+	}
+	if p.y+1 < e.Rows.Len() {
+		return position{x: 0, y: p.y + 1}, true
+	}
+	return p, false
+}
+
+// prevPos returns the position of the character before p, moving back to
+// the end of the previous line at the start of a line.
+func (e *Editor) prevPos(p position) (position, bool) {
+	if p.x > 0 {
+		chars := e.row(p.y).chars
+		return position{x: clusterStart(chars, min(p.x, len(chars))-1), y: p.y}, true
+	}
+	if p.y > 0 {
+		chars := e.row(p.y - 1).chars
+		return position{x: clusterStart(chars, max(len(chars)-1, 0)), y: p.y - 1}, true
+	}
+	return p, false
+}
+
+// wordForward returns the start of the word after p. An empty line counts
+// as a word. At the end of the buffer it returns the end of the last line.
+func (e *Editor) wordForward(p position, big bool) position {
+	chars := e.row(p.y).chars
+	if p.x < len(chars) {
+		if class := charClass(chars[p.x], big); class != 0 {
+			for p.x < len(chars) && charClass(chars[p.x], big) == class {
+				p.x++
+			}
+		}
+	}
+	for {
+		chars = e.row(p.y).chars
+		for p.x < len(chars) && charClass(chars[p.x], big) == 0 {
+			p.x++
+		}
+		if p.x < len(chars) || p.y+1 >= e.Rows.Len() {
+			return p
+		}
+		p = position{x: 0, y: p.y + 1}
+		if e.isBlankRow(p.y) {
+			return p
+		}
+	}
+}
+
+// wordBackward returns the start of the word before p. An empty line counts
+// as a word.
+func (e *Editor) wordBackward(p position, big bool) position {
+	p, ok := e.prevPos(p)
+	if !ok {
+		return p
+	}
+	for {
+		chars := e.row(p.y).chars
+		if len(chars) == 0 || charClass(chars[p.x], big) != 0 {
+			break
+		}
+		if p, ok = e.prevPos(p); !ok {
+			return p
+		}
+	}
+	chars := e.row(p.y).chars
+	if len(chars) == 0 {
+		return p
+	}
+	class := charClass(chars[p.x], big)
+	for p.x > 0 && charClass(chars[p.x-1], big) == class {
+		p.x--
+	}
+	return p
+}
+
+// wordEnd returns the last character of the word at or after the character
+// following p.
+func (e *Editor) wordEnd(p position, big bool) position {
+	p, ok := e.nextPos(p)
+	if !ok {
+		return p
+	}
+	for {
+		chars := e.row(p.y).chars
+		if len(chars) > 0 && charClass(chars[p.x], big) != 0 {
+			break
+		}
+		if p, ok = e.nextPos(p); !ok {
+			return p
+		}
+	}
+	chars := e.row(p.y).chars
+	class := charClass(chars[p.x], big)
+	for p.x+1 < len(chars) && charClass(chars[p.x+1], big) == class {
+		p.x++
+	}
+	return p
+}
+
+// motionRegion returns the region an operator covers when m moves the
+// cursor from from to to.
+func (e *Editor) motionRegion(m motion, from, to position) region {
+	start, end := from, to
+	if end.less(start) {
+		start, end = end, start
+	}
+	if m.linewise {
+		return region{kind: linewise, start: start, end: end}
+	}
+	if m.inclusive {
+		end.x = clusterEnd(e.row(end.y).chars, end.x)
+	} else if end.x == 0 && end.y > start.y {
+		// an exclusive motion that ends at the start of a line doesn't
+		// include that line.
+		if start.x <= e.firstNonBlank(start.y) {
+			return region{kind: linewise, start: start, end: position{y: end.y - 1}}
+		}
+		end = position{x: len(e.row(end.y - 1).chars), y: end.y - 1}
+	}
+	return region{kind: charwise, start: start, end: end}
+}
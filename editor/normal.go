@@ -0,0 +1,440 @@
+package editor
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+	modes "github.com/amirali/virayeshgar/editor/modes"
+)
+
+// errIncompleteCommand is returned by parseCommand while the pending keys
+// are the start of a valid command.
+var errIncompleteCommand = errors.New("incomplete command")
+
+// operator acts on the region covered by a motion or a text object.
+type operator func(e *Editor, r region)
+
+var operators = map[string]operator{
+	"d":  (*Editor).deleteRegion,
+	"y":  yankOperator,
+	"c":  changeOperator,
+	">":  func(e *Editor, r region) { e.indentRegion(r, 1) },
+	"<":  func(e *Editor, r region) { e.indentRegion(r, -1) },
+	"g~": func(e *Editor, r region) { e.caseRegion(r, toggleCase) },
+	"gu": func(e *Editor, r region) { e.caseRegion(r, unicode.ToLower) },
+	"gU": func(e *Editor, r region) { e.caseRegion(r, unicode.ToUpper) },
+}
+
+func yankOperator(e *Editor, r region) {
+	e.yankRegion(r)
+	if r.start.y < e.cy || r.kind == charwise {
+		e.cy = r.start.y
+	}
+	if r.kind == charwise {
+		e.cx = r.start.x
+	}
+}
+
+func changeOperator(e *Editor, r region) {
+	e.changeRegion(r)
+	e.SetMode(modes.InsertMode)
+}
+
+// normalAliases are commands that are shorthands for an operator and a
+// motion.
+var normalAliases = map[keys.Key]string{
+	'x': "dl",
+	'X': "dh",
+	'D': "d$",
+	'C': "c$",
+	's': "cl",
+	'S': "cc",
+	'Y': "yy",
+}
+
+// normalCommands are the normal mode commands that are neither operators
+// nor motions. They get the count typed in front of them, which is at least
+// one.
+var normalCommands = map[string]func(e *Editor, count int) error{
+	"i": func(e *Editor, _ int) error {
+		e.SetMode(modes.InsertMode)
+		return nil
+	},
+	"I": func(e *Editor, _ int) error {
+		e.cx = e.firstNonBlank(e.cy)
+		e.SetMode(modes.InsertMode)
+		return nil
+	},
+	"a": func(e *Editor, _ int) error {
+		e.cx = clusterEnd(e.row(e.cy).chars, e.cx)
+		e.SetMode(modes.InsertMode)
+		return nil
+	},
+	"A": func(e *Editor, _ int) error {
+		e.cx = len(e.row(e.cy).chars)
+		e.SetMode(modes.InsertMode)
+		return nil
+	},
+	"o": func(e *Editor, _ int) error {
+		e.cx = len(e.row(e.cy).chars)
+		e.InsertNewline()
+		e.SetMode(modes.InsertMode)
+		return nil
+	},
+	"O": func(e *Editor, _ int) error {
+		e.cx = 0
+		e.InsertNewline()
+		e.MoveCursor(keys.NavKeyK)
+		e.SetMode(modes.InsertMode)
+		return nil
+	},
+	":": func(e *Editor, _ int) error {
+		e.mode = modes.CommandMode
+		e.command = ""
+		e.SetStatusMessage(e.command)
+		return nil
+	},
+	"/": func(e *Editor, _ int) error {
+		err := e.Find(1)
+		if err == ErrPromptCanceled {
+			e.SetStatusMessage("")
+			return nil
+		}
+		return err
+	},
+	"?": func(e *Editor, _ int) error {
+		err := e.Find(-1)
+		if err == ErrPromptCanceled {
+			e.SetStatusMessage("")
+			return nil
+		}
+		return err
+	},
+	"u": func(e *Editor, count int) error {
+		for ; count > 0; count-- {
+			e.Undo()
+		}
+		return nil
+	},
+	string(rune(keys.ModeKeyCtrlR)): func(e *Editor, count int) error {
+		for ; count > 0; count-- {
+			e.Redo()
+		}
+		return nil
+	},
+	"g-": func(e *Editor, count int) error {
+		e.UndoStep(-count)
+		return nil
+	},
+	"g+": func(e *Editor, count int) error {
+		e.UndoStep(count)
+		return nil
+	},
+	"p": func(e *Editor, count int) error {
+		for ; count > 0; count-- {
+			e.Paste(true)
+		}
+		return nil
+	},
+	"P": func(e *Editor, count int) error {
+		for ; count > 0; count-- {
+			e.Paste(false)
+		}
+		return nil
+	},
+	"~": func(e *Editor, count int) error {
+		chars := e.row(e.cy).chars
+		if e.cx >= len(chars) {
+			return nil
+		}
+		end := nextCluster(chars, e.cx, count)
+		e.caseRegion(region{kind: charwise, start: position{x: e.cx, y: e.cy}, end: position{x: end, y: e.cy}}, toggleCase)
+		e.cx = min(end, len(chars)-1)
+		return nil
+	},
+	"v": func(e *Editor, _ int) error {
+		e.SetMode(modes.VisualMode)
+		return nil
+	},
+	"V": func(e *Editor, _ int) error {
+		e.SetMode(modes.VisualLineMode)
+		return nil
+	},
+	string(rune(keys.ModeKeyCtrlV)): func(e *Editor, _ int) error {
+		e.SetMode(modes.VisualBlockMode)
+		return nil
+	},
+}
+
+// normalCommand is a parsed [count]["register][operator][count]motion
+// sequence of keys.
+type normalCommand struct {
+	count    int
+	hasCount bool
+	register rune
+	// operator is empty for plain motions and other commands.
+	operator string
+	// linewise is set when the operator is doubled, like dd or >>.
+	linewise bool
+	// command is the key of a normalCommands entry.
+	command string
+	// motion or textObject is the key of a motions or textObjects entry,
+	// with around telling an "a" text object from an "i" one.
+	motion     string
+	textObject string
+	around     bool
+	arg        keys.Key
+}
+
+// lookup finds the entry of table the keys ks start with. It returns
+// errIncompleteCommand when ks is the start of a longer entry and
+// ErrUnkownMotion when nothing matches.
+func lookup[T any](table map[string]T, ks []keys.Key) (string, error) {
+	s := keysToString(ks)
+	incomplete := false
+	for name := range table {
+		if strings.HasPrefix(s, name) {
+			return name, nil
+		}
+		if strings.HasPrefix(name, s) {
+			incomplete = true
+		}
+	}
+	if incomplete {
+		return "", errIncompleteCommand
+	}
+	return "", ErrUnkownMotion
+}
+
+func keysToString(ks []keys.Key) string {
+	var b strings.Builder
+	for _, k := range ks {
+		b.WriteRune(rune(k))
+	}
+	return b.String()
+}
+
+// parseCommand parses the keys of a normal mode command. With visual set
+// it only accepts counts, motions and text objects, as operators in visual
+// mode act on the selection instead.
+func parseCommand(ks []keys.Key, visual bool) (normalCommand, error) {
+	var cmd normalCommand
+	i := 0
+	// pending is set when the keys could still become a normal command.
+	pending := false
+	count := func() int {
+		n := 0
+		for i < len(ks) && ks[i] >= '0' && ks[i] <= '9' && (n > 0 || ks[i] != '0') {
+			n = n*10 + int(ks[i]-'0')
+			i++
+		}
+		return n
+	}
+	addCount := func(n int) {
+		if n > 0 {
+			cmd.count = max(cmd.count, 1) * n
+			cmd.hasCount = true
+		}
+	}
+
+	addCount(count())
+	if !visual && i < len(ks) && ks[i] == '"' {
+		if i+1 >= len(ks) {
+			return cmd, errIncompleteCommand
+		}
+		cmd.register = rune(ks[i+1])
+		i += 2
+		addCount(count())
+	}
+	if i == len(ks) {
+		return cmd, errIncompleteCommand
+	}
+
+	if alias, ok := normalAliases[ks[i]]; ok && !visual {
+		expanded := make([]keys.Key, 0, len(ks)+len(alias))
+		expanded = append(expanded, ks[:i]...)
+		for _, r := range alias {
+			expanded = append(expanded, keys.Key(r))
+		}
+		ks = append(expanded, ks[i+1:]...)
+	}
+
+	if !visual {
+		name, err := lookup(operators, ks[i:])
+		if err == errIncompleteCommand {
+			return cmd, err
+		}
+		if err == nil {
+			cmd.operator = name
+			i += len([]rune(name))
+			addCount(count())
+			if i == len(ks) {
+				return cmd, errIncompleteCommand
+			}
+			// a doubled operator acts on whole lines, like dd or g~~.
+			rest := keysToString(ks[i:])
+			last := name[len(name)-1:]
+			if rest == last || rest == name {
+				cmd.linewise = true
+				return cmd, nil
+			}
+			if strings.HasPrefix(name, rest) {
+				return cmd, errIncompleteCommand
+			}
+		} else if name, err := lookup(normalCommands, ks[i:]); err == nil {
+			cmd.command = name
+			return cmd, nil
+		} else if err == errIncompleteCommand {
+			pending = true
+		}
+	}
+
+	if (cmd.operator != "" || visual) && (ks[i] == 'i' || ks[i] == 'a') {
+		if i+1 == len(ks) {
+			return cmd, errIncompleteCommand
+		}
+		name, err := lookup(textObjects, ks[i+1:])
+		if err != nil {
+			return cmd, err
+		}
+		cmd.textObject = name
+		cmd.around = ks[i] == 'a'
+		return cmd, nil
+	}
+
+	name, err := lookup(motions, ks[i:])
+	if err == ErrUnkownMotion && pending {
+		// the start of a command like Ctrl-W.
+		return cmd, errIncompleteCommand
+	}
+	if err != nil {
+		return cmd, err
+	}
+	cmd.motion = name
+	i += len([]rune(name))
+	if motions[name].takesArg {
+		if i == len(ks) {
+			return cmd, errIncompleteCommand
+		}
+		cmd.arg = ks[i]
+	}
+	return cmd, nil
+}
+
+// ExecuteMotion runs the command typed so far into the motion register. It
+// keeps the keys around while they are the start of a valid command.
+func (e *Editor) ExecuteMotion() error {
+	cmd, err := parseCommand(e.motionRegister, false)
+	if err == errIncompleteCommand {
+		return nil
+	}
+	e.motionRegister = []keys.Key{}
+	if err != nil {
+		return err
+	}
+
+	count := max(cmd.count, 1)
+	e.cy = e.clampY(e.cy)
+	e.selectedRegister, e.hasCount = cmd.register, cmd.hasCount
+	defer func() { e.selectedRegister, e.hasCount = 0, false }()
+
+	if cmd.command != "" {
+		return normalCommands[cmd.command](e, count)
+	}
+
+	cursor := e.clampPosition(position{x: e.cx, y: e.cy})
+	var r region
+	switch {
+	case cmd.linewise:
+		last := e.clampY(cursor.y + count - 1)
+		r = region{kind: linewise, start: position{y: cursor.y}, end: position{y: last}}
+	case cmd.textObject != "":
+		var ok bool
+		if r, ok = textObjects[cmd.textObject](e, cursor, count, cmd.around); !ok {
+			return nil
+		}
+	default:
+		m := motions[cmd.motion]
+		if cmd.operator == "c" && (cmd.motion == "w" || cmd.motion == "W") {
+			// cw on a word works like ce, it leaves the white space after
+			// the word alone.
+			if r, ok := e.charAt(cursor); ok && charClass(r, false) != 0 {
+				m = motions[map[string]string{"w": "e", "W": "E"}[cmd.motion]]
+			}
+		}
+		jump := m.jump
+		if cmd.operator == "" && m.visual != nil {
+			jump = m.visual
+		}
+		target, ok := jump(e, cursor, count, cmd.hasCount, cmd.arg)
+		if !ok {
+			return nil
+		}
+		if cmd.operator == "" {
+			e.cx, e.cy = target.x, target.y
+			e.clampCursor()
+			return nil
+		}
+		if (cmd.motion == "w" || cmd.motion == "W") && target.y > cursor.y && target.x <= e.firstNonBlank(target.y) {
+			// the last word moved over ends the line, so stop there
+			// instead of at the first word of the next line.
+			target = position{x: len(e.row(target.y - 1).chars), y: target.y - 1}
+		}
+		r = e.motionRegion(m, cursor, target)
+	}
+	operators[cmd.operator](e, r)
+	if e.mode == modes.NormalMode {
+		e.clampCursor()
+	}
+	return nil
+}
+
+// clampCursor keeps the cursor on a character, as normal mode has no use for
+// the position past the end of the line.
+func (e *Editor) clampCursor() {
+	e.cy = e.clampY(e.cy)
+	chars := e.row(e.cy).chars
+	e.cx = clusterStart(chars, max(0, min(e.cx, len(chars)-1)))
+}
+
+func toggleCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+// setRegister stores reg in the unnamed register and in the register
+// selected with ", if any. An upper case register name appends to the
+// lower case register.
+func (e *Editor) setRegister(reg register) {
+	e.yankRegister = reg
+	name := e.selectedRegister
+	if name == 0 || name == '"' {
+		return
+	}
+	if e.registers == nil {
+		e.registers = make(map[rune]register)
+	}
+	if unicode.IsUpper(name) {
+		name = unicode.ToLower(name)
+		if prev, ok := e.registers[name]; ok {
+			reg.lines = append(append([]string{}, prev.lines...), reg.lines...)
+			if prev.kind == linewise {
+				reg.kind = linewise
+			}
+		}
+	}
+	e.registers[name] = reg
+}
+
+// getRegister returns the register selected with ", or the unnamed one.
+func (e *Editor) getRegister() register {
+	name := unicode.ToLower(e.selectedRegister)
+	if name == 0 || name == '"' {
+		return e.yankRegister
+	}
+	return e.registers[name]
+}
@@ -0,0 +1,272 @@
+package editor
+
+import (
+	"slices"
+	"strings"
+)
+
+type position struct {
+	x int
+	y int
+}
+
+// less reports whether p comes before q in the buffer.
+func (p position) less(q position) bool {
+	return p.y < q.y || (p.y == q.y && p.x < q.x)
+}
+
+type registerKind int
+
+const (
+	charwise registerKind = iota
+	linewise
+	blockwise
+)
+
+// register holds yanked or cut text along with the shape it was taken in.
+type register struct {
+	kind  registerKind
+	lines []string
+}
+
+// region is a span of text an operator acts on.
+//
+// For charwise regions end is exclusive. For linewise regions only the y
+// values matter and both are inclusive. For blockwise regions the x values
+// are render columns, start inclusive and end exclusive.
+type region struct {
+	kind  registerKind
+	start position
+	end   position
+}
+
+// clampY keeps y inside the rows of the buffer.
+func (e *Editor) clampY(y int) int {
+	return max(0, min(y, e.Rows.Len()-1))
+}
+
+// blockSpan returns the range of characters of row that fall in the render
+// columns left..right, right being exclusive.
+func (e *Editor) blockSpan(row *Row, left, right int) (int, int) {
+	from := e.rowRxToCx(row, left)
+	to := clusterEnd(row.chars, e.rowRxToCx(row, right-1))
+	if from > to {
+		from = to
+	}
+	return from, to
+}
+
+// spans calls fn with the characters of every row r covers, from inclusive
+// and to exclusive.
+func (e *Editor) spans(r region, fn func(y int, row *Row, from, to int)) {
+	for y := r.start.y; y <= r.end.y; y++ {
+		row := e.row(y)
+		from, to := 0, len(row.chars)
+		switch r.kind {
+		case charwise:
+			if y == r.start.y {
+				from = min(r.start.x, to)
+			}
+			if y == r.end.y {
+				to = min(r.end.x, to)
+			}
+		case blockwise:
+			from, to = e.blockSpan(row, r.start.x, r.end.x)
+		}
+		fn(y, row, from, to)
+	}
+}
+
+// yankRegion copies the text covered by r to the yank register.
+func (e *Editor) yankRegion(r region) {
+	var lines []string
+	e.spans(r, func(y int, row *Row, from, to int) {
+		lines = append(lines, string(row.chars[from:to]))
+	})
+	e.setRegister(register{kind: r.kind, lines: lines})
+}
+
+// deleteRegion cuts the text covered by r into the yank register and puts
+// the cursor where the region started.
+func (e *Editor) deleteRegion(r region) {
+	e.yankRegion(r)
+	switch r.kind {
+	case linewise:
+		e.change(r.start.y, r.end.y, func() {
+			for y := r.end.y; y >= r.start.y; y-- {
+				e.DeleteRow(y)
+			}
+			if e.Rows.Len() == 0 {
+				e.InsertRow(0, "")
+			}
+		})
+		e.cy = e.clampY(r.start.y)
+		e.cx = 0
+	case charwise:
+		e.change(r.start.y, r.end.y, func() {
+			first, last := e.row(r.start.y), e.row(r.end.y)
+			start, end := min(r.start.x, len(first.chars)), min(r.end.x, len(last.chars))
+			chars := append(slices.Clone(first.chars[:start]), last.chars[end:]...)
+			for y := r.end.y; y > r.start.y; y-- {
+				e.DeleteRow(y)
+			}
+			first.chars = chars
+			e.updateRow(r.start.y)
+		})
+		e.cy = r.start.y
+		e.cx = r.start.x
+	case blockwise:
+		e.change(r.start.y, r.end.y, func() {
+			e.spans(r, func(y int, row *Row, from, to int) {
+				row.chars = append(row.chars[:from], row.chars[to:]...)
+				e.updateRow(y)
+			})
+		})
+		e.cy = r.start.y
+		e.cx = e.rowRxToCx(e.row(e.cy), r.start.x)
+	}
+}
+
+// changeRegion deletes the text covered by r, leaving the cursor where the
+// replacement text goes. Linewise regions leave an empty line behind.
+func (e *Editor) changeRegion(r region) {
+	if r.kind != linewise {
+		e.deleteRegion(r)
+		return
+	}
+	e.yankRegion(r)
+	e.change(r.start.y, r.end.y, func() {
+		for y := r.end.y; y >= r.start.y; y-- {
+			e.DeleteRow(y)
+		}
+		e.InsertRow(r.start.y, "")
+	})
+	e.cy = r.start.y
+	e.cx = 0
+}
+
+// indentRegion shifts every line of r one level to the right when dir is
+// positive and one level to the left otherwise.
+func (e *Editor) indentRegion(r region, dir int) {
+	e.change(r.start.y, r.end.y, func() {
+		for y := r.start.y; y <= r.end.y; y++ {
+			row := e.row(y)
+			if dir > 0 {
+				if len(row.chars) > 0 {
+					row.chars = slices.Insert(row.chars, 0, '\t')
+				}
+			} else if len(row.chars) > 0 && row.chars[0] == '\t' {
+				row.chars = row.chars[1:]
+			} else {
+				n := 0
+				for n < len(row.chars) && n < e.tabstop() && row.chars[n] == ' ' {
+					n++
+				}
+				row.chars = row.chars[n:]
+			}
+			e.updateRow(y)
+		}
+	})
+	e.cy = r.start.y
+	e.cx = 0
+}
+
+// caseRegion maps every character covered by r through fn, which changes
+// its case.
+func (e *Editor) caseRegion(r region, fn func(rune) rune) {
+	e.change(r.start.y, r.end.y, func() {
+		e.spans(r, func(y int, row *Row, from, to int) {
+			for i := from; i < to; i++ {
+				row.chars[i] = fn(row.chars[i])
+			}
+			e.updateRow(y)
+		})
+	})
+	e.cy = r.start.y
+	e.cx = r.start.x
+	if r.kind == blockwise {
+		e.cx = e.rowRxToCx(e.row(e.cy), r.start.x)
+	}
+}
+
+// insertText inserts lines at the given position. The first line is joined
+// to the text before at and the last one to the text after it. It returns
+// the position right after the inserted text.
+func (e *Editor) insertText(at position, lines []string) position {
+	row := e.row(at.y)
+	tail := slices.Clone(row.chars[at.x:])
+	row.chars = append(row.chars[:at.x], []rune(lines[0])...)
+	if len(lines) == 1 {
+		end := position{x: len(row.chars), y: at.y}
+		row.chars = append(row.chars, tail...)
+		e.updateRow(at.y)
+		return end
+	}
+	e.updateRow(at.y)
+	for i, line := range lines[1:] {
+		y := at.y + 1 + i
+		if i == len(lines)-2 {
+			e.InsertRow(y, line+string(tail))
+			return position{x: len([]rune(line)), y: y}
+		}
+		e.InsertRow(y, line)
+	}
+	panic("unreachable")
+}
+
+// Paste puts the yank register after the cursor, or before it when after is
+// false.
+func (e *Editor) Paste(after bool) {
+	reg := e.getRegister()
+	if len(reg.lines) == 0 || e.Rows.Len() == 0 {
+		return
+	}
+	e.cy = e.clampY(e.cy)
+	switch reg.kind {
+	case linewise:
+		at := e.cy
+		if after {
+			at++
+		}
+		e.PasteRow(at)
+		e.cy = at
+		e.cx = 0
+	case charwise:
+		at := position{x: min(e.cx, len(e.row(e.cy).chars)), y: e.cy}
+		if after && at.x < len(e.row(e.cy).chars) {
+			at.x = clusterEnd(e.row(e.cy).chars, at.x)
+		}
+		e.change(at.y, at.y, func() {
+			end := e.insertText(at, reg.lines)
+			if len(reg.lines) == 1 {
+				e.cx = max(end.x-1, at.x)
+			} else {
+				e.cx = at.x
+			}
+		})
+		e.cy = at.y
+	case blockwise:
+		row := e.row(e.cy)
+		cx := min(e.cx, len(row.chars))
+		if after && cx < len(row.chars) {
+			cx = clusterEnd(row.chars, cx)
+		}
+		rx := e.rowCxToRx(row, cx)
+		last := min(e.cy+len(reg.lines)-1, e.Rows.Len()-1)
+		e.change(e.cy, last, func() {
+			for i, line := range reg.lines {
+				y := e.cy + i
+				if y == e.Rows.Len() {
+					e.InsertRow(y, "")
+				}
+				row := e.row(y)
+				if width := e.rowCxToRx(row, len(row.chars)); width < rx {
+					row.chars = append(row.chars, []rune(strings.Repeat(" ", rx-width))...)
+				}
+				row.chars = slices.Insert(row.chars, e.rowRxToCx(row, rx), []rune(line)...)
+				e.updateRow(y)
+			}
+		})
+		e.cx = cx
+	}
+}
@@ -0,0 +1,293 @@
+// Package rope implements a persistent sequence of items, kept in a balanced
+// tree so that looking up, inserting and deleting items anywhere in it take
+// O(log n) time.
+//
+// A Rope is never changed in place. Every edit returns a new Rope that shares
+// all but O(log n) of its nodes with the old one, so keeping an old Rope
+// around is a cheap snapshot of the sequence. Snapshots share the items
+// themselves, they only stay as they were if the items aren't modified in
+// place.
+//
+// An item can take up more than one index, like a run of lines kept as a
+// single item, by implementing Weigher. Such an item is looked up by any of
+// its indexes, but inserted, deleted and replaced whole: edits have to start
+// and end on item boundaries.
+package rope
+
+// Weigher is implemented by items that take up Weight indexes of a Rope,
+// which is at least one. Other items take up one.
+type Weigher interface {
+	Weight() int
+}
+
+// Rope is a sequence of items. The zero value is an empty Rope ready to use.
+type Rope[T any] struct {
+	root *node[T]
+}
+
+// node is a node of an AVL tree ordered by position.
+type node[T any] struct {
+	item        T
+	left, right *node[T]
+	// size is the number of indexes the items of the subtree take up.
+	size   int
+	height int
+}
+
+// New returns a Rope holding items.
+func New[T any](items ...T) Rope[T] {
+	return Rope[T]{root: build(items)}
+}
+
+// Len returns the number of indexes in r, which is the number of items
+// unless some of them weigh more than one.
+func (r Rope[T]) Len() int {
+	return size(r.root)
+}
+
+// At returns the item at index i. It panics if i is out of range.
+func (r Rope[T]) At(i int) T {
+	item, _ := r.Find(i)
+	return item
+}
+
+// Find returns the item at index i and the index it starts at, which is i
+// unless the item weighs more than one. It panics if i is out of range.
+func (r Rope[T]) Find(i int) (T, int) {
+	r.check(i, r.Len()-1)
+	n, start := r.root, 0
+	for {
+		ls, w := size(n.left), weight(n.item)
+		switch {
+		case i < ls:
+			n = n.left
+		case i >= ls+w:
+			i -= ls + w
+			start += ls + w
+			n = n.right
+		default:
+			return n.item, start + ls
+		}
+	}
+}
+
+// Set returns a Rope with the item at index i replaced by item. It panics if
+// i is out of range.
+func (r Rope[T]) Set(i int, item T) Rope[T] {
+	r.check(i, r.Len()-1)
+	return Rope[T]{root: set(r.root, i, item)}
+}
+
+// Insert returns a Rope with items inserted before index i. It panics if i
+// is out of range, Len being a valid index to append at, or inside an item.
+func (r Rope[T]) Insert(i int, items ...T) Rope[T] {
+	r.check(i, r.Len())
+	if len(items) == 0 {
+		return r
+	}
+	left, right := split(r.root, i)
+	return Rope[T]{root: concat(concat(left, build(items)), right)}
+}
+
+// Delete returns a Rope without the items from index from up to but not
+// including index to. It panics if the range is out of bounds or cuts an
+// item.
+func (r Rope[T]) Delete(from, to int) Rope[T] {
+	r.check(from, r.Len())
+	r.check(to, r.Len())
+	if from >= to {
+		return r
+	}
+	left, rest := split(r.root, from)
+	_, right := split(rest, to-from)
+	return Rope[T]{root: concat(left, right)}
+}
+
+// Slice returns the items from index from up to but not including index to,
+// along with the whole of the items the range starts or ends inside of.
+func (r Rope[T]) Slice(from, to int) []T {
+	items := make([]T, 0, max(to-from, 0))
+	r.Walk(from, func(i int, item T) bool {
+		if i >= to {
+			return false
+		}
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+// Walk calls fn for every item from index from on, in order, until fn
+// returns false. i is the index the item starts at, which is before from for
+// an item from is inside of.
+func (r Rope[T]) Walk(from int, fn func(i int, item T) bool) {
+	walk(r.root, 0, max(from, 0), fn)
+}
+
+func (r Rope[T]) check(i, last int) {
+	if i < 0 || i > last {
+		panic("rope: index out of range")
+	}
+}
+
+func walk[T any](n *node[T], offset, from int, fn func(int, T) bool) bool {
+	if n == nil {
+		return true
+	}
+	i := offset + size(n.left)
+	w := weight(n.item)
+	if from < i && !walk(n.left, offset, from, fn) {
+		return false
+	}
+	if from < i+w && !fn(i, n.item) {
+		return false
+	}
+	return walk(n.right, i+w, from, fn)
+}
+
+func weight[T any](item T) int {
+	if w, ok := any(item).(Weigher); ok {
+		return w.Weight()
+	}
+	return 1
+}
+
+func size[T any](n *node[T]) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func height[T any](n *node[T]) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+// mk returns a new node holding item between left and right.
+func mk[T any](left *node[T], item T, right *node[T]) *node[T] {
+	return &node[T]{
+		item:   item,
+		left:   left,
+		right:  right,
+		size:   size(left) + size(right) + weight(item),
+		height: max(height(left), height(right)) + 1,
+	}
+}
+
+func build[T any](items []T) *node[T] {
+	if len(items) == 0 {
+		return nil
+	}
+	mid := len(items) / 2
+	return mk(build(items[:mid]), items[mid], build(items[mid+1:]))
+}
+
+func set[T any](n *node[T], i int, item T) *node[T] {
+	ls, w := size(n.left), weight(n.item)
+	switch {
+	case i < ls:
+		return mk(set(n.left, i, item), n.item, n.right)
+	case i >= ls+w:
+		return mk(n.left, n.item, set(n.right, i-ls-w, item))
+	default:
+		return mk(n.left, item, n.right)
+	}
+}
+
+func rotateLeft[T any](n *node[T]) *node[T] {
+	r := n.right
+	return mk(mk(n.left, n.item, r.left), r.item, r.right)
+}
+
+func rotateRight[T any](n *node[T]) *node[T] {
+	l := n.left
+	return mk(l.left, l.item, mk(l.right, n.item, n.right))
+}
+
+// join returns the tree of the items of left, then item, then the items of
+// right, in O(|height(left) - height(right)|) time.
+func join[T any](left *node[T], item T, right *node[T]) *node[T] {
+	switch {
+	case height(left) > height(right)+1:
+		return joinRight(left, item, right)
+	case height(right) > height(left)+1:
+		return joinLeft(left, item, right)
+	default:
+		return mk(left, item, right)
+	}
+}
+
+// joinRight joins a right tree that is lower than left, going down the right
+// spine of left to where the heights match.
+func joinRight[T any](left *node[T], item T, right *node[T]) *node[T] {
+	if height(left.right) <= height(right)+1 {
+		t := mk(left.right, item, right)
+		if height(t) <= height(left.left)+1 {
+			return mk(left.left, left.item, t)
+		}
+		return rotateLeft(mk(left.left, left.item, rotateRight(t)))
+	}
+	t := joinRight(left.right, item, right)
+	n := mk(left.left, left.item, t)
+	if height(t) <= height(left.left)+1 {
+		return n
+	}
+	return rotateLeft(n)
+}
+
+// joinLeft is the mirror image of joinRight.
+func joinLeft[T any](left *node[T], item T, right *node[T]) *node[T] {
+	if height(right.left) <= height(left)+1 {
+		t := mk(left, item, right.left)
+		if height(t) <= height(right.right)+1 {
+			return mk(t, right.item, right.right)
+		}
+		return rotateRight(mk(rotateLeft(t), right.item, right.right))
+	}
+	t := joinLeft(left, item, right.left)
+	n := mk(t, right.item, right.right)
+	if height(t) <= height(right.right)+1 {
+		return n
+	}
+	return rotateRight(n)
+}
+
+// concat returns the tree of the items of left followed by those of right.
+func concat[T any](left, right *node[T]) *node[T] {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	rest, last := splitLast(left)
+	return join(rest, last, right)
+}
+
+func splitLast[T any](n *node[T]) (*node[T], T) {
+	if n.right == nil {
+		return n.left, n.item
+	}
+	rest, last := splitLast(n.right)
+	return join(n.left, n.item, rest), last
+}
+
+// split returns the trees of the first i items of n and of the rest.
+func split[T any](n *node[T], i int) (*node[T], *node[T]) {
+	if n == nil {
+		return nil, nil
+	}
+	ls, w := size(n.left), weight(n.item)
+	switch {
+	case i <= ls:
+		left, right := split(n.left, i)
+		return left, join(right, n.item, n.right)
+	case i < ls+w:
+		panic("rope: index inside an item")
+	}
+	left, right := split(n.right, i-ls-w)
+	return join(n.left, n.item, left), right
+}
@@ -0,0 +1,253 @@
+package rope
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// check fails the test unless r holds want and its tree keeps the AVL
+// invariants: sizes add up to the weights of the items and the heights of
+// siblings differ by one at most.
+func check(t *testing.T, r Rope[int], want []int) {
+	t.Helper()
+	if got := r.Slice(0, r.Len()); !slices.Equal(got, want) {
+		t.Fatalf("rope = %v, want %v", got, want)
+	}
+	if r.Len() != len(want) {
+		t.Fatalf("Len = %d, want %d", r.Len(), len(want))
+	}
+	for i, item := range want {
+		if got := r.At(i); got != item {
+			t.Fatalf("At(%d) = %d, want %d", i, got, item)
+		}
+	}
+	checkNode(t, r.root)
+}
+
+func checkNode[T any](t *testing.T, n *node[T]) {
+	t.Helper()
+	if n == nil {
+		return
+	}
+	checkNode(t, n.left)
+	checkNode(t, n.right)
+	if want := size(n.left) + size(n.right) + weight(n.item); n.size != want {
+		t.Fatalf("node %v has size %d, want %d", n.item, n.size, want)
+	}
+	if want := max(height(n.left), height(n.right)) + 1; n.height != want {
+		t.Fatalf("node %v has height %d, want %d", n.item, n.height, want)
+	}
+	if d := height(n.left) - height(n.right); d < -1 || d > 1 {
+		t.Fatalf("node %v is out of balance: heights %d and %d", n.item, height(n.left), height(n.right))
+	}
+}
+
+func seq(from, to int) []int {
+	s := make([]int, 0, to-from)
+	for i := from; i < to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+func TestRope(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(Rope[int]) Rope[int]
+		want []int
+	}{
+		{"insert into empty", func(r Rope[int]) Rope[int] { return Rope[int]{}.Insert(0, 1, 2, 3) }, []int{1, 2, 3}},
+		{"append", func(r Rope[int]) Rope[int] { return r.Insert(r.Len(), 100, 101) }, append(seq(0, 100), 100, 101)},
+		{"prepend", func(r Rope[int]) Rope[int] { return r.Insert(0, -1) }, append([]int{-1}, seq(0, 100)...)},
+		{"insert in the middle", func(r Rope[int]) Rope[int] { return r.Insert(50, -1, -2) }, slices.Concat(seq(0, 50), []int{-1, -2}, seq(50, 100))},
+		{"insert nothing", func(r Rope[int]) Rope[int] { return r.Insert(50) }, seq(0, 100)},
+		{"insert many", func(r Rope[int]) Rope[int] { return r.Insert(1, seq(1000, 3000)...) }, slices.Concat(seq(0, 1), seq(1000, 3000), seq(1, 100))},
+		{"delete the first", func(r Rope[int]) Rope[int] { return r.Delete(0, 1) }, seq(1, 100)},
+		{"delete the last", func(r Rope[int]) Rope[int] { return r.Delete(99, 100) }, seq(0, 99)},
+		{"delete a range", func(r Rope[int]) Rope[int] { return r.Delete(10, 90) }, slices.Concat(seq(0, 10), seq(90, 100))},
+		{"delete everything", func(r Rope[int]) Rope[int] { return r.Delete(0, 100) }, []int{}},
+		{"delete nothing", func(r Rope[int]) Rope[int] { return r.Delete(40, 40) }, seq(0, 100)},
+		{"set", func(r Rope[int]) Rope[int] { return r.Set(42, -42) }, slices.Concat(seq(0, 42), []int{-42}, seq(43, 100))},
+		{"delete down to one", func(r Rope[int]) Rope[int] {
+			for r.Len() > 1 {
+				r = r.Delete(0, 1)
+			}
+			return r
+		}, []int{99}},
+		{"append one at a time", func(r Rope[int]) Rope[int] {
+			for i := 100; i < 1000; i++ {
+				r = r.Insert(r.Len(), i)
+			}
+			return r
+		}, seq(0, 1000)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := New(seq(0, 100)...)
+			got := test.edit(r)
+			check(t, got, test.want)
+			// the rope edited is left as it was.
+			check(t, r, seq(0, 100))
+		})
+	}
+}
+
+func TestSliceAndWalk(t *testing.T) {
+	r := New(seq(0, 10)...)
+	if got := r.Slice(3, 6); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("Slice(3, 6) = %v, want [3 4 5]", got)
+	}
+	if got := r.Slice(8, 20); !slices.Equal(got, []int{8, 9}) {
+		t.Errorf("Slice(8, 20) = %v, want [8 9]", got)
+	}
+	var walked []int
+	r.Walk(7, func(i, item int) bool {
+		if i != item {
+			t.Errorf("Walk gave item %d at index %d", item, i)
+		}
+		walked = append(walked, item)
+		return i < 8
+	})
+	if !slices.Equal(walked, []int{7, 8}) {
+		t.Errorf("Walk(7) stopping after 8 = %v, want [7 8]", walked)
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	r := New(1, 2, 3)
+	for name, fn := range map[string]func(){
+		"At(3)":        func() { r.At(3) },
+		"At(-1)":       func() { r.At(-1) },
+		"Set(3)":       func() { r.Set(3, 0) },
+		"Insert(4)":    func() { r.Insert(4, 0) },
+		"Delete(2, 4)": func() { r.Delete(2, 4) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+// run is an item that takes up n indexes.
+type run struct {
+	name string
+	n    int
+}
+
+func (r run) Weight() int { return r.n }
+
+func TestWeighted(t *testing.T) {
+	a, b, c := run{"a", 3}, run{"b", 1}, run{"c", 2}
+	r := New(a, b, c)
+	if r.Len() != 6 {
+		t.Errorf("Len = %d, want 6", r.Len())
+	}
+	for i, want := range []struct {
+		item  run
+		start int
+	}{{a, 0}, {a, 0}, {a, 0}, {b, 3}, {c, 4}, {c, 4}} {
+		if item, start := r.Find(i); item != want.item || start != want.start {
+			t.Errorf("Find(%d) = %v, %d, want %v, %d", i, item, start, want.item, want.start)
+		}
+	}
+	var walked []string
+	r.Walk(2, func(i int, item run) bool {
+		walked = append(walked, fmt.Sprintf("%d %s", i, item.name))
+		return true
+	})
+	if want := []string{"0 a", "3 b", "4 c"}; !slices.Equal(walked, want) {
+		t.Errorf("Walk(2) = %q, want %q", walked, want)
+	}
+	if got := r.Slice(2, 4); !slices.Equal(got, []run{a, b}) {
+		t.Errorf("Slice(2, 4) = %v, want [a b]", got)
+	}
+
+	x := run{"x", 2}
+	for _, test := range []struct {
+		name string
+		got  Rope[run]
+		want []run
+	}{
+		{"insert between items", r.Insert(3, x), []run{a, x, b, c}},
+		{"insert at the end", r.Insert(6, x), []run{a, b, c, x}},
+		{"delete an item", r.Delete(3, 4), []run{a, c}},
+		{"delete items", r.Delete(0, 4), []run{c}},
+		{"set a heavier item", r.Set(4, run{"d", 5}), []run{a, b, {"d", 5}}},
+		{"set a lighter item", r.Set(1, b), []run{b, b, c}},
+	} {
+		got := test.got.Slice(0, test.got.Len())
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: rope = %v, want %v", test.name, got, test.want)
+		}
+		n := 0
+		for _, item := range test.want {
+			n += item.n
+		}
+		if test.got.Len() != n {
+			t.Errorf("%s: Len = %d, want %d", test.name, test.got.Len(), n)
+		}
+		checkNode(t, test.got.root)
+	}
+
+	for name, fn := range map[string]func(){
+		"Insert(2)":    func() { r.Insert(2, x) },
+		"Delete(1, 4)": func() { r.Delete(1, 4) },
+		"Delete(3, 5)": func() { r.Delete(3, 5) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s inside an item didn't panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+// FuzzRope runs the edits encoded in data on a rope and on a slice, which
+// must stay the same.
+func FuzzRope(f *testing.F) {
+	f.Add([]byte{0, 0, 5, 1, 2, 3, 2, 1, 0, 4})
+	f.Add([]byte{0, 0, 200, 1, 10, 100, 0, 50, 30, 1, 0, 255})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r Rope[int]
+		var model []int
+		next := 0
+		for len(data) >= 3 {
+			op, a, b := data[0]%3, int(data[1]), int(data[2])
+			data = data[3:]
+			switch op {
+			case 0:
+				i := a % (len(model) + 1)
+				items := seq(next, next+b)
+				next += b
+				r = r.Insert(i, items...)
+				model = slices.Insert(model, i, items...)
+			case 1:
+				if len(model) == 0 {
+					continue
+				}
+				from := a % len(model)
+				to := from + b%(len(model)-from+1)
+				r = r.Delete(from, to)
+				model = slices.Delete(model, from, to)
+			case 2:
+				if len(model) == 0 {
+					continue
+				}
+				i := a % len(model)
+				r = r.Set(i, -next)
+				model[i] = -next
+				next++
+			}
+			check(t, r, model)
+		}
+	})
+}
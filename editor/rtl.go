@@ -0,0 +1,173 @@
+package editor
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/amirali/virayeshgar/editor/bidi"
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+// updateBidi works out the order the rendered row is shown in, when it has
+// right-to-left text.
+func updateBidi(row *Row) {
+	row.order, row.levels = nil, nil
+	if !bidi.HasRTL(row.render) {
+		return
+	}
+	runes := []rune(row.render)
+	row.levels = bidi.Levels(runes)
+	// reorder whole grapheme clusters, so that marks stay after their
+	// letters.
+	var starts []int
+	var levels []uint8
+	for i := 0; i < len(runes); i = clusterEnd(runes, i) {
+		starts = append(starts, i)
+		levels = append(levels, row.levels[i])
+	}
+	starts = append(starts, len(runes))
+	row.order = make([]int, 0, len(runes))
+	for _, c := range bidi.VisualOrder(levels) {
+		for i := starts[c]; i < starts[c+1]; i++ {
+			row.order = append(row.order, i)
+		}
+	}
+}
+
+// renderIndex returns the index in the render string of the first rune the
+// character at cx is rendered as.
+func (e *Editor) renderIndex(row *Row, cx int) int {
+	i, col := 0, 0
+	for x := 0; x < min(cx, len(row.chars)); {
+		end := clusterEnd(row.chars, x)
+		if row.chars[x] == '\t' {
+			n := e.tabstop() - col%e.tabstop()
+			i += n
+			col += n
+		} else {
+			i += end - x
+			col += clusterWidth(row.chars, x, end)
+		}
+		x = end
+	}
+	return i
+}
+
+// charIndex returns the index of the character rendered as the rune at
+// index i of the render string.
+func (e *Editor) charIndex(row *Row, i int) int {
+	at, col := 0, 0
+	for cx := 0; cx < len(row.chars); {
+		end := clusterEnd(row.chars, cx)
+		n, w := end-cx, clusterWidth(row.chars, cx, end)
+		if row.chars[cx] == '\t' {
+			n = e.tabstop() - col%e.tabstop()
+			w = n
+		}
+		if i < at+n {
+			return cx + min(i-at, end-cx-1)
+		}
+		at += n
+		col += w
+		cx = end
+	}
+	return len(row.chars)
+}
+
+// visualColumn returns the screen column, counted from the start of the
+// row, that the character at cx of a row with right-to-left text is shown
+// at. The end of the row is right after its last character, or on it when
+// that character goes right to left.
+func (e *Editor) visualColumn(row *Row, cx int) int {
+	runes := []rune(row.render)
+	if len(runes) == 0 {
+		return 0
+	}
+	i := clusterStart(runes, min(e.renderIndex(row, cx), len(runes)-1))
+	v := slices.Index(row.order, i)
+	col := 0
+	for u := 0; u < v; {
+		start := row.order[u]
+		end := clusterEnd(runes, start)
+		col += clusterWidth(runes, start, end)
+		u += end - start
+	}
+	if cx >= len(row.chars) && row.levels[i]%2 == 0 {
+		col += clusterWidth(runes, i, clusterEnd(runes, i))
+	}
+	return col
+}
+
+// visibleBidiText works like visibleText for rows with right-to-left text,
+// which are shown in their visual order. The columns it returns are those
+// of the runes in the text, not on the screen.
+func visibleBidiText(row *Row, from, width int) (string, []uint8, []int) {
+	runes := []rune(row.render)
+	colOf := make([]int, len(runes))
+	for i, col := 0, 0; i < len(runes); {
+		end := clusterEnd(runes, i)
+		for j := i; j < end; j++ {
+			colOf[j] = col
+		}
+		col += clusterWidth(runes, i, end)
+		i = end
+	}
+
+	var b strings.Builder
+	var hl []uint8
+	var cols []int
+	vcol, w := 0, 0
+	for v := 0; v < len(row.order); {
+		start := row.order[v]
+		end := clusterEnd(runes, start)
+		cw := clusterWidth(runes, start, end)
+		if vcol >= from {
+			if w+cw > width {
+				break
+			}
+			for j := start; j < end; j++ {
+				b.WriteRune(bidi.Mirror(runes[j], row.levels[j]))
+				hl = append(hl, row.hl[j])
+				cols = append(cols, colOf[j])
+			}
+			w += cw
+		}
+		vcol += cw
+		v += end - start
+	}
+	return b.String(), hl, cols
+}
+
+// visualJump moves the cursor count characters across the screen, to the
+// left when dir is negative and to the right otherwise. In right-to-left
+// text that is the other way through the text than h and l go.
+func visualJump(dir int) func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool) {
+	return func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool) {
+		row := e.row(p.y)
+		if row.order == nil {
+			if dir < 0 {
+				return jumpLeft(e, p, count, hasCount, arg)
+			}
+			return jumpRight(e, p, count, hasCount, arg)
+		}
+		v := slices.Index(row.order, min(e.renderIndex(row, p.x), len(row.order)-1))
+		moved := false
+		for ; count > 0; count-- {
+			// step over all the runes of the character, like the spaces
+			// of a tab.
+			for {
+				v += dir
+				if v < 0 || v >= len(row.order) {
+					return p, moved
+				}
+				cx := clusterStart(row.chars, e.charIndex(row, row.order[v]))
+				if cx != p.x {
+					p.x = cx
+					moved = true
+					break
+				}
+			}
+		}
+		return p, moved
+	}
+}
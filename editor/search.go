@@ -0,0 +1,289 @@
+package editor
+
+import (
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+// IgnoreCase makes searches ignore case. With SmartCase as well, a pattern
+// with an upper case letter in it doesn't.
+var (
+	IgnoreCase = false
+	SmartCase  = false
+)
+
+func init() {
+	motions["n"] = motion{jump: searchJump(1)}
+	motions["N"] = motion{jump: searchJump(-1)}
+	motions["*"] = motion{jump: wordSearchJump(1)}
+	motions["#"] = motion{jump: wordSearchJump(-1)}
+}
+
+// ignoreCase reports whether a search for pattern ignores case, as the
+// options say. An empty pattern stands for the last one.
+func (e *Editor) ignoreCase(pattern string) bool {
+	if pattern == "" {
+		pattern = e.lastPattern
+	}
+	if !IgnoreCase {
+		return false
+	}
+	if !SmartCase {
+		return true
+	}
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+		if r == '\\' {
+			// escapes like \W aren't letters to find.
+			_, next := utf8.DecodeRuneInString(pattern[i+size:])
+			i += size + next
+			continue
+		}
+		if unicode.IsUpper(r) {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+// match is where a search matched in a row: from the character at x up to
+// the one at end.
+type match struct {
+	position
+	end int
+}
+
+// rowMatches returns the matches of re in the row at y.
+func (e *Editor) rowMatches(re *regexp.Regexp, y int) []match {
+	line := string(e.row(y).chars)
+	var matches []match
+	for _, m := range re.FindAllStringIndex(line, -1) {
+		x := utf8.RuneCountInString(line[:m[0]])
+		end := x + utf8.RuneCountInString(line[m[0]:m[1]])
+		matches = append(matches, match{position{x: x, y: y}, end})
+	}
+	return matches
+}
+
+// searchFrom returns the first match of re after p, or before it when dir
+// is -1, going round at the ends of the buffer. It reports whether it went
+// round, and false when nothing matches.
+func (e *Editor) searchFrom(re *regexp.Regexp, p position, dir int) (m match, wrapped, ok bool) {
+	// going round at the end takes the whole file.
+	e.waitLoading()
+	n := e.Rows.Len()
+	for i := 0; i <= n; i++ {
+		y := p.y + dir*i
+		if y < 0 || y >= n {
+			wrapped = true
+			y = (y%n + n) % n
+		}
+		matches := e.rowMatches(re, y)
+		if dir < 0 {
+			matches = reversed(matches)
+		}
+		for _, m := range matches {
+			after := m.x > p.x
+			if dir < 0 {
+				after = m.x < p.x
+			}
+			// the row the search starts on is looked at twice, for the
+			// matches after p first and for the ones before it last.
+			if i == 0 && after || i == n && !after || i > 0 && i < n {
+				return m, wrapped, true
+			}
+		}
+	}
+	return match{}, false, false
+}
+
+// search returns where the count-th match of re after p is, or before it
+// when dir is -1. It tells the user when the search goes round an end of
+// the buffer.
+func (e *Editor) search(re *regexp.Regexp, p position, count, dir int) (position, bool) {
+	wrapped := false
+	for ; count > 0; count-- {
+		m, w, ok := e.searchFrom(re, p, dir)
+		if !ok {
+			e.SetStatusMessage("Pattern not found: %s", e.lastPattern)
+			return p, false
+		}
+		p, wrapped = m.position, wrapped || w
+	}
+	switch {
+	case wrapped && dir > 0:
+		e.SetStatusMessage("search hit BOTTOM, continuing at TOP")
+	case wrapped:
+		e.SetStatusMessage("search hit TOP, continuing at BOTTOM")
+	default:
+		e.SetStatusMessage("%s%s", searchPrefix(dir), e.lastPattern)
+	}
+	return p, true
+}
+
+// searchPrefix returns the key that searches in the direction dir.
+func searchPrefix(dir int) string {
+	if dir < 0 {
+		return "?"
+	}
+	return "/"
+}
+
+// searchJump returns the jump of n, which searches for the last pattern in
+// the direction of the last search, or of N with dir -1, which searches the
+// other way.
+func searchJump(dir int) func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool) {
+	return func(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+		re, err := e.compilePattern("", e.ignoreCase(""))
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+			return p, false
+		}
+		if e.searchBackward {
+			return e.search(re, p, count, -dir)
+		}
+		return e.search(re, p, count, dir)
+	}
+}
+
+// wordSearchJump returns the jump of *, which searches forward for the word
+// under the cursor, or the next one on the line, or of # with dir -1, which
+// searches backward. SmartCase doesn't apply to the word.
+func wordSearchJump(dir int) func(e *Editor, p position, count int, hasCount bool, arg keys.Key) (position, bool) {
+	return func(e *Editor, p position, count int, _ bool, _ keys.Key) (position, bool) {
+		chars := e.row(p.y).chars
+		start := p.x
+		for start < len(chars) && charClass(chars[start], false) != 2 {
+			start++
+		}
+		if start >= len(chars) {
+			e.SetStatusMessage("No string under cursor")
+			return p, false
+		}
+		for start > 0 && charClass(chars[start-1], false) == 2 {
+			start--
+		}
+		end := start
+		for end < len(chars) && charClass(chars[end], false) == 2 {
+			end++
+		}
+		word := string(chars[start:end])
+		pattern := regexp.QuoteMeta(word)
+		if isASCII(word) {
+			// \b only knows of ASCII letters, other words are found
+			// inside longer ones too.
+			pattern = `\b` + pattern + `\b`
+		}
+		re, err := e.compilePattern(pattern, IgnoreCase)
+		if err != nil {
+			e.SetStatusMessage("%s", err)
+			return p, false
+		}
+		e.searchBackward = dir < 0
+		// start at the start of the word, so that # doesn't stop at it.
+		return e.search(re, position{x: start, y: p.y}, count, dir)
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Find asks for a regular expression to search for after the cursor, or
+// before it when dir is -1, and moves the cursor to the match. The match is
+// shown while the pattern is typed, the arrow keys go to the next and the
+// previous ones. Esc moves the cursor back where it was.
+func (e *Editor) Find(dir int) error {
+	saved := e.view
+
+	var re *regexp.Regexp
+	var current match
+	found := false
+	defer func() { e.incSearch, e.currentMatch = nil, nil }()
+
+	onKeyPress := func(query string, k keys.Key) {
+		e.currentMatch = nil
+		switch k {
+		case keys.KeyEnter, keys.EscKey:
+			return
+		case keys.KeyArrowRight, keys.KeyArrowDown:
+			if found {
+				current, _, found = e.searchFrom(re, current.position, 1)
+			}
+		case keys.KeyArrowLeft, keys.KeyArrowUp:
+			if found {
+				current, _, found = e.searchFrom(re, current.position, -1)
+			}
+		default:
+			// patterns that don't compile yet, like "(", match nothing.
+			var err error
+			re, err = regexp.Compile(caseFlags(e.ignoreCase(query)) + query)
+			found, e.incSearch = false, nil
+			if query != "" && err == nil {
+				e.incSearch = re
+				current, _, found = e.searchFrom(re, position{x: saved.cx, y: saved.cy}, dir)
+			}
+		}
+		if !found {
+			e.view = saved
+			return
+		}
+		e.cy, e.cx = current.y, current.x
+		// set rowOffset to bottom so that the next scroll() will scroll
+		// upwards and the matching line will be at the top of the screen
+		e.rowOffset = e.Rows.Len()
+		e.currentMatch = &current
+	}
+
+	prompt := "Search: %s (ESC = cancel | Enter = confirm | Arrows = prev/next)"
+	if dir < 0 {
+		prompt = "Search backward: %s (ESC = cancel | Enter = confirm | Arrows = prev/next)"
+	}
+	query, err := e.Prompt(prompt, onKeyPress)
+	if err != nil {
+		// restore cursor position when the user cancels search
+		e.view = saved
+		return err
+	}
+	if _, err := regexp.Compile(query); err != nil {
+		e.view = saved
+		e.SetStatusMessage("%s", err)
+		return nil
+	}
+	e.lastPattern = query
+	e.noHighlight = false
+	e.searchBackward = dir < 0
+	if !found {
+		e.view = saved
+		e.SetStatusMessage("Pattern not found: %s", query)
+		return nil
+	}
+	start := position{x: saved.cx, y: saved.cy}
+	switch {
+	case dir > 0 && !start.less(current.position):
+		e.SetStatusMessage("search hit BOTTOM, continuing at TOP")
+	case dir < 0 && !current.less(start):
+		e.SetStatusMessage("search hit TOP, continuing at BOTTOM")
+	default:
+		e.SetStatusMessage("%s%s", searchPrefix(dir), query)
+	}
+	return nil
+}
+
+// caseFlags returns the flags a regular expression starts with to ignore
+// case, if it does.
+func caseFlags(ignoreCase bool) string {
+	if ignoreCase {
+		return "(?i)"
+	}
+	return ""
+}
@@ -0,0 +1,327 @@
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+// substitution is a parsed :s/pattern/replacement/flags command.
+type substitution struct {
+	re          *regexp.Regexp
+	replacement string
+	// global replaces every match on a line rather than the first one,
+	// confirm asks before each replacement and countOnly counts the
+	// matches without replacing them.
+	global, confirm, countOnly bool
+}
+
+// parseSubstitute parses the arguments of :s, the pattern, the replacement
+// and the flags between delimiters, like /pattern/replacement/g. It returns
+// what follows the flags, the count. With no arguments it substitutes the
+// last pattern with the last replacement again.
+func (e *Editor) parseSubstitute(arg string) (substitution, string, error) {
+	var sub substitution
+	pattern, replacement := "", e.lastReplacement
+	rest := ""
+	if arg != "" {
+		delim, size := utf8.DecodeRuneInString(arg)
+		if unicode.IsLetter(delim) || unicode.IsDigit(delim) || unicode.IsSpace(delim) || delim == '\\' || delim == '"' || delim == '|' {
+			return sub, "", errors.New("Regular expressions can't be delimited by letters")
+		}
+		var fields []string
+		fields, rest = splitDelimited(arg[size:], delim, 2)
+		pattern = fields[0]
+		replacement = ""
+		if len(fields) > 1 {
+			replacement = fields[1]
+		}
+	}
+
+	ignoreCase := e.ignoreCase(pattern)
+	i := 0
+	for ; i < len(rest) && strings.IndexByte("gciIn", rest[i]) >= 0; i++ {
+		switch rest[i] {
+		case 'g':
+			sub.global = true
+		case 'c':
+			sub.confirm = true
+		case 'i':
+			ignoreCase = true
+		case 'I':
+			ignoreCase = false
+		case 'n':
+			sub.countOnly = true
+		}
+	}
+	re, err := e.compilePattern(pattern, ignoreCase)
+	if err != nil {
+		return sub, "", err
+	}
+	sub.re = re
+	sub.replacement = replacement
+	e.lastReplacement = replacement
+	return sub, strings.TrimSpace(rest[i:]), nil
+}
+
+// splitDelimited splits s at the first n delimiters that aren't escaped with
+// a backslash, returning the fields and what follows the last delimiter. A
+// delimiter escaped in the first field, the pattern, loses its backslash.
+func splitDelimited(s string, delim rune, n int) ([]string, string) {
+	var fields []string
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == '\\' && i+size < len(s) {
+			next, nsize := utf8.DecodeRuneInString(s[i+size:])
+			if next != delim || len(fields) > 0 {
+				b.WriteRune(r)
+			}
+			b.WriteRune(next)
+			i += size + nsize
+			continue
+		}
+		i += size
+		if r == delim {
+			fields = append(fields, b.String())
+			b.Reset()
+			if len(fields) == n {
+				return fields, s[i:]
+			}
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return append(fields, b.String()), ""
+}
+
+// expandReplacement returns what a match of re in src, with the submatch
+// indexes m, is replaced with. In the replacement & and \0 stand for the
+// whole match, \1 to \9, $1 and ${name} for groups, \r and \n for a line
+// break and \t for a tab. \u and \l change the case of the next character,
+// \U and \L of all of them up to \E.
+func expandReplacement(re *regexp.Regexp, replacement, src string, m []int) string {
+	var b strings.Builder
+	// one is the case change of the next character, all the one up to \E.
+	var one, all byte
+	emit := func(s string) {
+		for _, r := range s {
+			switch {
+			case one == 'u':
+				r = unicode.ToUpper(r)
+			case one == 'l':
+				r = unicode.ToLower(r)
+			case all == 'U':
+				r = unicode.ToUpper(r)
+			case all == 'L':
+				r = unicode.ToLower(r)
+			}
+			one = 0
+			b.WriteRune(r)
+		}
+	}
+	group := func(i int) string {
+		if i < 0 || 2*i+1 >= len(m) || m[2*i] < 0 {
+			return ""
+		}
+		return src[m[2*i]:m[2*i+1]]
+	}
+
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			switch d := replacement[i]; {
+			case isDigit(d):
+				emit(group(int(d - '0')))
+			case d == 'u' || d == 'l':
+				one = d
+			case d == 'U' || d == 'L':
+				all = d
+			case d == 'E' || d == 'e':
+				all = 0
+			case d == 'r' || d == 'n':
+				emit("\n")
+			case d == 't':
+				emit("\t")
+			default:
+				// an escaped character stands for itself, like \& or \\.
+				_, size := utf8.DecodeRuneInString(replacement[i:])
+				emit(replacement[i : i+size])
+				i += size - 1
+			}
+		case c == '&':
+			emit(group(0))
+		case c == '$' && i+1 < len(replacement):
+			j := i + 1
+			switch {
+			case replacement[j] == '$':
+				emit("$")
+				i = j
+			case isDigit(replacement[j]):
+				for j < len(replacement) && isDigit(replacement[j]) {
+					j++
+				}
+				n, _ := strconv.Atoi(replacement[i+1 : j])
+				emit(group(n))
+				i = j - 1
+			case replacement[j] == '{':
+				end := strings.IndexByte(replacement[j:], '}')
+				if end < 0 {
+					emit("$")
+					break
+				}
+				name := replacement[j+1 : j+end]
+				n := re.SubexpIndex(name)
+				if number, err := strconv.Atoi(name); err == nil {
+					n = number
+				}
+				emit(group(n))
+				i = j + end
+			default:
+				emit("$")
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(replacement[i:])
+			emit(replacement[i : i+size])
+			i += size - 1
+		}
+	}
+	return b.String()
+}
+
+// Substitute runs :[range]s/pattern/replacement/[flags] [count] on the
+// lines of cmd. The whole substitution is a single change to undo.
+func (e *Editor) Substitute(cmd exCommand) error {
+	sub, rest, err := e.parseSubstitute(cmd.arg)
+	if err != nil {
+		return err
+	}
+	if rest != "" {
+		if err := e.exCount(&cmd, rest); err != nil {
+			return err
+		}
+	}
+	n := 1
+	if sub.global {
+		n = -1
+	}
+
+	matches, lines := 0, 0
+	for y := cmd.from; y <= cmd.to; y++ {
+		if found := len(sub.re.FindAllStringIndex(string(e.row(y).chars), n)); found > 0 {
+			matches += found
+			lines++
+		}
+	}
+	if matches == 0 {
+		return fmt.Errorf("Pattern not found: %s", e.lastPattern)
+	}
+	if sub.countOnly {
+		e.SetStatusMessage("%d matches on %d lines", matches, lines)
+		return nil
+	}
+
+	// all is set once there is no need to ask anymore, quit once the user
+	// asks to stop.
+	all, quit := !sub.confirm, false
+	replaced, lines, last := 0, 0, -1
+	to := cmd.to
+	e.change(cmd.from, cmd.to, func() {
+		for y := cmd.from; y <= to && !quit; y++ {
+			line := string(e.row(y).chars)
+			var b strings.Builder
+			done := 0 // the end of the text of the line copied to b
+			changed := false
+			for _, m := range sub.re.FindAllStringSubmatchIndex(line, n) {
+				replace := true
+				if !all {
+					replace, all, quit = e.confirmSubstitute(y, b.String()+line[done:], utf8.RuneCountInString(b.String()+line[done:m[0]]), utf8.RuneCountInString(line[m[0]:m[1]]))
+				}
+				if quit && !replace {
+					break
+				}
+				if !replace {
+					continue
+				}
+				b.WriteString(line[done:m[0]])
+				b.WriteString(expandReplacement(sub.re, sub.replacement, line, m))
+				done = m[1]
+				replaced++
+				changed = true
+				if quit {
+					break
+				}
+			}
+			if !changed {
+				if sub.confirm {
+					// the line was shown with the replacements asked about.
+					e.setRowText(y, line)
+				}
+				continue
+			}
+			b.WriteString(line[done:])
+			parts := strings.Split(b.String(), "\n")
+			e.setRowText(y, parts[0])
+			for i, part := range parts[1:] {
+				e.InsertRow(y+1+i, part)
+			}
+			lines++
+			y += len(parts) - 1
+			to += len(parts) - 1
+			last = y
+		}
+	})
+	if last >= 0 {
+		e.cy = last
+		e.cx = e.firstNonBlank(last)
+	}
+	e.SetStatusMessage("%d substitutions on %d lines", replaced, lines)
+	return nil
+}
+
+// setRowText sets the text of the row at y.
+func (e *Editor) setRowText(y int, text string) {
+	row := e.row(y)
+	row.chars = []rune(text)
+	e.updateRow(y)
+}
+
+// confirmSubstitute shows the row at y with the given text, the n runes from
+// the rune at index at highlighted as the match to replace, and asks the
+// user whether to replace it: y replaces it, n skips it, a replaces it and
+// all the matches after it, l replaces it and stops, q and Esc stop.
+func (e *Editor) confirmSubstitute(y int, text string, at, n int) (replace, all, quit bool) {
+	e.setRowText(y, text)
+	e.cy = y
+	e.cx = at
+	e.currentMatch = &match{position{x: at, y: y}, at + n}
+	defer func() { e.currentMatch = nil }()
+	for {
+		e.SetStatusMessage("replace with %s (y/n/a/q/l)?", e.lastReplacement)
+		e.Render()
+		k, err := e.readKey()
+		if err != nil {
+			return false, false, true
+		}
+		switch k {
+		case 'y':
+			return true, false, false
+		case 'n':
+			return false, false, false
+		case 'a':
+			return true, true, false
+		case 'l':
+			return true, false, true
+		case 'q', keys.EscKey:
+			return false, false, true
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// TabPage is a set of windows filling the screen. The tab line at the top
+// lists the tab pages once there is more than one.
+type TabPage struct {
+	layout *frame
+	// win is the current window of the tab page, kept while another tab
+	// page is shown.
+	win *Window
+}
+
+// tabIndex returns where the current tab page is in the tab list.
+func (e *Editor) tabIndex() int {
+	return slices.Index(e.tabs, e.TabPage)
+}
+
+// allWindows returns the windows of every tab page.
+func (e *Editor) allWindows() []*Window {
+	var ws []*Window
+	for _, t := range e.tabs {
+		ws = append(ws, t.layout.windows()...)
+	}
+	return ws
+}
+
+// showTab makes t the current tab page.
+func (e *Editor) showTab(t *TabPage) {
+	if t == e.TabPage {
+		return
+	}
+	e.commitUndo()
+	e.Buffer.lastView = e.view
+	e.TabPage.win = e.Window
+	e.TabPage = t
+	e.Window = t.win
+	e.layoutWindows()
+	e.clampCursor()
+}
+
+// NewTab opens a tab page after the current one. Its window shows filename,
+// or an empty buffer when filename is empty.
+func (e *Editor) NewTab(filename string) error {
+	w := newWindow(e.Buffer)
+	w.view = e.view
+	t := &TabPage{layout: w.frame, win: w}
+	e.tabs = slices.Insert(e.tabs, e.tabIndex()+1, t)
+	e.showTab(t)
+	if filename == "" {
+		e.showBuffer(e.newBuffer(""))
+		return nil
+	}
+	return e.EditFile(filename, true)
+}
+
+// CloseTab closes t. The last tab page can't be closed.
+func (e *Editor) CloseTab(t *TabPage) error {
+	if len(e.tabs) == 1 {
+		return errors.New("Cannot close last tab page")
+	}
+	i := slices.Index(e.tabs, t)
+	if t == e.TabPage {
+		// the tab page after takes its place, or the one before for the
+		// last tab page.
+		next := i + 1
+		if next == len(e.tabs) {
+			next = i - 1
+		}
+		e.showTab(e.tabs[next])
+	}
+	e.tabs = slices.Delete(e.tabs, i, i+1)
+	// the tab line goes away with the second to last tab page.
+	e.layoutWindows()
+	return nil
+}
+
+// GotoTab makes the tab page with the given number, counting from one, the
+// current one.
+func (e *Editor) GotoTab(number int) error {
+	if number < 1 || number > len(e.tabs) {
+		return fmt.Errorf("Tab page %d does not exist", number)
+	}
+	e.showTab(e.tabs[number-1])
+	return nil
+}
+
+// NextTab moves count tab pages forward, or backward when count is
+// negative, going round at the ends.
+func (e *Editor) NextTab(count int) {
+	n := len(e.tabs)
+	e.showTab(e.tabs[((e.tabIndex()+count)%n+n)%n])
+}
+
+func init() {
+	normalCommands["gt"] = func(e *Editor, count int) error {
+		if e.hasCount {
+			return e.GotoTab(count)
+		}
+		e.NextTab(1)
+		return nil
+	}
+	normalCommands["gT"] = func(e *Editor, count int) error {
+		e.NextTab(-count)
+		return nil
+	}
+}
+
+// tabLineRows returns the number of rows the tab line takes at the top of
+// the screen.
+func (e *Editor) tabLineRows() int {
+	if len(e.tabs) > 1 {
+		return 1
+	}
+	return 0
+}
+
+// drawTabLine draws the labels of the tab pages, the current one standing
+// out of the inverted line.
+func (e *Editor) drawTabLine(b *strings.Builder) {
+	if e.tabLineRows() == 0 {
+		return
+	}
+	b.WriteString("\x1b[H")
+	width := 0
+	for _, t := range e.tabs {
+		w := t.win
+		if t == e.TabPage {
+			w = e.Window
+		}
+		name := "[No Name]"
+		if w.filename != "" {
+			name = filepath.Base(w.filename)
+		}
+		label := " "
+		if n := len(t.layout.windows()); n > 1 {
+			label += strconv.Itoa(n)
+		}
+		if w.dirty > 0 {
+			label += "+"
+		}
+		if label != " " {
+			label += " "
+		}
+		label += name + " "
+		label = runewidth.Truncate(label, e.termCols-width, "")
+		if t == e.TabPage {
+			b.WriteString("\x1b[1m") // bold
+		} else {
+			b.WriteString("\x1b[7m") // inverted colors
+		}
+		b.WriteString(label)
+		b.WriteString("\x1b[m")
+		width += runewidth.StringWidth(label)
+	}
+	b.WriteString("\x1b[7m")
+	b.WriteString(strings.Repeat(" ", max(e.termCols-width, 0)))
+	b.WriteString("\x1b[m")
+}
+
+// tabCommand runs the tab page commands. It reports false for other
+// commands.
+func (e *Editor) tabCommand(name string, args []string) (bool, error) {
+	arg := strings.Join(args, " ")
+	switch name {
+	case "tabnew", "tabe", "tabedit":
+		return true, e.NewTab(arg)
+	case "tabc", "tabclose":
+		if arg == "" {
+			return true, e.CloseTab(e.TabPage)
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(e.tabs) {
+			return true, fmt.Errorf("Invalid tab page %q", arg)
+		}
+		return true, e.CloseTab(e.tabs[n-1])
+	case "tabn", "tabnext":
+		if arg == "" {
+			e.NextTab(1)
+			return true, nil
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return true, fmt.Errorf("Invalid tab page %q", arg)
+		}
+		return true, e.GotoTab(n)
+	case "tabp", "tabprevious", "tabN", "tabNext":
+		n := 1
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil {
+				return true, fmt.Errorf("Invalid count %q", arg)
+			}
+		}
+		e.NextTab(-n)
+		return true, nil
+	}
+	return false, nil
+}
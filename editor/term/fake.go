@@ -0,0 +1,89 @@
+package term
+
+// Fake is a terminal in memory. It keeps a Screen of what the editor draws,
+// and hands out the keys typed with Type as input.
+type Fake struct {
+	*Screen
+
+	input []byte
+	// waiting counts the reads in a row that found no keys.
+	waiting int
+
+	// Idle, when set, is called when the editor waits for keys and there
+	// are none left. The first read that finds none is taken for a pause
+	// in typing, Idle is called on the next.
+	Idle func()
+
+	resized chan struct{}
+}
+
+// NewFake returns a blank fake terminal of the given size.
+func NewFake(rows, cols int) *Fake {
+	f := &Fake{Screen: NewScreen(rows, cols), resized: make(chan struct{}, 1)}
+	f.answer = func(answer string) {
+		// the answer comes before the keys still waiting to be read.
+		f.input = append([]byte(answer), f.input...)
+	}
+	return f
+}
+
+// Type types keys, written the way the terminal sends them: "\x1b" for Esc,
+// "\r" for Enter or "\x1b[A" for the up arrow.
+func (f *Fake) Type(keys string) {
+	f.input = append(f.input, keys...)
+	f.waiting = 0
+}
+
+// Pending reports whether there are keys typed that weren't read yet.
+func (f *Fake) Pending() bool {
+	return len(f.input) > 0
+}
+
+// Read reads the keys typed. With none left it returns no bytes, like a
+// real terminal in raw mode when nothing was typed for a while. Enter comes
+// in as a newline, as MakeRaw leaves carriage returns translated.
+func (f *Fake) Read(p []byte) (int, error) {
+	if len(f.input) == 0 {
+		f.waiting++
+		if f.waiting > 1 && f.Idle != nil {
+			f.Idle()
+		}
+		return 0, nil
+	}
+	f.waiting = 0
+	n := copy(p, f.input)
+	f.input = f.input[n:]
+	for i, b := range p[:n] {
+		if b == '\r' {
+			p[i] = '\n'
+		}
+	}
+	return n, nil
+}
+
+func (f *Fake) MakeRaw() error {
+	return nil
+}
+
+func (f *Fake) Restore() error {
+	return nil
+}
+
+func (f *Fake) Size() (rows, cols int, err error) {
+	rows, cols = f.Screen.Size()
+	return rows, cols, nil
+}
+
+func (f *Fake) Resized() <-chan struct{} {
+	return f.resized
+}
+
+// Resize changes the size of the screen, keeping what fits of it, and lets
+// the editor know.
+func (f *Fake) Resize(rows, cols int) {
+	f.Screen.Resize(rows, cols)
+	select {
+	case f.resized <- struct{}{}:
+	default:
+	}
+}
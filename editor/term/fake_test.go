@@ -0,0 +1,55 @@
+package term
+
+import (
+	"io"
+	"testing"
+)
+
+func TestFakeWrite(t *testing.T) {
+	f := NewFake(3, 10)
+	io.WriteString(f, "hello\x1b[2;3Hwo\x1b[7mr\x1b[27mld")
+	io.WriteString(f, "\x1b[1;4H\x1b[K")
+	io.WriteString(f, "\x1b[3;1H\x1b[0;90mab\x1b[1;7mc\x1b[22;39md\x1b[m")
+	if got, want := f.String(), "hel\n  world\nabcd\n"; got != want {
+		t.Errorf("screen = %q, want %q", got, want)
+	}
+	if f.Cell(1, 4).Style != "7" || f.Cell(1, 5).Style != "" {
+		t.Errorf("only the r should be reversed")
+	}
+	for col, want := range []string{"90", "90", "1;7;90", "7"} {
+		if got := f.Cell(2, col).Style; got != want {
+			t.Errorf("style of cell %d = %q, want %q", col, got, want)
+		}
+	}
+	if row, col := f.Cursor(); row != 2 || col != 4 {
+		t.Errorf("cursor at %d,%d, want 2,4", row, col)
+	}
+}
+
+func TestFakeWideAndCombining(t *testing.T) {
+	f := NewFake(1, 10)
+	// the output can stop in the middle of a character.
+	b := []byte("中éx")
+	f.Write(b[:2])
+	f.Write(b[2:])
+	if got, want := f.Line(0), "中éx"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+	if got := f.Cell(0, 1).Text; got != "" {
+		t.Errorf("right half of a wide character = %q, want empty", got)
+	}
+	if _, col := f.Cursor(); col != 4 {
+		t.Errorf("cursor at column %d, want 4", col)
+	}
+}
+
+func TestFakeCursorReport(t *testing.T) {
+	f := NewFake(5, 10)
+	f.Type("j")
+	io.WriteString(f, "\x1b[3;4H\x1b[6n")
+	b := make([]byte, 16)
+	n, _ := f.Read(b)
+	if got, want := string(b[:n]), "\x1b[3;4Rj"; got != want {
+		t.Errorf("input = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,387 @@
+package term
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// Cell is a cell of a Screen.
+type Cell struct {
+	// Text is the character in the cell with its combining marks, a space
+	// when the cell is blank and empty when it is the right half of a wide
+	// character.
+	Text string
+	// Style is the graphic rendition the cell is drawn with, written as
+	// the parameters of the SGR escape sequence that sets it, like "1;92"
+	// or "7". It is empty for the default.
+	Style string
+}
+
+// style is a graphic rendition, set with SGR escape sequences.
+type style struct {
+	bold, dim, reverse bool
+	// fg is the code of the foreground color, zero for the default.
+	fg int
+}
+
+func (s style) String() string {
+	var params []string
+	if s.bold {
+		params = append(params, "1")
+	}
+	if s.dim {
+		params = append(params, "2")
+	}
+	if s.reverse {
+		params = append(params, "7")
+	}
+	if s.fg != 0 {
+		params = append(params, strconv.Itoa(s.fg))
+	}
+	return strings.Join(params, ";")
+}
+
+// Screen is a model of the cells of a terminal screen, kept up to date
+// with the text and escape sequences written to it. It understands the
+// escape sequences the editor uses and ignores the others.
+type Screen struct {
+	rows, cols int
+	cells      [][]Cell
+	// row and col are the cursor, counted from zero.
+	row, col int
+	style    style
+
+	// out keeps the end of the output when it stops in the middle of a
+	// character or an escape sequence.
+	out []byte
+
+	// answer, when set, gets what the terminal answers to the queries
+	// written to it.
+	answer func(string)
+}
+
+// NewScreen returns a blank screen of the given size.
+func NewScreen(rows, cols int) *Screen {
+	s := &Screen{}
+	s.Resize(rows, cols)
+	return s
+}
+
+// Size returns the number of rows and columns of the screen.
+func (s *Screen) Size() (rows, cols int) {
+	return s.rows, s.cols
+}
+
+// Resize changes the size of the screen, keeping what fits of it.
+func (s *Screen) Resize(rows, cols int) {
+	cells := make([][]Cell, rows)
+	for y := range cells {
+		cells[y] = make([]Cell, cols)
+		for x := range cells[y] {
+			if y < s.rows && x < s.cols {
+				cells[y][x] = s.cells[y][x]
+			} else {
+				cells[y][x] = Cell{Text: " "}
+			}
+		}
+	}
+	s.rows, s.cols, s.cells = rows, cols, cells
+	s.row, s.col = min(s.row, rows-1), min(s.col, cols)
+}
+
+// Cell returns the cell at the given row and column, counted from zero.
+func (s *Screen) Cell(row, col int) Cell {
+	return s.cells[row][col]
+}
+
+// Cursor returns the row and column of the cursor, counted from zero.
+func (s *Screen) Cursor() (row, col int) {
+	return s.row, s.col
+}
+
+// Line returns the text on a row of the screen, without the blanks at its
+// end.
+func (s *Screen) Line(row int) string {
+	var b strings.Builder
+	for _, c := range s.cells[row] {
+		b.WriteString(c.Text)
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// String returns the text on the screen, a line for each row.
+func (s *Screen) String() string {
+	lines := make([]string, s.rows)
+	for y := range lines {
+		lines[y] = s.Line(y)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Write draws p on the screen. It understands the escape sequences the
+// editor uses and ignores the others.
+func (s *Screen) Write(p []byte) (int, error) {
+	s.out = append(s.out, p...)
+	for len(s.out) > 0 {
+		if s.out[0] == '\x1b' {
+			n := sequenceLen(s.out)
+			if n == 0 {
+				break
+			}
+			s.escape(string(s.out[:n]))
+			s.out = s.out[n:]
+			continue
+		}
+		if !utf8.FullRune(s.out) {
+			break
+		}
+		r, size := utf8.DecodeRune(s.out)
+		s.out = s.out[size:]
+		s.put(r)
+	}
+	return len(p), nil
+}
+
+// sequenceLen returns the length of the escape sequence b starts with, or
+// zero when b ends before it does.
+func sequenceLen(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	if b[1] != '[' {
+		return 2
+	}
+	for i := 2; i < len(b); i++ {
+		if b[i] >= 0x40 && b[i] <= 0x7e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (s *Screen) put(r rune) {
+	switch r {
+	case '\r':
+		s.col = 0
+		return
+	case '\n':
+		s.lineFeed()
+		return
+	case '\b':
+		s.col = max(s.col-1, 0)
+		return
+	}
+	w := runewidth.RuneWidth(r)
+	if w == 0 {
+		// a combining mark goes with the character before it.
+		x := s.col - 1
+		for x > 0 && s.cells[s.row][x].Text == "" {
+			x--
+		}
+		if x >= 0 {
+			s.cells[s.row][x].Text += string(r)
+		}
+		return
+	}
+	if s.col+w > s.cols {
+		s.col = 0
+		s.lineFeed()
+	}
+	style := s.style.String()
+	s.cells[s.row][s.col] = Cell{Text: string(r), Style: style}
+	if w == 2 && s.col+1 < s.cols {
+		s.cells[s.row][s.col+1] = Cell{Style: style}
+	}
+	s.col += w
+}
+
+// lineFeed moves the cursor down a row, scrolling the screen up at the
+// bottom.
+func (s *Screen) lineFeed() {
+	if s.row+1 < s.rows {
+		s.row++
+		return
+	}
+	copy(s.cells, s.cells[1:])
+	s.cells[s.rows-1] = make([]Cell, s.cols)
+	s.clear(s.rows-1, 0, s.cols)
+}
+
+// clear blanks the cells of a row from one column up to another.
+func (s *Screen) clear(row, from, to int) {
+	for x := from; x < to; x++ {
+		s.cells[row][x] = Cell{Text: " "}
+	}
+}
+
+func (s *Screen) escape(seq string) {
+	if len(seq) < 3 {
+		return
+	}
+	final := seq[len(seq)-1]
+	params := seq[2 : len(seq)-1]
+	if strings.HasPrefix(params, "?") {
+		// private modes, like showing the cursor.
+		return
+	}
+	args := strings.Split(params, ";")
+	arg := func(i, def int) int {
+		if i >= len(args) || args[i] == "" {
+			return def
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil {
+			return def
+		}
+		return n
+	}
+
+	switch final {
+	case 'H':
+		s.row = min(max(arg(0, 1), 1), s.rows) - 1
+		s.col = min(max(arg(1, 1), 1), s.cols) - 1
+	case 'A':
+		s.row = max(s.row-arg(0, 1), 0)
+	case 'B':
+		s.row = min(s.row+arg(0, 1), s.rows-1)
+	case 'C':
+		s.col = min(s.col+arg(0, 1), s.cols-1)
+	case 'D':
+		s.col = max(s.col-arg(0, 1), 0)
+	case 'J':
+		if arg(0, 0) == 2 {
+			for y := range s.cells {
+				s.clear(y, 0, s.cols)
+			}
+		}
+	case 'K':
+		s.clear(s.row, min(s.col, s.cols), s.cols)
+	case 'm':
+		for i := range args {
+			switch n := arg(i, 0); {
+			case n == 0:
+				s.style = style{}
+			case n == 1:
+				s.style.bold = true
+			case n == 2:
+				s.style.dim = true
+			case n == 7:
+				s.style.reverse = true
+			case n == 22:
+				s.style.bold, s.style.dim = false, false
+			case n == 27:
+				s.style.reverse = false
+			case n >= 30 && n <= 37, n >= 90 && n <= 97:
+				s.style.fg = n
+			case n == 39:
+				s.style.fg = 0
+			}
+		}
+	case 'n':
+		if arg(0, 0) == 6 {
+			if s.answer != nil {
+				s.answer(fmt.Sprintf("\x1b[%d;%dR", s.row+1, s.col+1))
+			}
+		}
+	}
+}
+
+// Diff returns what to write to a terminal showing prev, a screen of the
+// same size, for it to show s. Only the cells that changed are drawn, going
+// from one to the next with the shortest cursor movement and changing the
+// style only when it differs, and the cursor ends up where it is on s. The
+// terminal is taken to be in the default style and is left in it.
+func (s *Screen) Diff(prev *Screen) string {
+	var b strings.Builder
+	// row and col are the cursor of the terminal, col is -1 when it isn't
+	// known, like after drawing in the last column.
+	row, col := prev.row, prev.col
+	style := ""
+	drawn := false
+	for y := range s.cells {
+		for x := 0; x < s.cols; x++ {
+			c := s.cells[y][x]
+			if c.Text == "" || !s.changed(prev, y, x) {
+				continue
+			}
+			if !drawn {
+				drawn = true
+				b.WriteString("\x1b[?25l") // hide the cursor
+			}
+			if row != y || col != x {
+				b.WriteString(s.move(row, col, y, x, style))
+			}
+			if c.Style != style {
+				style = c.Style
+				if style == "" {
+					b.WriteString("\x1b[m")
+				} else {
+					fmt.Fprintf(&b, "\x1b[0;%sm", style)
+				}
+			}
+			b.WriteString(c.Text)
+			row, col = y, x+s.width(y, x)
+			if col >= s.cols {
+				col = -1
+			}
+		}
+	}
+	if style != "" {
+		b.WriteString("\x1b[m")
+	}
+	if row != s.row || col != s.col {
+		fmt.Fprintf(&b, "\x1b[%d;%dH", s.row+1, s.col+1)
+	}
+	if drawn {
+		b.WriteString("\x1b[?25h") // show the cursor
+	}
+	return b.String()
+}
+
+// changed reports whether the character at the given cell has to be drawn
+// again for a terminal showing prev to show s: when it or the right half of
+// it differs.
+func (s *Screen) changed(prev *Screen, row, col int) bool {
+	if s.cells[row][col] != prev.cells[row][col] {
+		return true
+	}
+	return s.width(row, col) == 2 && s.cells[row][col+1] != prev.cells[row][col+1]
+}
+
+// width returns the number of columns the character at the given cell
+// takes.
+func (s *Screen) width(row, col int) int {
+	if col+1 < s.cols && s.cells[row][col+1].Text == "" {
+		return 2
+	}
+	return 1
+}
+
+// move returns the shortest way to move the cursor from one cell to
+// another: jumping to it, moving forward or, drawn in the given style, the
+// characters already on the screen in between.
+func (s *Screen) move(fromRow, fromCol, row, col int, style string) string {
+	best := fmt.Sprintf("\x1b[%d;%dH", row+1, col+1)
+	if fromRow != row || fromCol < 0 || fromCol > col || s.cells[row][fromCol].Text == "" {
+		return best
+	}
+	if forward := fmt.Sprintf("\x1b[%dC", col-fromCol); len(forward) < len(best) {
+		best = forward
+	}
+	var b strings.Builder
+	for x := fromCol; x < col; x++ {
+		c := s.cells[row][x]
+		if c.Style != style {
+			return best
+		}
+		b.WriteString(c.Text)
+	}
+	if b.Len() < len(best) {
+		best = b.String()
+	}
+	return best
+}
@@ -0,0 +1,36 @@
+package term
+
+import (
+	"io"
+	"testing"
+)
+
+func TestScreenDiff(t *testing.T) {
+	prev := NewScreen(3, 10)
+	io.WriteString(prev, "hello\x1b[2;1H中文 text\x1b[3;1H\x1b[7mbar\x1b[m")
+	next := NewScreen(3, 10)
+	io.WriteString(next, "help\x1b[2;1H中x text\x1b[3;1H\x1b[7mbaz\x1b[m\x1b[1;2H")
+
+	// a terminal showing prev shows next once it gets the diff.
+	f := NewScreen(3, 10)
+	io.WriteString(f, "hello\x1b[2;1H中文 text\x1b[3;1H\x1b[7mbar\x1b[m")
+	diff := next.Diff(prev)
+	io.WriteString(f, diff)
+	if got, want := f.String(), next.String(); got != want {
+		t.Errorf("screen = %q, want %q", got, want)
+	}
+	for row := range 3 {
+		for col := range 10 {
+			if got, want := f.Cell(row, col), next.Cell(row, col); got != want {
+				t.Errorf("cell %d,%d = %q, want %q", row, col, got, want)
+			}
+		}
+	}
+	if row, col := f.Cursor(); row != 0 || col != 1 {
+		t.Errorf("cursor at %d,%d, want 0,1", row, col)
+	}
+
+	if diff := next.Diff(next); diff != "" {
+		t.Errorf("diff of the same screen = %q, want nothing", diff)
+	}
+}
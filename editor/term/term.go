@@ -0,0 +1,25 @@
+// Package term is the terminal the editor runs in: the real one, or a fake
+// one tests can type keys into and read the screen from.
+package term
+
+import "io"
+
+// Terminal is what the editor reads keys from and draws on.
+type Terminal interface {
+	// Read reads the bytes of the keys typed. It returns no bytes when
+	// nothing was typed for a while.
+	// Write writes text and escape sequences to the screen.
+	io.ReadWriter
+
+	// MakeRaw puts the terminal in raw mode and Restore takes it back to
+	// the mode it was in before.
+	MakeRaw() error
+	Restore() error
+
+	// Size returns the number of rows and columns of the terminal.
+	Size() (rows, cols int, err error)
+
+	// Resized returns a channel that gets a value when the terminal is
+	// resized.
+	Resized() <-chan struct{}
+}
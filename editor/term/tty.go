@@ -0,0 +1,99 @@
+package term
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/amirali/virayeshgar/tools"
+)
+
+// TTY is the terminal of the process, on its standard input and output.
+type TTY struct {
+	in, out     *os.File
+	origTermios *unix.Termios
+
+	signals chan os.Signal
+	resized chan struct{}
+
+	// restoreOnce makes Restore safe to call again, it keeps the error of
+	// the first call in restoreErr.
+	restoreOnce sync.Once
+	restoreErr  error
+}
+
+// NewTTY returns the terminal reading keys from in and drawing on out.
+func NewTTY(in, out *os.File) *TTY {
+	return &TTY{in: in, out: out, resized: make(chan struct{}, 1)}
+}
+
+func (t *TTY) Read(p []byte) (int, error) {
+	return t.in.Read(p)
+}
+
+func (t *TTY) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+// MakeRaw turns off echoing and line editing. Reads wait for a tenth of a
+// second at most.
+func (t *TTY) MakeRaw() error {
+	termios, err := unix.IoctlGetTermios(int(t.in.Fd()), ioctlReadTermios)
+	if err != nil {
+		return err
+	}
+	raw := *termios
+	raw.Iflag &^= unix.BRKINT | unix.INPCK | unix.ISTRIP | unix.IXON
+	raw.Cflag |= unix.CS8
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 0
+	raw.Cc[unix.VTIME] = 1
+	if err := unix.IoctlSetTermios(int(t.in.Fd()), ioctlWriteTermios, &raw); err != nil {
+		return err
+	}
+	t.origTermios = termios
+
+	t.signals = make(chan os.Signal, 1)
+	signal.Notify(t.signals, unix.SIGWINCH)
+	go func(signals chan os.Signal) {
+		for range signals {
+			select {
+			case t.resized <- struct{}{}:
+			default:
+			}
+		}
+	}(t.signals)
+	return nil
+}
+
+func (t *TTY) Restore() error {
+	if t.origTermios == nil {
+		return fmt.Errorf("raw mode is not enabled")
+	}
+	t.restoreOnce.Do(func() {
+		signal.Stop(t.signals)
+		close(t.signals)
+		t.restoreErr = unix.IoctlSetTermios(int(t.in.Fd()), ioctlWriteTermios, t.origTermios)
+	})
+	return t.restoreErr
+}
+
+// Size asks the terminal for its size, or when it can't tell, moves the
+// cursor to the bottom right corner and asks where it ended up.
+func (t *TTY) Size() (rows, cols int, err error) {
+	ws, err := unix.IoctlGetWinsize(int(t.out.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 {
+		if _, err = t.out.Write([]byte("\x1b[999C\x1b[999B")); err != nil {
+			return 0, 0, err
+		}
+		return tools.GetCursorPosition(t.in, t.out)
+	}
+	return int(ws.Row), int(ws.Col), nil
+}
+
+func (t *TTY) Resized() <-chan struct{} {
+	return t.resized
+}
@@ -1,8 +1,6 @@
-package editor
+package term
 
 import "golang.org/x/sys/unix"
 
 const ioctlReadTermios = unix.TCGETS
 const ioctlWriteTermios = unix.TCSETS
-
-const NullBufferPath = "/dev/null"
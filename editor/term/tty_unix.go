@@ -1,11 +1,9 @@
 //go:build darwin
 // +build darwin
 
-package editor
+package term
 
 import "golang.org/x/sys/unix"
 
 const ioctlReadTermios = unix.TIOCGETA
 const ioctlWriteTermios = unix.TIOCSETA
-
-const NullBufferPath = "/dev/null"
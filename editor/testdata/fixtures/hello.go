@@ -0,0 +1,12 @@
+package main
+
+import "fmt"
+
+/* greet says hello to name. */
+func greet(name string) string {
+	return "hello, " + name // a comment
+}
+
+func main() {
+	fmt.Println(greet("world"), 42, 3.14)
+}
@@ -0,0 +1,11 @@
+-- greet says hello to name.
+local function greet(name)
+  return "hello, " .. name
+end
+
+--[[ a long
+comment --]]
+local n = 42
+if n > 10 then
+  print(greet('world'), n, nil, true)
+end
@@ -0,0 +1,11 @@
+# greet says hello to name.
+def greet(name):
+    return "hello, " + name
+
+
+class Greeter:
+    def __init__(self, n=42):
+        self.n = n
+
+if __name__ == "__main__":
+    print(greet('world'), None, True, 3.14)
@@ -0,0 +1,220 @@
+package editor
+
+// textObject selects the text around p, like a word or the inside of a pair
+// of brackets. With around set it includes the surrounding white space or
+// delimiters. It reports false when there is nothing to select.
+type textObject func(e *Editor, p position, count int, around bool) (region, bool)
+
+var textObjects = map[string]textObject{
+	"w":  wordObject(false),
+	"W":  wordObject(true),
+	"\"": quoteObject('"'),
+	"'":  quoteObject('\''),
+	"`":  quoteObject('`'),
+	"(":  bracketObject('(', ')'),
+	")":  bracketObject('(', ')'),
+	"b":  bracketObject('(', ')'),
+	"[":  bracketObject('[', ']'),
+	"]":  bracketObject('[', ']'),
+	"{":  bracketObject('{', '}'),
+	"}":  bracketObject('{', '}'),
+	"B":  bracketObject('{', '}'),
+	"<":  bracketObject('<', '>'),
+	">":  bracketObject('<', '>'),
+	"p":  paragraphObject,
+}
+
+func wordObject(big bool) textObject {
+	return func(e *Editor, p position, count int, around bool) (region, bool) {
+		chars := e.row(p.y).chars
+		if len(chars) == 0 {
+			return region{}, false
+		}
+		x := min(p.x, len(chars)-1)
+		class := charClass(chars[x], big)
+		start, end := x, x+1
+		for start > 0 && charClass(chars[start-1], big) == class {
+			start--
+		}
+		for end < len(chars) && charClass(chars[end], big) == class {
+			end++
+		}
+		// every count after the first takes in the next word or run of
+		// blanks.
+		for ; count > 1 && end < len(chars); count-- {
+			class := charClass(chars[end], big)
+			for end < len(chars) && charClass(chars[end], big) == class {
+				end++
+			}
+		}
+		if around {
+			if class == 0 {
+				// on blanks, "aw" takes the following word along.
+				if end < len(chars) {
+					class := charClass(chars[end], big)
+					for end < len(chars) && charClass(chars[end], big) == class {
+						end++
+					}
+				}
+			} else {
+				n := end
+				for n < len(chars) && charClass(chars[n], big) == 0 {
+					n++
+				}
+				if n > end {
+					end = n
+				} else {
+					for start > 0 && charClass(chars[start-1], big) == 0 {
+						start--
+					}
+				}
+			}
+		}
+		return region{kind: charwise, start: position{x: start, y: p.y}, end: position{x: end, y: p.y}}, true
+	}
+}
+
+func quoteObject(quote rune) textObject {
+	return func(e *Editor, p position, _ int, around bool) (region, bool) {
+		chars := e.row(p.y).chars
+		var quotes []int
+		for i, r := range chars {
+			if r == quote && (i == 0 || chars[i-1] != '\\') {
+				quotes = append(quotes, i)
+			}
+		}
+		// quotes pair up from the start of the line; pick the pair the
+		// cursor is in, or else the first one after it.
+		open, close := -1, -1
+		for i := 0; i+1 < len(quotes); i += 2 {
+			if p.x <= quotes[i+1] {
+				open, close = quotes[i], quotes[i+1]
+				break
+			}
+		}
+		if open == -1 {
+			return region{}, false
+		}
+		start, end := open+1, close
+		if around {
+			start, end = open, close+1
+			n := end
+			for n < len(chars) && charClass(chars[n], false) == 0 {
+				n++
+			}
+			if n > end {
+				end = n
+			} else {
+				for start > 0 && charClass(chars[start-1], false) == 0 {
+					start--
+				}
+			}
+		}
+		return region{kind: charwise, start: position{x: start, y: p.y}, end: position{x: end, y: p.y}}, true
+	}
+}
+
+func bracketObject(open, close rune) textObject {
+	return func(e *Editor, p position, count int, around bool) (region, bool) {
+		var start, end position
+		for ; count > 0; count-- {
+			var ok bool
+			if start, ok = e.findOpenBracket(p, open, close); !ok {
+				return region{}, false
+			}
+			if end, ok = e.findCloseBracket(start, open, close); !ok {
+				return region{}, false
+			}
+			if p, ok = e.prevPos(start); !ok && count > 1 {
+				return region{}, false
+			}
+		}
+		if around {
+			end.x++
+			return region{kind: charwise, start: start, end: end}, true
+		}
+		start.x++
+		if start.x >= len(e.row(start.y).chars) && end.y > start.y {
+			// the bracket ends its line, so the inside starts on the next
+			// one, and ends on the line before a closing bracket that only
+			// has white space in front of it.
+			start = position{x: 0, y: start.y + 1}
+			if end.x <= e.firstNonBlank(end.y) && end.y > start.y {
+				end = position{x: len(e.row(end.y - 1).chars), y: end.y - 1}
+			}
+		}
+		return region{kind: charwise, start: start, end: end}, true
+	}
+}
+
+func (e *Editor) charAt(p position) (rune, bool) {
+	chars := e.row(p.y).chars
+	if p.x < 0 || p.x >= len(chars) {
+		return 0, false
+	}
+	return chars[p.x], true
+}
+
+// findOpenBracket looks backward from p for the open bracket that isn't
+// closed before p.
+func (e *Editor) findOpenBracket(p position, open, close rune) (position, bool) {
+	depth := 0
+	for first := true; ; first = false {
+		if r, ok := e.charAt(p); ok {
+			switch {
+			case r == open && depth == 0:
+				return p, true
+			case r == open:
+				depth--
+			case r == close && !first:
+				depth++
+			}
+		}
+		var ok bool
+		if p, ok = e.prevPos(p); !ok {
+			return p, false
+		}
+	}
+}
+
+// findCloseBracket looks forward from the open bracket at p for the bracket
+// that closes it.
+func (e *Editor) findCloseBracket(p position, open, close rune) (position, bool) {
+	depth := 0
+	for {
+		var ok bool
+		if p, ok = e.nextPos(p); !ok {
+			return p, false
+		}
+		if r, ok := e.charAt(p); ok {
+			switch {
+			case r == close && depth == 0:
+				return p, true
+			case r == close:
+				depth--
+			case r == open:
+				depth++
+			}
+		}
+	}
+}
+
+func paragraphObject(e *Editor, p position, count int, around bool) (region, bool) {
+	blank := e.isBlankRow(p.y)
+	start, end := p.y, p.y
+	for start > 0 && e.isBlankRow(start-1) == blank {
+		start--
+	}
+	for ; count > 0; count-- {
+		for end+1 < e.Rows.Len() && e.isBlankRow(end+1) == blank {
+			end++
+		}
+		if around || count > 1 {
+			// take in the following run of lines of the other kind.
+			for end+1 < e.Rows.Len() && e.isBlankRow(end+1) != blank {
+				end++
+			}
+		}
+	}
+	return region{kind: linewise, start: position{y: start}, end: position{y: end}}, true
+}
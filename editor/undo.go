@@ -0,0 +1,389 @@
+package editor
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// undoChange replaces the rows starting at at, which read before, with the
+// rows in after.
+type undoChange struct {
+	at     int
+	before []string
+	after  []string
+}
+
+// UndoNode is a state of the buffer in the undo tree. It holds the changes
+// that lead to it from its parent state.
+type UndoNode struct {
+	// seq numbers the states in the order they were created, the root
+	// being 0.
+	seq      int
+	parent   *UndoNode
+	children []*UndoNode
+	// redo is the child Ctrl-R moves to, the one last created or visited.
+	redo    *UndoNode
+	changes []undoChange
+	// cursor is where the cursor was before the changes were made.
+	cursor position
+	// marks are the marks from before the changes, or after them once
+	// they were undone, for undo and redo to put back. Marks of deleted
+	// lines are gone otherwise.
+	marks map[rune]position
+	// time is when the state was created.
+	time time.Time
+	// save is the number of the last write of the file made in this state,
+	// zero when it was never written.
+	save int
+}
+
+type undoTree struct {
+	root *UndoNode
+	cur  *UndoNode
+	// nodes lists every state by its seq.
+	nodes []*UndoNode
+	// pending collects the changes of the command being run, they become
+	// a new state once it's over.
+	pending *UndoNode
+	// depth is above zero while nested changes are made, which are already
+	// recorded by the outermost one.
+	depth int
+	// saves counts the writes of the file.
+	saves int
+}
+
+func newUndoTree() undoTree {
+	root := &UndoNode{time: time.Now()}
+	return undoTree{root: root, cur: root, nodes: []*UndoNode{root}}
+}
+
+// rowStrings returns the text of rows from..to.
+func (e *Editor) rowStrings(from, to int) []string {
+	lines := make([]string, 0, max(to-from+1, 0))
+	for y := from; y <= to; y++ {
+		lines = append(lines, string(e.row(y).chars))
+	}
+	return lines
+}
+
+// change runs fn, which edits rows from..to and is free to grow or shrink
+// that span of rows, and records the edit in the undo tree. A to below from
+// means fn only inserts rows at from.
+func (e *Editor) change(from, to int, fn func()) {
+	e.dirty++
+	e.changes++
+	if e.undoTree.depth > 0 {
+		fn()
+		return
+	}
+	before := e.rowStrings(from, to)
+	marks := maps.Clone(e.marks)
+	n := e.Rows.Len()
+	e.undoTree.depth++
+	fn()
+	e.undoTree.depth--
+	after := e.rowStrings(from, to+e.Rows.Len()-n)
+	e.recordChange(undoChange{at: from, before: before, after: after}, marks)
+}
+
+// recordChange adds c to the changes of the command being run. marks are
+// the marks from before c, kept for undo when c is its first change.
+func (e *Editor) recordChange(c undoChange, marks map[rune]position) {
+	t := &e.undoTree
+	if t.pending == nil {
+		t.pending = &UndoNode{cursor: position{x: e.cx, y: e.cy}, marks: marks}
+	}
+	if n := len(t.pending.changes); n > 0 {
+		// typing on a line keeps replacing that same line, only keep the
+		// latest text.
+		last := &t.pending.changes[n-1]
+		if last.at == c.at && len(last.after) == 1 && len(c.before) == 1 && len(c.after) == 1 && last.after[0] == c.before[0] {
+			last.after = c.after
+			return
+		}
+	}
+	t.pending.changes = append(t.pending.changes, c)
+}
+
+// commitUndo turns the changes of the last command into a new state in the
+// undo tree.
+func (e *Editor) commitUndo() {
+	t := &e.undoTree
+	node := t.pending
+	if node == nil {
+		return
+	}
+	t.pending = nil
+	node.seq = len(t.nodes)
+	node.time = time.Now()
+	node.parent = t.cur
+	t.cur.children = append(t.cur.children, node)
+	t.cur.redo = node
+	t.cur = node
+	t.nodes = append(t.nodes, node)
+}
+
+// applyChanges replays the changes of node, backwards when undoing.
+func (e *Editor) applyChanges(node *UndoNode, undo bool) {
+	e.undoTree.depth++
+	defer func() { e.undoTree.depth-- }()
+
+	changes := slices.Clone(node.changes)
+	if undo {
+		slices.Reverse(changes)
+	}
+	marks := maps.Clone(e.marks)
+	for _, c := range changes {
+		before, after := c.before, c.after
+		if undo {
+			before, after = after, before
+		}
+		// lines that are still there get their text replaced, which
+		// keeps the marks on them.
+		common := min(len(before), len(after))
+		e.change(c.at, c.at+common-1, func() {
+			for i, line := range after[:common] {
+				e.setRowText(c.at+i, line)
+			}
+		})
+		for range before[common:] {
+			e.DeleteRow(c.at + common)
+		}
+		for i, line := range after[common:] {
+			e.InsertRow(c.at+common+i, line)
+		}
+	}
+	for name, p := range node.marks {
+		if e.marks == nil {
+			e.marks = make(map[rune]position)
+		}
+		e.marks[name] = p
+	}
+	node.marks = marks
+	e.cx, e.cy = node.cursor.x, node.cursor.y
+	e.clampCursor()
+}
+
+func (e *Editor) Undo() {
+	t := &e.undoTree
+	e.commitUndo()
+	if t.cur == t.root {
+		e.SetStatusMessage("oldest version")
+		return
+	}
+	node := t.cur
+	e.applyChanges(node, true)
+	t.cur = node.parent
+	t.cur.redo = node
+	e.SetStatusMessage("undo: state %d of %d", t.cur.seq, len(t.nodes)-1)
+}
+
+func (e *Editor) Redo() {
+	t := &e.undoTree
+	e.commitUndo()
+	if t.cur.redo == nil {
+		e.SetStatusMessage("newest version")
+		return
+	}
+	node := t.cur.redo
+	e.applyChanges(node, false)
+	t.cur = node
+	e.SetStatusMessage("redo: state %d of %d", t.cur.seq, len(t.nodes)-1)
+}
+
+// undoGoto moves the buffer to the state target, undoing up to the state
+// both it and the current state come from and redoing down from there.
+func (e *Editor) undoGoto(target *UndoNode) {
+	t := &e.undoTree
+	e.commitUndo()
+
+	ancestors := map[*UndoNode]bool{}
+	for n := t.cur; n != nil; n = n.parent {
+		ancestors[n] = true
+	}
+	var path []*UndoNode
+	common := target
+	for !ancestors[common] {
+		path = append(path, common)
+		common = common.parent
+	}
+
+	for t.cur != common {
+		e.applyChanges(t.cur, true)
+		t.cur.parent.redo = t.cur
+		t.cur = t.cur.parent
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		e.applyChanges(path[i], false)
+		t.cur.redo = path[i]
+		t.cur = path[i]
+	}
+}
+
+// UndoStep moves count states forward in time, or back when count is
+// negative, regardless of the branch the states are on.
+func (e *Editor) UndoStep(count int) {
+	t := &e.undoTree
+	e.commitUndo()
+	seq := max(0, min(t.cur.seq+count, len(t.nodes)-1))
+	if seq == t.cur.seq {
+		if count < 0 {
+			e.SetStatusMessage("oldest version")
+		} else {
+			e.SetStatusMessage("newest version")
+		}
+		return
+	}
+	e.undoGoto(t.nodes[seq])
+	e.SetStatusMessage("state %d of %d", seq, len(t.nodes)-1)
+}
+
+// markSaved records that the current state was just written to the file.
+func (e *Editor) markSaved() {
+	t := &e.undoTree
+	e.commitUndo()
+	t.saves++
+	t.cur.save = t.saves
+}
+
+// lastSave returns the number of the last write at or before the current
+// state.
+func (t *undoTree) lastSave() int {
+	save := 0
+	for _, n := range t.nodes[:t.cur.seq+1] {
+		save = max(save, n.save)
+	}
+	return save
+}
+
+// UndoTime moves the buffer back or forward in time by arg, which is a
+// count followed by a unit: s, m, h or d for seconds, minutes, hours or days,
+// or f for writes of the file. A count alone moves that many states, like
+// g- and g+.
+func (e *Editor) UndoTime(arg string, forward bool) error {
+	t := &e.undoTree
+	e.commitUndo()
+
+	arg = strings.TrimSpace(arg)
+	unit := byte(0)
+	if arg != "" && (arg[len(arg)-1] < '0' || arg[len(arg)-1] > '9') {
+		unit = arg[len(arg)-1]
+		arg = arg[:len(arg)-1]
+	}
+	count := 1
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid count %q", arg)
+		}
+		count = n
+	}
+
+	var target *UndoNode
+	switch unit {
+	case 0:
+		if !forward {
+			count = -count
+		}
+		e.UndoStep(count)
+		return nil
+
+	case 's', 'm', 'h', 'd':
+		d := time.Duration(count) * map[byte]time.Duration{
+			's': time.Second,
+			'm': time.Minute,
+			'h': time.Hour,
+			'd': 24 * time.Hour,
+		}[unit]
+		if !forward {
+			d = -d
+		}
+		// the state the buffer was in at that time is the newest one
+		// created by then.
+		when := t.cur.time.Add(d)
+		target = t.root
+		for _, n := range t.nodes {
+			if !n.time.After(when) {
+				target = n
+			}
+		}
+
+	case 'f':
+		save := t.lastSave()
+		if forward {
+			save += count
+		} else {
+			save -= count
+			if t.cur.save == 0 && count > 0 {
+				// with changes since the last write, going back one write
+				// returns to that write.
+				save++
+			}
+		}
+		switch {
+		case save <= 0:
+			target = t.root
+		case save > t.saves:
+			target = t.nodes[len(t.nodes)-1]
+		default:
+			// a state written more than once only keeps its last write,
+			// so settle for the closest write before.
+			target = t.root
+			for _, n := range t.nodes {
+				if n.save != 0 && n.save <= save && n.save > target.save {
+					target = n
+				}
+			}
+		}
+
+	default:
+		return fmt.Errorf("invalid unit %q", unit)
+	}
+
+	if target == t.cur {
+		if forward {
+			e.SetStatusMessage("newest version")
+		} else {
+			e.SetStatusMessage("oldest version")
+		}
+		return nil
+	}
+	e.undoGoto(target)
+	e.SetStatusMessage("state %d of %d, %s", target.seq, len(t.nodes)-1, timeAgo(target.time))
+	return nil
+}
+
+// timeAgo describes how long ago t was.
+func timeAgo(t time.Time) string {
+	d := time.Since(t)
+	if d < 100*time.Second {
+		return fmt.Sprintf("%d seconds ago", int(d.Seconds()))
+	}
+	if d < 12*time.Hour {
+		return t.Format("15:04:05")
+	}
+	return t.Format("2006/01/02 15:04:05")
+}
+
+// undoList describes the leaves of the undo tree, the last state of every
+// branch.
+func (e *Editor) undoList() string {
+	var leaves []string
+	for _, n := range e.undoTree.nodes {
+		if len(n.children) == 0 && n != e.undoTree.root {
+			leaf := fmt.Sprintf("%d (%d changes, %s", n.seq, len(n.changes), timeAgo(n.time))
+			if n.save != 0 {
+				leaf += fmt.Sprintf(", write %d", n.save)
+			}
+			leaves = append(leaves, leaf+")")
+		}
+	}
+	if len(leaves) == 0 {
+		return "Nothing to undo"
+	}
+	return "number changes: " + strings.Join(leaves, ", ")
+}
@@ -0,0 +1,162 @@
+package editor
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UndoDir is the directory undo histories are kept in between sessions. An
+// empty UndoDir turns persistent undo off.
+var UndoDir = defaultUndoDir()
+
+func defaultUndoDir() string {
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(state, "virayeshgar", "undo")
+}
+
+// undoFile is the on-disk form of an undo tree. Nodes are stored by seq and
+// refer to each other by index.
+type undoFile struct {
+	// Hash is the sha256 sum of the file the history belongs to, as it was
+	// when the history was written.
+	Hash  [sha256.Size]byte
+	Cur   int
+	Saves int
+	Nodes []undoFileNode
+}
+
+type undoFileNode struct {
+	Parent  int
+	Redo    int
+	CursorX int
+	CursorY int
+	Time    time.Time
+	Save    int
+	Changes []undoFileChange
+}
+
+type undoFileChange struct {
+	At     int
+	Before []string
+	After  []string
+}
+
+// undoFilePath returns where the undo history of filename is kept, which is
+// named after its absolute path with the slashes replaced by percent signs.
+func undoFilePath(filename string) (string, error) {
+	if UndoDir == "" {
+		return "", errors.New("no undo directory")
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(UndoDir, strings.ReplaceAll(abs, string(filepath.Separator), "%")), nil
+}
+
+// writeUndoFile stores the undo tree for the file just written, whose
+// content hashes to sum.
+func (e *Editor) writeUndoFile(sum [sha256.Size]byte) error {
+	path, err := undoFilePath(e.filename)
+	if err != nil {
+		return err
+	}
+	t := &e.undoTree
+
+	uf := undoFile{Hash: sum, Cur: t.cur.seq, Saves: t.saves}
+	for _, n := range t.nodes {
+		fn := undoFileNode{Parent: -1, Redo: -1, CursorX: n.cursor.x, CursorY: n.cursor.y, Time: n.time, Save: n.save}
+		if n.parent != nil {
+			fn.Parent = n.parent.seq
+		}
+		if n.redo != nil {
+			fn.Redo = n.redo.seq
+		}
+		for _, c := range n.changes {
+			fn.Changes = append(fn.Changes, undoFileChange{At: c.at, Before: c.before, After: c.after})
+		}
+		uf.Nodes = append(uf.Nodes, fn)
+	}
+
+	if err := os.MkdirAll(UndoDir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(UndoDir, ".undo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(uf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readUndoFile restores the undo tree of the file just opened, provided its
+// content hashes to hash. A history written for other content is ignored.
+func (e *Editor) readUndoFile(hash [sha256.Size]byte) error {
+	path, err := undoFilePath(e.filename)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var uf undoFile
+	if err := gob.NewDecoder(f).Decode(&uf); err != nil {
+		return err
+	}
+	if uf.Hash != hash {
+		return errors.New("file changed since the undo history was written")
+	}
+	if len(uf.Nodes) == 0 || uf.Cur < 0 || uf.Cur >= len(uf.Nodes) {
+		return errors.New("corrupt undo history")
+	}
+
+	nodes := make([]*UndoNode, len(uf.Nodes))
+	for i := range nodes {
+		nodes[i] = &UndoNode{seq: i}
+	}
+	for i, fn := range uf.Nodes {
+		n := nodes[i]
+		n.cursor = position{x: fn.CursorX, y: fn.CursorY}
+		n.time, n.save = fn.Time, fn.Save
+		for _, c := range fn.Changes {
+			n.changes = append(n.changes, undoChange{at: c.At, before: c.Before, after: c.After})
+		}
+		if i == 0 {
+			continue
+		}
+		if fn.Parent < 0 || fn.Parent >= i {
+			return errors.New("corrupt undo history")
+		}
+		n.parent = nodes[fn.Parent]
+		n.parent.children = append(n.parent.children, n)
+	}
+	for i, fn := range uf.Nodes {
+		if fn.Redo > 0 && fn.Redo < len(nodes) {
+			nodes[i].redo = nodes[fn.Redo]
+		}
+	}
+	e.undoTree = undoTree{root: nodes[0], cur: nodes[uf.Cur], nodes: nodes, saves: uf.Saves}
+	return nil
+}
@@ -0,0 +1,314 @@
+package editor
+
+import (
+	"slices"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+	modes "github.com/amirali/virayeshgar/editor/modes"
+)
+
+// visualSelection remembers the bounds of a visual selection after the
+// editor leaves visual mode, so that commands like :'<,'> can refer to it.
+type visualSelection struct {
+	mode   modes.Mode
+	anchor position
+	cursor position
+}
+
+// blockInsert describes text typed on the first line of a visual block that
+// has to be repeated on the other lines once insert mode ends.
+type blockInsert struct {
+	top    int
+	bottom int
+	// render column the text is inserted at.
+	rx int
+	// cx on the top row where insertion started.
+	cx int
+	// pad short lines with spaces instead of skipping them.
+	pad bool
+}
+
+// visualRegion returns the region covered by the visual selection between
+// the anchor and the cursor.
+func (e *Editor) visualRegion(sel visualSelection) region {
+	start, end := sel.anchor, sel.cursor
+	if end.less(start) {
+		start, end = end, start
+	}
+	start.y, end.y = e.clampY(start.y), e.clampY(end.y)
+
+	switch sel.mode {
+	case modes.VisualLineMode:
+		return region{kind: linewise, start: start, end: end}
+	case modes.VisualBlockMode:
+		a, c := e.clampPosition(sel.anchor), e.clampPosition(sel.cursor)
+		left := min(e.rowCxToRx(e.row(a.y), a.x), e.rowCxToRx(e.row(c.y), c.x))
+		right := max(e.rxEnd(e.row(a.y), a.x), e.rxEnd(e.row(c.y), c.x))
+		return region{kind: blockwise, start: position{x: left, y: start.y}, end: position{x: right, y: end.y}}
+	default:
+		row := e.row(end.y)
+		switch {
+		case end.x < len(row.chars):
+			end.x = clusterEnd(row.chars, end.x)
+		case end.y+1 < e.Rows.Len():
+			// the selection includes the end of the line.
+			end = position{x: 0, y: end.y + 1}
+		default:
+			end.x = len(row.chars)
+		}
+		return region{kind: charwise, start: start, end: end}
+	}
+}
+
+// clampPosition keeps p inside the text of the buffer.
+func (e *Editor) clampPosition(p position) position {
+	p.y = e.clampY(p.y)
+	p.x = max(0, min(p.x, len(e.row(p.y).chars)))
+	return p
+}
+
+// rxEnd returns the render column right after the character at cx.
+func (e *Editor) rxEnd(row *Row, cx int) int {
+	if cx < len(row.chars) {
+		return e.rowCxToRx(row, clusterEnd(row.chars, cx))
+	}
+	return e.rowCxToRx(row, cx) + 1
+}
+
+func (e *Editor) currentSelection() visualSelection {
+	return visualSelection{
+		mode:   e.mode,
+		anchor: e.anchor,
+		cursor: position{x: e.cx, y: e.cy},
+	}
+}
+
+// visualSpan returns the render columns of filerow that are selected, from
+// inclusive and to exclusive.
+func (e *Editor) visualSpan(filerow int) (from, to int, ok bool) {
+	if !e.mode.IsVisual() || e.Rows.Len() == 0 {
+		return 0, 0, false
+	}
+	r := e.visualRegion(e.currentSelection())
+	if filerow < r.start.y || filerow > r.end.y {
+		return 0, 0, false
+	}
+	row := e.row(filerow)
+	width := e.rowCxToRx(row, len(row.chars))
+	switch r.kind {
+	case linewise:
+		return 0, width, true
+	case blockwise:
+		return r.start.x, r.end.x, true
+	default:
+		from, to = 0, width
+		if filerow == r.start.y {
+			from = e.rowCxToRx(row, min(r.start.x, len(row.chars)))
+		}
+		if filerow == r.end.y {
+			to = e.rowCxToRx(row, min(r.end.x, len(row.chars)))
+		}
+		return from, to, true
+	}
+}
+
+// exitVisualMode remembers the current selection and goes back to normal
+// mode.
+func (e *Editor) exitVisualMode() {
+	e.lastVisual = e.currentSelection()
+	e.SetMode(modes.NormalMode)
+}
+
+func (e *Editor) ProcessKeyVisualMode() error {
+	k, err := e.readKey()
+	if err != nil {
+		return err
+	}
+	k = e.mapKey(k, true)
+	if k == keys.EscKey && len(e.motionRegister) > 0 {
+		e.motionRegister = []keys.Key{}
+	} else if len(e.motionRegister) > 0 || !e.visualCommand(k) {
+		e.motionRegister = append(e.motionRegister, k)
+		if err := e.executeVisualMotion(); err != nil {
+			e.SetStatusMessage(err.Error())
+		}
+	}
+
+	e.quitCounter = 0
+	return nil
+}
+
+// visualCommand runs the visual mode command bound to k, reporting false
+// if there is none.
+func (e *Editor) visualCommand(k keys.Key) bool {
+	switch k {
+	case keys.ModeKeySmallV, keys.ModeKeyCapitalV, keys.ModeKeyCtrlV:
+		mode := map[keys.Key]modes.Mode{
+			keys.ModeKeySmallV:   modes.VisualMode,
+			keys.ModeKeyCapitalV: modes.VisualLineMode,
+			keys.ModeKeyCtrlV:    modes.VisualBlockMode,
+		}[k]
+		if mode == e.mode {
+			e.exitVisualMode()
+		} else {
+			e.mode = mode
+			e.SetStatusMessage(mode.StatusMessage)
+		}
+
+	case 'o':
+		e.anchor, e.cx, e.cy = position{x: e.cx, y: e.cy}, e.anchor.x, e.anchor.y
+
+	case keys.EscKey:
+		e.exitVisualMode()
+
+	case keys.MotionKeyD, keys.ModeKeyX:
+		r := e.visualRegion(e.currentSelection())
+		e.exitVisualMode()
+		e.deleteRegion(r)
+
+	case keys.MotionKeyY:
+		r := e.visualRegion(e.currentSelection())
+		e.exitVisualMode()
+		e.yankRegion(r)
+		e.cy = r.start.y
+		if r.kind == charwise {
+			e.cx = r.start.x
+		}
+
+	case 'c':
+		r := e.visualRegion(e.currentSelection())
+		e.exitVisualMode()
+		e.changeRegion(r)
+		if r.kind == blockwise {
+			e.startBlockInsert(r, r.start.x, false)
+		}
+		e.SetMode(modes.InsertMode)
+
+	case 'I', keys.ModeKeyCapitalA:
+		if e.mode != modes.VisualBlockMode {
+			break
+		}
+		r := e.visualRegion(e.currentSelection())
+		e.exitVisualMode()
+		rx, pad := r.start.x, false
+		if k == keys.ModeKeyCapitalA {
+			rx, pad = r.end.x, true
+		}
+		row := e.row(r.start.y)
+		e.cy = r.start.y
+		e.cx = e.rowRxToCx(row, rx)
+		e.startBlockInsert(r, rx, pad)
+		e.SetMode(modes.InsertMode)
+
+	case '>', '<':
+		r := e.visualRegion(e.currentSelection())
+		e.exitVisualMode()
+		dir := 1
+		if k == '<' {
+			dir = -1
+		}
+		e.indentRegion(r, dir)
+
+	case '~':
+		r := e.visualRegion(e.currentSelection())
+		e.exitVisualMode()
+		e.caseRegion(r, toggleCase)
+
+	case keys.ModeKeyCol:
+		e.lastVisual = e.currentSelection()
+		e.mode = modes.CommandMode
+		e.command = "'<,'>"
+		e.SetStatusMessage(e.command)
+
+	default:
+		return false
+	}
+	return true
+}
+
+// executeVisualMotion runs the motion typed so far into the motion register,
+// moving the cursor and with it the end of the selection. Text objects
+// select the text they cover.
+func (e *Editor) executeVisualMotion() error {
+	cmd, err := parseCommand(e.motionRegister, true)
+	if err == errIncompleteCommand {
+		return nil
+	}
+	e.motionRegister = []keys.Key{}
+	if err != nil {
+		return err
+	}
+
+	count := max(cmd.count, 1)
+	cursor := e.clampPosition(position{x: e.cx, y: e.cy})
+	if cmd.textObject != "" {
+		r, ok := textObjects[cmd.textObject](e, cursor, count, cmd.around)
+		if !ok {
+			return nil
+		}
+		if r.kind == linewise && e.mode != modes.VisualLineMode {
+			e.mode = modes.VisualLineMode
+			e.SetStatusMessage(e.mode.StatusMessage)
+		}
+		e.anchor = r.start
+		e.cx, e.cy = r.end.x-1, r.end.y
+		if e.cx > 0 {
+			e.cx = clusterStart(e.row(e.cy).chars, e.cx)
+		}
+		if r.kind == charwise && e.cx < 0 {
+			// the object ends with a line break, select up to the end of
+			// the previous line.
+			e.cy--
+			e.cx = len(e.row(e.cy).chars)
+		}
+		return nil
+	}
+
+	m := motions[cmd.motion]
+	jump := m.jump
+	if m.visual != nil {
+		jump = m.visual
+	}
+	target, ok := jump(e, cursor, count, cmd.hasCount, cmd.arg)
+	if ok {
+		e.cx, e.cy = target.x, target.y
+		e.clampCursor()
+	}
+	return nil
+}
+
+func (e *Editor) startBlockInsert(r region, rx int, pad bool) {
+	if r.kind != blockwise || r.start.y == r.end.y {
+		return
+	}
+	e.blockInsert = &blockInsert{top: r.start.y, bottom: r.end.y, rx: rx, cx: e.cx, pad: pad}
+}
+
+// finishBlockInsert repeats the text typed on the first line of a visual
+// block on all the other lines of the block.
+func (e *Editor) finishBlockInsert() {
+	b := e.blockInsert
+	e.blockInsert = nil
+	if e.cy != b.top || e.cx <= b.cx {
+		return
+	}
+	text := e.row(b.top).chars[b.cx:e.cx]
+	bottom := min(b.bottom, e.Rows.Len()-1)
+	e.change(b.top+1, bottom, func() {
+		for y := b.top + 1; y <= bottom; y++ {
+			row := e.row(y)
+			width := e.rowCxToRx(row, len(row.chars))
+			if width < b.rx {
+				if !b.pad {
+					continue
+				}
+				for ; width < b.rx; width++ {
+					row.chars = append(row.chars, ' ')
+				}
+			}
+			at := e.rowRxToCx(row, b.rx)
+			row.chars = append(row.chars[:at], append(slices.Clone(text), row.chars[at:]...)...)
+			e.updateRow(y)
+		}
+	})
+}
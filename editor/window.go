@@ -0,0 +1,538 @@
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	keys "github.com/amirali/virayeshgar/editor/keys"
+)
+
+var ErrNoRoom = errors.New("Not enough room")
+
+// Window is a viewport onto a buffer, with its own cursor and scroll
+// position.
+type Window struct {
+	*Buffer
+	view
+	rx int
+
+	// top and left are where the window is on the screen. screenRows and
+	// screenCols are the size of its text, the status line below it left
+	// out.
+	top, left              int
+	screenRows, screenCols int
+
+	frame *frame
+}
+
+// frame is a part of the screen, either a single window or a stack or a row
+// of frames.
+type frame struct {
+	parent *frame
+	// win is the window of a frame with no children.
+	win *Window
+	// vertical frames put their children side by side with a separator
+	// column in between, other frames stack them.
+	vertical bool
+	children []*frame
+	// the size of the frame on the screen, status lines included.
+	rows, cols int
+}
+
+const (
+	// minWindowRows is the height of the smallest window, a line of text
+	// and the status line.
+	minWindowRows = 2
+	minWindowCols = 1
+)
+
+// newWindow returns a window showing b in a frame of its own.
+func newWindow(b *Buffer) *Window {
+	w := &Window{Buffer: b, view: b.lastView}
+	w.frame = &frame{win: w}
+	return w
+}
+
+// size returns the size of f along the direction its parent lays it out.
+func (f *frame) size() int {
+	if f.parent != nil && f.parent.vertical {
+		return f.cols
+	}
+	return f.rows
+}
+
+func (f *frame) setSize(n int) {
+	if f.parent != nil && f.parent.vertical {
+		f.cols = n
+	} else {
+		f.rows = n
+	}
+}
+
+// minSize returns how small f can get along the direction of its parent.
+func (f *frame) minSize() int {
+	vertical := f.parent != nil && f.parent.vertical
+	if f.win != nil {
+		if vertical {
+			return minWindowCols
+		}
+		return minWindowRows
+	}
+	n := 0
+	for _, c := range f.children {
+		if f.vertical == vertical {
+			n += c.minSize()
+		} else {
+			n = max(n, c.minSize())
+		}
+	}
+	if f.vertical && vertical {
+		n += len(f.children) - 1 // separators
+	}
+	return n
+}
+
+// layout places f and everything in it at the given position and size,
+// growing or shrinking its last children to fit.
+func (f *frame) layout(top, left, rows, cols int) {
+	f.rows, f.cols = rows, cols
+	if f.win != nil {
+		f.win.top, f.win.left = top, left
+		f.win.screenRows, f.win.screenCols = max(rows-1, 0), cols
+		return
+	}
+	avail := rows
+	if f.vertical {
+		avail = cols - (len(f.children) - 1)
+	}
+	sizes := make([]int, len(f.children))
+	total := 0
+	for i, c := range f.children {
+		sizes[i] = c.size()
+		total += sizes[i]
+	}
+	// hand out or take back the difference, starting from the last child.
+	for i := len(sizes) - 1; i >= 0 && total != avail; i-- {
+		if total < avail {
+			sizes[i] += avail - total
+			total = avail
+		} else {
+			cut := min(total-avail, sizes[i]-f.children[i].minSize())
+			if cut > 0 {
+				sizes[i] -= cut
+				total -= cut
+			}
+		}
+	}
+	for i, c := range f.children {
+		if f.vertical {
+			c.layout(top, left, rows, sizes[i])
+			left += sizes[i] + 1
+		} else {
+			c.layout(top, left, sizes[i], cols)
+			top += sizes[i]
+		}
+	}
+}
+
+// windows returns the windows in f, from top left to bottom right.
+func (f *frame) windows() []*Window {
+	if f.win != nil {
+		return []*Window{f.win}
+	}
+	var ws []*Window
+	for _, c := range f.children {
+		ws = append(ws, c.windows()...)
+	}
+	return ws
+}
+
+// layoutWindows places the windows of the current tab page on the screen,
+// between the tab line and the message bar.
+func (e *Editor) layoutWindows() {
+	top := e.tabLineRows()
+	e.layout.layout(top, 0, e.termRows-1-top, e.termCols)
+}
+
+// windows returns the windows of the current tab page, from top left to
+// bottom right.
+func (e *Editor) windows() []*Window {
+	return e.layout.windows()
+}
+
+// showWindow makes w the current window.
+func (e *Editor) showWindow(w *Window) {
+	if w == e.Window {
+		return
+	}
+	e.commitUndo()
+	e.Buffer.lastView = e.view
+	e.Window = w
+	e.clampCursor()
+}
+
+// SplitWindow splits the current window in two, the new window going above
+// it or, with vertical set, to its left. The new window shows filename, or
+// the same buffer when filename is empty, and becomes the current window.
+func (e *Editor) SplitWindow(vertical bool, filename string) error {
+	old := e.Window
+	f := old.frame
+	size := f.rows
+	if vertical {
+		size = f.cols - 1
+	}
+	least := minWindowRows
+	if vertical {
+		least = minWindowCols
+	}
+	if size < 2*least {
+		return ErrNoRoom
+	}
+
+	w := newWindow(old.Buffer)
+	w.view = old.view
+	nf := w.frame
+	nf.rows, nf.cols = f.rows, f.cols
+	if p := f.parent; p != nil && p.vertical == vertical {
+		nf.parent = p
+		i := slices.Index(p.children, f)
+		p.children = slices.Insert(p.children, i, nf)
+	} else {
+		// f turns into a stack or row of the new window and the old one.
+		old.frame = &frame{win: old, rows: f.rows, cols: f.cols}
+		f.win = nil
+		f.vertical = vertical
+		f.children = []*frame{nf, old.frame}
+		nf.parent, old.frame.parent = f, f
+		f = old.frame
+	}
+	nf.setSize(size - size/2)
+	f.setSize(size / 2)
+	e.layoutWindows()
+
+	e.showWindow(w)
+	if filename != "" {
+		if err := e.EditFile(filename, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseWindow closes w, a window of the current tab page. Closing its last
+// window closes the tab page, unless it is the last one.
+func (e *Editor) CloseWindow(w *Window) error {
+	f := w.frame
+	p := f.parent
+	if p == nil {
+		if len(e.tabs) > 1 {
+			return e.CloseTab(e.TabPage)
+		}
+		return errors.New("Cannot close last window")
+	}
+	i := slices.Index(p.children, f)
+	p.children = slices.Delete(p.children, i, i+1)
+	// the space goes to the frame before, or after for the first one.
+	n := p.children[max(i-1, 0)]
+	grow := f.size()
+	if p.vertical {
+		grow++ // the separator
+	}
+	n.setSize(n.size() + grow)
+
+	if len(p.children) == 1 {
+		// a stack of one is the frame itself.
+		c := p.children[0]
+		c.rows, c.cols = p.rows, p.cols
+		c.parent = p.parent
+		if g := p.parent; g != nil {
+			j := slices.Index(g.children, p)
+			if c.win == nil && c.vertical == g.vertical {
+				for _, cc := range c.children {
+					cc.parent = g
+				}
+				g.children = slices.Replace(g.children, j, j+1, c.children...)
+			} else {
+				g.children[j] = c
+			}
+		} else {
+			e.layout = c
+			c.parent = nil
+		}
+	}
+	e.layoutWindows()
+
+	if w == e.Window {
+		next := n
+		for next.win == nil {
+			next = next.children[0]
+		}
+		e.showWindow(next.win)
+	}
+	return nil
+}
+
+// quitWindow closes the current window for :q, unless it is the last one,
+// which quits the editor instead. It reports whether there were other
+// windows.
+func (e *Editor) quitWindow(force bool) (bool, error) {
+	if len(e.windows()) == 1 && len(e.tabs) == 1 {
+		return false, nil
+	}
+	if e.dirty > 0 && !Hidden && !force {
+		// the changes are only lost with the last window showing them.
+		shown := 0
+		for _, w := range e.allWindows() {
+			if w.Buffer == e.Buffer {
+				shown++
+			}
+		}
+		if shown == 1 {
+			return true, ErrNoWriteSinceLastChange
+		}
+	}
+	return true, e.CloseWindow(e.Window)
+}
+
+// Quit closes the current window, or the editor along with the last one,
+// which it reports by returning ErrQuitEditor. Unsaved changes are kept
+// unless force is set.
+func (e *Editor) Quit(force bool) error {
+	if ok, err := e.quitWindow(force); ok {
+		return err
+	}
+	if !force {
+		if e.dirty > 0 {
+			return errors.New("ERROR!!! File has unsaved changes")
+		}
+		if b := e.modifiedBuffer(); b != nil {
+			return fmt.Errorf("ERROR!!! Buffer %d has unsaved changes", b.number)
+		}
+	}
+	io.WriteString(e.term, "\x1b[2J") // clear the screen
+	io.WriteString(e.term, "\x1b[H")  // reposition the cursor
+	return ErrQuitEditor
+}
+
+// OnlyWindow closes every window but the current one.
+func (e *Editor) OnlyWindow() {
+	e.layout = e.Window.frame
+	e.layout.parent = nil
+	e.layoutWindows()
+}
+
+// ResizeWindow makes the current window n lines taller, or n columns wider
+// with vertical set. n is negative to make it smaller.
+func (e *Editor) ResizeWindow(vertical bool, n int) {
+	// find the frame that is laid out in the direction to resize.
+	f := e.Window.frame
+	for f.parent != nil && f.parent.vertical != vertical {
+		f = f.parent
+	}
+	p := f.parent
+	if p == nil {
+		return
+	}
+	i := slices.Index(p.children, f)
+	if n < 0 {
+		n = -min(-n, f.size()-f.minSize())
+		// the frame after takes the space, or the one before for the last
+		// frame.
+		j := i + 1
+		if j == len(p.children) {
+			j = i - 1
+		}
+		p.children[j].setSize(p.children[j].size() - n)
+		f.setSize(f.size() + n)
+	} else {
+		// take the space from the frames after, then from those before.
+		order := slices.Concat(p.children[i+1:], reversed(p.children[:i]))
+		for _, s := range order {
+			take := min(n, s.size()-s.minSize())
+			if take <= 0 {
+				continue
+			}
+			s.setSize(s.size() - take)
+			f.setSize(f.size() + take)
+			n -= take
+		}
+	}
+	e.layoutWindows()
+}
+
+func reversed[T any](s []T) []T {
+	s = slices.Clone(s)
+	slices.Reverse(s)
+	return s
+}
+
+// EqualizeWindows makes all windows about the same size.
+func (e *Editor) EqualizeWindows() {
+	var equalize func(f *frame)
+	equalize = func(f *frame) {
+		if f.win != nil {
+			return
+		}
+		avail := f.rows
+		if f.vertical {
+			avail = f.cols - (len(f.children) - 1)
+		}
+		for i, c := range f.children {
+			n := avail / len(f.children)
+			if i < avail%len(f.children) {
+				n++
+			}
+			c.setSize(n)
+			if f.vertical {
+				c.rows = f.rows
+			} else {
+				c.cols = f.cols
+			}
+			equalize(c)
+		}
+	}
+	equalize(e.layout)
+	e.layoutWindows()
+}
+
+// windowAt returns the window whose text or status line is at the given
+// screen position.
+func (e *Editor) windowAt(row, col int) *Window {
+	for _, w := range e.windows() {
+		if row >= w.top && row <= w.top+w.screenRows && col >= w.left && col < w.left+w.screenCols {
+			return w
+		}
+	}
+	return nil
+}
+
+// MoveToWindow goes count windows in the direction of the h, j, k or l key,
+// starting from the cursor.
+func (e *Editor) MoveToWindow(dir keys.Key, count int) {
+	for ; count > 0; count-- {
+		w := e.Window
+		row := w.top + e.cy - e.rowOffset
+		col := w.left + min(e.gutterWidth()+e.rx-e.colOffset, w.screenCols-1)
+		switch dir {
+		case 'h':
+			col = w.left - 2
+		case 'l':
+			col = w.left + w.screenCols + 1
+		case 'k':
+			row = w.top - 1
+		case 'j':
+			row = w.top + w.screenRows + 1
+		}
+		next := e.windowAt(row, col)
+		if next == nil {
+			return
+		}
+		e.showWindow(next)
+	}
+}
+
+// windowCommands are the commands typed after Ctrl-W.
+var windowCommands = map[string]func(e *Editor, count int) error{
+	"s": func(e *Editor, _ int) error { return e.SplitWindow(false, "") },
+	"v": func(e *Editor, _ int) error { return e.SplitWindow(true, "") },
+	"h": func(e *Editor, count int) error { e.MoveToWindow('h', count); return nil },
+	"j": func(e *Editor, count int) error { e.MoveToWindow('j', count); return nil },
+	"k": func(e *Editor, count int) error { e.MoveToWindow('k', count); return nil },
+	"l": func(e *Editor, count int) error { e.MoveToWindow('l', count); return nil },
+	"w": func(e *Editor, count int) error { e.cycleWindow(count); return nil },
+	"W": func(e *Editor, count int) error { e.cycleWindow(-count); return nil },
+	"c": func(e *Editor, _ int) error {
+		// like q, but the last window is left open.
+		if ok, err := e.quitWindow(false); ok {
+			return err
+		}
+		return e.CloseWindow(e.Window)
+	},
+	"q": func(e *Editor, _ int) error { return e.Quit(false) },
+	"o": func(e *Editor, _ int) error { e.OnlyWindow(); return nil },
+	"+": func(e *Editor, count int) error { e.ResizeWindow(false, count); return nil },
+	"-": func(e *Editor, count int) error { e.ResizeWindow(false, -count); return nil },
+	">": func(e *Editor, count int) error { e.ResizeWindow(true, count); return nil },
+	"<": func(e *Editor, count int) error { e.ResizeWindow(true, -count); return nil },
+	"=": func(e *Editor, _ int) error { e.EqualizeWindows(); return nil },
+	"_": func(e *Editor, _ int) error { e.ResizeWindow(false, e.termRows); return nil },
+	"|": func(e *Editor, _ int) error { e.ResizeWindow(true, e.termCols); return nil },
+}
+
+func init() {
+	for k, fn := range windowCommands {
+		name := string(rune(keys.Ctrl('w'))) + k
+		normalCommands[name] = func(e *Editor, count int) error {
+			if err := fn(e, count); err != nil {
+				if errors.Is(err, ErrQuitEditor) {
+					return err
+				}
+				e.SetStatusMessage("%s", err)
+			}
+			return nil
+		}
+	}
+}
+
+// cycleWindow moves count windows forward, or backward when count is
+// negative, going round at the ends.
+func (e *Editor) cycleWindow(count int) {
+	ws := e.windows()
+	i := slices.Index(ws, e.Window)
+	n := len(ws)
+	e.showWindow(ws[((i+count)%n+n)%n])
+}
+
+// windowCommand runs the window commands. It reports false for other
+// commands.
+func (e *Editor) windowCommand(name string, args []string) (bool, error) {
+	arg := strings.Join(args, " ")
+	vertical := false
+	if name == "vert" || name == "vertical" {
+		vertical = true
+		if len(args) == 0 {
+			return true, errors.New("Argument required")
+		}
+		name, args = args[0], args[1:]
+		arg = strings.Join(args, " ")
+	}
+
+	switch name {
+	case "sp", "split":
+		return true, e.SplitWindow(vertical, arg)
+	case "vs", "vsplit":
+		return true, e.SplitWindow(true, arg)
+	case "clo", "close":
+		return true, e.CloseWindow(e.Window)
+	case "on", "only":
+		e.OnlyWindow()
+		return true, nil
+	case "res", "resize":
+		size := e.Window.frame.rows
+		if vertical {
+			size = e.Window.frame.cols
+		}
+		if arg == "" {
+			e.ResizeWindow(vertical, e.termRows+e.termCols)
+			return true, nil
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return true, fmt.Errorf("Invalid size %q", arg)
+		}
+		if arg[0] == '+' || arg[0] == '-' {
+			e.ResizeWindow(vertical, n)
+		} else {
+			if !vertical {
+				n++ // the status line
+			}
+			e.ResizeWindow(vertical, n-size)
+		}
+		return true, nil
+	}
+	return false, nil
+}
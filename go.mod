@@ -3,7 +3,9 @@ module github.com/amirali/virayeshgar
 go 1.22.0
 
 require (
-	github.com/mattn/go-runewidth v0.0.15 // indirect
-	github.com/rivo/uniseg v0.2.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
+	github.com/mattn/go-runewidth v0.0.15
+	golang.org/x/sys v0.18.0
+	golang.org/x/text v0.14.0
 )
+
+require github.com/rivo/uniseg v0.2.0
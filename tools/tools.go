@@ -2,7 +2,7 @@ package tools
 
 import (
 	"fmt"
-	"os"
+	"io"
 	"strings"
 	"unicode"
 )
@@ -35,11 +35,13 @@ func Utf8Slice(s string, start, end int) string {
 	return string([]rune(s)[start:end])
 }
 
-func GetCursorPosition() (row, col int, err error) {
-	if _, err = os.Stdout.Write([]byte("\x1b[6n")); err != nil {
+// GetCursorPosition asks the terminal at w for the position of the cursor
+// and reads the answer from r.
+func GetCursorPosition(r io.Reader, w io.Writer) (row, col int, err error) {
+	if _, err = w.Write([]byte("\x1b[6n")); err != nil {
 		return
 	}
-	if _, err = fmt.Fscanf(os.Stdin, "\x1b[%d;%d", &row, &col); err != nil {
+	if _, err = fmt.Fscanf(r, "\x1b[%d;%dR", &row, &col); err != nil {
 		return
 	}
 	return